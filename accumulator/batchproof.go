@@ -257,6 +257,8 @@ type targPos struct {
 // TODO OH WAIT -- this is not how to to it!  Don't hash all the way up to the
 // roots to verify -- just hash up to any populated node!  Saves a ton of CPU!
 func verifyBatchProof(targetHashes []Hash, bp BatchProof, roots []Hash, numLeaves uint64,
+	// hasher is the hash function the accumulator was built with.
+	hasher Hasher,
 	// cached should be a function that fetches nodes from the pollard and
 	// indicates whether they exist or not, this is only useful for the pollard
 	// and nil should be passed for the forest.
@@ -404,6 +406,7 @@ func verifyBatchProof(targetHashes []Hash, bp BatchProof, roots []Hash, numLeave
 
 		// check if the parent is cached
 		parentPos := parent(target.Pos, rows)
+		parentRow := detectRow(parentPos, rows)
 		isParentCached, cachedParent := cached(parentPos)
 
 		var hash Hash
@@ -427,7 +430,7 @@ func verifyBatchProof(targetHashes []Hash, bp BatchProof, roots []Hash, numLeave
 					return nil, nil, err
 				}
 			} else {
-				hash = parentHash(left.Val, right.Val)
+				hash = hasher.ParentHash(parentRow, left.Val, right.Val)
 				if hash != cachedParent {
 					// The calculated hash did not match the cached parent.
 					err := fmt.Errorf("verifyBatchProof: calculated parent hash of %x doesn't"+
@@ -437,7 +440,7 @@ func verifyBatchProof(targetHashes []Hash, bp BatchProof, roots []Hash, numLeave
 				}
 			}
 		} else {
-			hash = parentHash(left.Val, right.Val)
+			hash = hasher.ParentHash(parentRow, left.Val, right.Val)
 		}
 
 		// sort the miniTrees by which tree they are in
@@ -3,6 +3,7 @@ package accumulator
 import (
 	"encoding/binary"
 	"fmt"
+	"io"
 	"os"
 	"sort"
 	"time"
@@ -64,6 +65,9 @@ type Forest struct {
 	// map from hashes to positions.
 	positionMap map[MiniHash]uint64
 
+	// hasher computes the parent hashes.  nil means DefaultHasher.
+	hasher Hasher
+
 	/*
 	 * below are just for testing / benchmarking
 	 */
@@ -151,6 +155,22 @@ func NewForest(forestType ForestType, forestFile *os.File, cowPath string, cowMa
 	return f
 }
 
+// Hasher returns the hasher the forest uses
+func (f *Forest) Hasher() Hasher {
+	return hasherOrDefault(f.hasher)
+}
+
+// SetHasher sets the hash function for the forest.  Can only be done while
+// the forest is empty, as existing hashes wouldn't match.
+func (f *Forest) SetHasher(h Hasher) error {
+	if f.numLeaves != 0 {
+		return fmt.Errorf("SetHasher: forest already has %d leaves",
+			f.numLeaves)
+	}
+	f.hasher = h
+	return nil
+}
+
 // TODO forest.removev4 and pollard.rem2 are VERY similar.  It seems like
 // whether it's forest or pollard, most of the complicated stuff is the same.
 // so maybe they can both satisfy an interface.  In the case of remove, the only
@@ -341,7 +361,8 @@ func (f *Forest) reHash(dirt []uint64) error {
 			if f.data.read(left) == empty || f.data.read(right) == empty {
 				f.data.write(parpos, empty)
 			} else {
-				par := parentHash(f.data.read(left), f.data.read(right))
+				par := f.Hasher().ParentHash(
+					r+1, f.data.read(left), f.data.read(right))
 				f.historicHashes++
 				f.data.write(parpos, par)
 			}
@@ -393,7 +414,7 @@ func (f *Forest) addv2(adds []Leaf) {
 			rootPos := len(positionList.list) - int(h+1)
 			// grab, pop, swap, hash, new
 			root := f.data.read(positionList.list[rootPos]) // grab
-			n = parentHash(root, n)                         // hash
+			n = f.Hasher().ParentHash(h+1, root, n)         // hash
 			pos = parent(pos, f.rows)                       // rise
 			f.data.write(pos, n)                            // write
 		}
@@ -545,13 +566,17 @@ func (f *Forest) PosMapSanity() error {
 }
 
 // RestoreForest restores the forest on restart. Needed when resuming after exiting.
-// miscForestFile is where numLeaves and rows is stored
+// miscForestFile is where numLeaves, rows and the hasher id is stored.
+// Returns an error if the forest was built with a different hasher than
+// the one given.  A nil hasher means DefaultHasher.
 func RestoreForest(
 	miscForestFile *os.File, forestFile *os.File,
-	toRAM, cached bool, cow string, cowMaxCache int) (*Forest, error) {
+	toRAM, cached bool, cow string, cowMaxCache int,
+	hasher Hasher) (*Forest, error) {
 
 	// start a forest for restore
 	f := new(Forest)
+	f.hasher = hasher
 
 	// Restore the numLeaves
 	err := binary.Read(miscForestFile, binary.BigEndian, &f.numLeaves)
@@ -561,7 +586,19 @@ func RestoreForest(
 	// Restore number of rows
 	// TODO optimize away "rows" and only save in minimzed form
 	// (this requires code to shrink the forest
-	binary.Read(miscForestFile, binary.BigEndian, &f.rows)
+	err = binary.Read(miscForestFile, binary.BigEndian, &f.rows)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check the hasher.  Older misc files don't have it, and those
+	// were always built with the default.
+	var hasherID HasherID
+	err = binary.Read(miscForestFile, binary.BigEndian, &hasherID)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	err = checkHasherID(hasherID, hasher)
 	if err != nil {
 		return nil, err
 	}
@@ -626,6 +663,28 @@ func RestoreForest(
 	return f, nil
 }
 
+// RamCopy returns a copy of the forest with all its hashes in ram, so it
+// can be changed without changing f.  It needs as much ram as a RamForest.
+func (f *Forest) RamCopy() *Forest {
+	ramData := new(ramForestData)
+	ramData.resize((2 << f.rows) - 1)
+	for pos := uint64(0); pos < ramData.size(); pos++ {
+		ramData.write(pos, f.data.read(pos))
+	}
+
+	positionMap := make(map[MiniHash]uint64, len(f.positionMap))
+	for mini, pos := range f.positionMap {
+		positionMap[mini] = pos
+	}
+	return &Forest{
+		numLeaves:   f.numLeaves,
+		rows:        f.rows,
+		data:        ramData,
+		positionMap: positionMap,
+		hasher:      f.hasher,
+	}
+}
+
 func (f *Forest) PrintPositionMap() string {
 	var s string
 	for pos := uint64(0); pos < f.numLeaves; pos++ {
@@ -636,8 +695,32 @@ func (f *Forest) PrintPositionMap() string {
 	return s
 }
 
-// WriteMiscData writes the numLeaves and rows to miscForestFile
+// WriteMiscData writes the numLeaves, rows and hasher id to miscForestFile
+// and closes the forest data.  Use SaveMiscData if the forest is still
+// going to be used.
 func (f *Forest) WriteMiscData(miscForestFile *os.File) error {
+	err := f.writeMisc(miscForestFile)
+	if err != nil {
+		return err
+	}
+
+	f.data.close()
+
+	return nil
+}
+
+// SaveMiscData writes the same things as WriteMiscData, but only flushes the
+// forest data to disk instead of closing it, so the forest can keep going.
+func (f *Forest) SaveMiscData(miscForestFile *os.File) error {
+	err := f.writeMisc(miscForestFile)
+	if err != nil {
+		return err
+	}
+
+	return f.data.sync()
+}
+
+func (f *Forest) writeMisc(miscForestFile *os.File) error {
 	err := binary.Write(miscForestFile, binary.BigEndian, f.numLeaves)
 	if err != nil {
 		return err
@@ -648,9 +731,7 @@ func (f *Forest) WriteMiscData(miscForestFile *os.File) error {
 		return err
 	}
 
-	f.data.close()
-
-	return nil
+	return binary.Write(miscForestFile, binary.BigEndian, f.Hasher().ID())
 }
 
 // WriteForestToDisk writes the whole forest to disk
@@ -691,6 +772,17 @@ func (f *Forest) getRoots() []Hash {
 	return roots
 }
 
+// GetRoots returns the hashes of all the roots, biggest tree first
+func (f *Forest) GetRoots() []Hash {
+	return f.getRoots()
+}
+
+// ReconstructStats returns numleaves and rows, same as for the Pollard, so
+// that proofs from the forest can be checked against its roots.
+func (f *Forest) ReconstructStats() (uint64, uint8) {
+	return f.numLeaves, f.rows
+}
+
 // Stats returns the current forest statics as a string. This includes
 // number of total leaves, historic hashes, length of the position map,
 // and the size of the forest
@@ -2,6 +2,7 @@ package accumulator
 
 import (
 	"fmt"
+	"io/ioutil"
 	"math/rand"
 	"os"
 	"reflect"
@@ -195,6 +196,47 @@ func TestCowForestAddDel(t *testing.T) {
 	}
 }
 
+// Changing a RamCopy of a disk forest leaves the disk forest alone
+func TestForestRamCopy(t *testing.T) {
+	file, err := ioutil.TempFile("", "ramcopytest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	diskF := NewForest(DiskForest, file, "", 0)
+	ramF := NewForest(RamForest, nil, "", 0)
+
+	sc := newSimChain(0x07)
+	forests := []*Forest{diskF, ramF}
+	var roots []Hash
+	for b := 0; b < 100; b++ {
+		if b == 50 {
+			// the copy carries on instead
+			roots = diskF.GetRoots()
+			forests[0] = diskF.RamCopy()
+		}
+		adds, _, delHashes := sc.NextBlock(10)
+		for _, f := range forests {
+			bp, err := f.ProveBatch(delHashes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = f.Modify(adds, bp.Targets)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if !reflect.DeepEqual(forests[0].GetRoots(), ramF.GetRoots()) {
+		t.Fatalf("copy roots %v, expect %v",
+			forests[0].GetRoots(), ramF.GetRoots())
+	}
+	if !reflect.DeepEqual(diskF.GetRoots(), roots) {
+		t.Fatalf("disk forest roots %v after changing the copy, expect %v",
+			diskF.GetRoots(), roots)
+	}
+}
+
 func TestForestFixed(t *testing.T) {
 	f := NewForest(RamForest, nil, "", 0)
 	numadds := 5
@@ -333,7 +375,8 @@ func addDelFullBatchProof(nAdds, nDels int) error {
 		return err
 	}
 	// check block proof.  Note this doesn't delete anything, just proves inclusion
-	_, _, err = verifyBatchProof(leavesToProve, bp, f.getRoots(), f.numLeaves, nil)
+	_, _, err = verifyBatchProof(leavesToProve, bp, f.getRoots(), f.numLeaves,
+		f.Hasher(), nil)
 	if err != nil {
 		return fmt.Errorf("VerifyBatchProof failed. Error: %s", err.Error())
 	}
@@ -44,6 +44,10 @@ type ForestData interface {
 	// can't resize down
 	resize(newSize uint64) // make it have a new size (bigger)
 
+	// writes out anything held in memory so the forest-on-disk can be
+	// restored from, but keeps it open for more changes
+	sync() error
+
 	// closes the forest-on-disk for stopping
 	close()
 }
@@ -105,6 +109,11 @@ func (r *ramForestData) resize(newSize uint64) {
 	r.m = append(r.m, make([]byte, (newSize-r.size())*leafSize)...)
 }
 
+func (r *ramForestData) sync() error {
+	// a ram forest gets written out with WriteForestToDisk
+	return nil
+}
+
 func (r *ramForestData) close() {
 	// nothing to do here fro a ram forest.
 }
@@ -950,6 +959,14 @@ func (cow *cowForest) resize(newSize uint64) {
 }
 
 // closes the cowForest for exit
+func (cow *cowForest) sync() error {
+	err := cow.commit()
+	if err != nil {
+		return err
+	}
+	return cow.clean()
+}
+
 func (cow *cowForest) close() {
 	fmt.Printf("cow cached hits:%v, misses:%v\n",
 		cow.hits, cow.misses)
@@ -1249,6 +1266,10 @@ func (d *diskForestData) resize(newSize uint64) {
 	}
 }
 
+func (d *diskForestData) sync() error {
+	return d.file.Sync()
+}
+
 func (d *diskForestData) close() {
 	err := d.file.Close()
 	if err != nil {
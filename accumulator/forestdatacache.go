@@ -384,6 +384,11 @@ func (d *cacheForestData) resize(newSize uint64) {
 	d.hashCount = newSize
 }
 
+func (d *cacheForestData) sync() error {
+	flushCacheToDisk(d)
+	return d.file.Sync()
+}
+
 func (d *cacheForestData) close() {
 	flushCacheToDisk(d)
 }
@@ -96,11 +96,11 @@ func (f *Forest) Verify(p Proof) bool {
 		// detect current row parity
 		if 1<<uint(h)&p.Position == 0 {
 			//			fmt.Printf("compute %04x %04x -> ", n[:4], sib[:4])
-			n = parentHash(n, sib)
+			n = f.Hasher().ParentHash(uint8(h+1), n, sib)
 			//			fmt.Printf("%04x\n", n[:4])
 		} else {
 			//			fmt.Printf("compute %04x %04x -> ", sib[:4], n[:4])
-			n = parentHash(sib, n)
+			n = f.Hasher().ParentHash(uint8(h+1), sib, n)
 			//			fmt.Printf("%04x\n", n[:4])
 		}
 	}
@@ -199,6 +199,7 @@ func (f *Forest) ProveBatch(hs []Hash) (BatchProof, error) {
 
 // VerifyBatchProof is just a wrapper around verifyBatchProof
 func (f *Forest) VerifyBatchProof(toProve []Hash, bp BatchProof) error {
-	_, _, err := verifyBatchProof(toProve, bp, f.getRoots(), f.numLeaves, nil)
+	_, _, err := verifyBatchProof(
+		toProve, bp, f.getRoots(), f.numLeaves, f.Hasher(), nil)
 	return err
 }
@@ -1,5 +1,240 @@
 package accumulator
 
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash/fnv"
+)
+
+// HasherID identifies a Hasher.  It's written alongside the forest and
+// pollard state so that state built with one hash function doesn't get
+// loaded and used with another.
+type HasherID uint8
+
+const (
+	// HasherSha512_256 is the original utreexo hash and the default.
+	HasherSha512_256 HasherID = iota
+	// HasherSha256 is plain single sha256.
+	HasherSha256
+	// HasherTaggedSha256 is BIP340 style tagged sha256, with separate tags
+	// for leaves and parents.
+	HasherTaggedSha256
+
+	// HasherCheapTest is a fast non-cryptographic hash.  Only for tests and
+	// benchmarks, never use it for anything real.
+	HasherCheapTest HasherID = 0x7f
+
+	// HasherRowCommit is set in the id of hashers that commit to the row of
+	// the parent.  The low bits are the id of the underlying hasher.
+	HasherRowCommit HasherID = 0x80
+)
+
+// Hasher is the hash function used to build the accumulator.
+type Hasher interface {
+	// ID returns the identifier written to serialized state.
+	ID() HasherID
+	// ParentHash gets you the merkle parent of two children hashes.
+	// row is the row the parent is on; 1 for the parent of two leaves.
+	// Hashers that don't commit to the row ignore it.
+	ParentHash(row uint8, l, r Hash) Hash
+	// Sum hashes arbitrary data, such as serialized leaf data.
+	Sum(b []byte) Hash
+}
+
+var (
+	// DefaultHasher is what a Forest or Pollard uses when no hasher is set.
+	DefaultHasher Hasher = sha512_256Hasher{}
+
+	// Sha256Hasher uses single sha256 for everything.
+	Sha256Hasher Hasher = sha256Hasher{}
+
+	// TaggedSha256Hasher uses tagged sha256 with the tags "UtreexoParent"
+	// and "UtreexoLeaf".
+	TaggedSha256Hasher Hasher = newTaggedSha256Hasher(
+		"UtreexoParent", "UtreexoLeaf")
+
+	// CheapTestHasher is an insecure hasher for tests.
+	CheapTestHasher Hasher = cheapTestHasher{}
+)
+
+// HasherFromID returns the Hasher for the given id
+func HasherFromID(id HasherID) (Hasher, error) {
+	if id&HasherRowCommit != 0 {
+		h, err := HasherFromID(id &^ HasherRowCommit)
+		if err != nil {
+			return nil, err
+		}
+		return RowCommitting(h), nil
+	}
+	switch id {
+	case HasherSha512_256:
+		return DefaultHasher, nil
+	case HasherSha256:
+		return Sha256Hasher, nil
+	case HasherTaggedSha256:
+		return TaggedSha256Hasher, nil
+	case HasherCheapTest:
+		return CheapTestHasher, nil
+	}
+	return nil, fmt.Errorf("unknown hasher id %d", id)
+}
+
+// hasherOrDefault returns h, or the DefaultHasher if h is nil.  Lets the
+// zero value of Forest and Pollard work as before.
+func hasherOrDefault(h Hasher) Hasher {
+	if h == nil {
+		return DefaultHasher
+	}
+	return h
+}
+
+// checkHasherID returns an error if the id read from serialized state
+// doesn't match the hasher we're trying to restore with
+func checkHasherID(id HasherID, h Hasher) error {
+	if id != hasherOrDefault(h).ID() {
+		return fmt.Errorf("state built with hasher %d but restoring "+
+			"with hasher %d", id, hasherOrDefault(h).ID())
+	}
+	return nil
+}
+
+// sha512_256Hasher is the default hasher
+type sha512_256Hasher struct{}
+
+func (sha512_256Hasher) ID() HasherID { return HasherSha512_256 }
+
+func (sha512_256Hasher) ParentHash(_ uint8, l, r Hash) Hash {
+	return parentHash(l, r)
+}
+
+func (sha512_256Hasher) Sum(b []byte) Hash {
+	return sha512.Sum512_256(b)
+}
+
+// sha256Hasher hashes with single sha256
+type sha256Hasher struct{}
+
+func (sha256Hasher) ID() HasherID { return HasherSha256 }
+
+func (sha256Hasher) ParentHash(_ uint8, l, r Hash) Hash {
+	if l == empty || r == empty {
+		panic("got an empty leaf here. ")
+	}
+	var buf [64]byte
+	copy(buf[:32], l[:])
+	copy(buf[32:], r[:])
+	return sha256.Sum256(buf[:])
+}
+
+func (sha256Hasher) Sum(b []byte) Hash {
+	return sha256.Sum256(b)
+}
+
+// taggedSha256Hasher computes sha256(sha256(tag) || sha256(tag) || msg).
+// The tag hashes are precomputed.
+type taggedSha256Hasher struct {
+	parentTag, leafTag [64]byte
+}
+
+func newTaggedSha256Hasher(parentTag, leafTag string) taggedSha256Hasher {
+	var t taggedSha256Hasher
+	p := sha256.Sum256([]byte(parentTag))
+	l := sha256.Sum256([]byte(leafTag))
+	copy(t.parentTag[:32], p[:])
+	copy(t.parentTag[32:], p[:])
+	copy(t.leafTag[:32], l[:])
+	copy(t.leafTag[32:], l[:])
+	return t
+}
+
+func (taggedSha256Hasher) ID() HasherID { return HasherTaggedSha256 }
+
+func (t taggedSha256Hasher) ParentHash(_ uint8, l, r Hash) Hash {
+	if l == empty || r == empty {
+		panic("got an empty leaf here. ")
+	}
+	h := sha256.New()
+	h.Write(t.parentTag[:])
+	h.Write(l[:])
+	h.Write(r[:])
+	rh := Hash{}
+	copy(rh[:], h.Sum(nil))
+	return rh
+}
+
+func (t taggedSha256Hasher) Sum(b []byte) Hash {
+	h := sha256.New()
+	h.Write(t.leafTag[:])
+	h.Write(b)
+	rh := Hash{}
+	copy(rh[:], h.Sum(nil))
+	return rh
+}
+
+// cheapTestHasher is two fnv-128a hashes stuck together.  Not collision
+// resistant at all.
+type cheapTestHasher struct{}
+
+func (cheapTestHasher) ID() HasherID { return HasherCheapTest }
+
+func (c cheapTestHasher) ParentHash(_ uint8, l, r Hash) Hash {
+	if l == empty || r == empty {
+		panic("got an empty leaf here. ")
+	}
+	var buf [64]byte
+	copy(buf[:32], l[:])
+	copy(buf[32:], r[:])
+	return c.Sum(buf[:])
+}
+
+func (cheapTestHasher) Sum(b []byte) Hash {
+	rh := Hash{}
+	h := fnv.New128a()
+	h.Write(b)
+	copy(rh[:16], h.Sum(nil))
+	// second half commits to the first so it's not just a repeat
+	h.Write(rh[:16])
+	copy(rh[16:], h.Sum(nil))
+	return rh
+}
+
+// RowCommitting returns a hasher that puts the row of the parent into every
+// parent hash, so that a node can't be passed off as one from another row.
+// Leaf hashes are the same as the underlying hasher's.
+func RowCommitting(h Hasher) Hasher {
+	h = hasherOrDefault(h)
+	if h.ID()&HasherRowCommit != 0 {
+		return h
+	}
+	return rowCommitHasher{base: h}
+}
+
+// rowCommitHasher hashes the row byte followed by the two children with the
+// underlying hasher's Sum.
+type rowCommitHasher struct {
+	base Hasher
+}
+
+func (r rowCommitHasher) ID() HasherID {
+	return r.base.ID() | HasherRowCommit
+}
+
+func (r rowCommitHasher) ParentHash(row uint8, lh, rh Hash) Hash {
+	if lh == empty || rh == empty {
+		panic("got an empty leaf here. ")
+	}
+	var buf [65]byte
+	buf[0] = row
+	copy(buf[1:33], lh[:])
+	copy(buf[33:], rh[:])
+	return r.base.Sum(buf[:])
+}
+
+func (r rowCommitHasher) Sum(b []byte) Hash {
+	return r.base.Sum(b)
+}
+
 // hashableNode is the data needed to perform a hash
 type hashableNode struct {
 	sib, dest *polNode
@@ -8,10 +243,11 @@ type hashableNode struct {
 
 // hashRow calculates new hashes for all the positions passed in
 func (f *Forest) hashRow(dirtpositions []uint64) error {
+	h := f.Hasher()
 	for _, hp := range dirtpositions {
 		l := f.data.read(child(hp, f.rows))
 		r := f.data.read(child(hp, f.rows) | 1)
-		f.data.write(hp, parentHash(l, r))
+		f.data.write(hp, h.ParentHash(detectRow(hp, f.rows), l, r))
 	}
 
 	return nil
@@ -0,0 +1,54 @@
+package accumulator
+
+import (
+	"testing"
+)
+
+func TestHasherFromID(t *testing.T) {
+	hashers := []Hasher{DefaultHasher, Sha256Hasher, TaggedSha256Hasher,
+		CheapTestHasher, RowCommitting(DefaultHasher),
+		RowCommitting(TaggedSha256Hasher)}
+
+	var l, r Hash
+	l[0], r[0] = 1, 2
+	for _, h := range hashers {
+		got, err := HasherFromID(h.ID())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.ID() != h.ID() {
+			t.Fatalf("got hasher %d for id %d", got.ID(), h.ID())
+		}
+		if got.ParentHash(3, l, r) != h.ParentHash(3, l, r) {
+			t.Fatalf("hasher %d from id hashes differently", h.ID())
+		}
+	}
+
+	_, err := HasherFromID(HasherID(0x42))
+	if err == nil {
+		t.Fatal("expected error for unknown hasher id")
+	}
+}
+
+func TestRowCommitting(t *testing.T) {
+	var l, r Hash
+	l[0], r[0] = 1, 2
+
+	h := RowCommitting(DefaultHasher)
+	if RowCommitting(h).ID() != h.ID() {
+		t.Fatal("RowCommitting wrapped twice")
+	}
+	if h.ParentHash(1, l, r) == h.ParentHash(2, l, r) {
+		t.Fatal("same parent hash on different rows")
+	}
+	if h.ParentHash(1, l, r) == DefaultHasher.ParentHash(1, l, r) {
+		t.Fatal("row committing parent hash same as default")
+	}
+	if h.Sum(l[:]) != DefaultHasher.Sum(l[:]) {
+		t.Fatal("row committing changed the leaf hash")
+	}
+	// legacy hashers ignore the row
+	if DefaultHasher.ParentHash(1, l, r) != DefaultHasher.ParentHash(5, l, r) {
+		t.Fatal("default hasher commits to row")
+	}
+}
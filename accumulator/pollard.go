@@ -41,10 +41,22 @@ type Pollard struct {
 	// TODO not currently implemented yet.
 	Lookahead int32
 
+	// UndoDepth is how many blocks back Undo can go.  0 means no undo
+	// history is kept.
+	UndoDepth int32
+
+	// history is what each of the last UndoDepth Modifies changed, and
+	// logging is the one Modify is currently adding to
+	history []*pollardState
+	logging *pollardState
+
 	// positionMap is maps hashes to positions.
 	// It is only used for fullPollard.
 	positionMap map[MiniHash]uint64
 
+	// hasher computes the parent hashes.  nil means DefaultHasher.
+	hasher Hasher
+
 	// Below are for keeping statistics.
 	// hashesEver is all the hashes that have ever been performed.
 	// rememberEver is all the nodes that have ever been cached.
@@ -53,12 +65,33 @@ type Pollard struct {
 	hashesEver, rememberEver, currentRemember, overWire uint64
 }
 
+// Hasher returns the hasher the pollard uses
+func (p *Pollard) Hasher() Hasher {
+	return hasherOrDefault(p.hasher)
+}
+
+// SetHasher sets the hash function for the pollard.  Must be called before
+// anything is added, and before restoring so the restored state can be
+// checked against it.
+func (p *Pollard) SetHasher(h Hasher) error {
+	if p.numLeaves != 0 {
+		return fmt.Errorf("SetHasher: pollard already has %d leaves",
+			p.numLeaves)
+	}
+	p.hasher = h
+	return nil
+}
+
 // Modify deletes then adds elements to the accumulator.
 func (p *Pollard) Modify(adds []Leaf, delsUn []uint64) error {
 	dels := make([]uint64, len(delsUn))
 	copy(dels, delsUn)
 	sortUint64s(dels)
 
+	// log what this block changes so it can be undone
+	p.saveState()
+	defer p.endState()
+
 	err := p.rem2(dels)
 	if err != nil {
 		return err
@@ -163,7 +196,7 @@ func (p *Pollard) addOne(add Hash, remember bool) error {
 	n.remember = remember
 
 	if p.positionMap != nil {
-		p.positionMap[add.Mini()] = p.numLeaves
+		p.setPosition(add.Mini(), p.numLeaves)
 
 		// Always remember everything for full pollard.
 		n.remember = true
@@ -174,10 +207,11 @@ func (p *Pollard) addOne(add Hash, remember bool) error {
 	var h uint8
 	for ; (p.numLeaves>>h)&1 == 1; h++ {
 		// grab, pop, swap, hash, new
+		p.touch(p.roots[len(p.roots)-1])
 		leftRoot := p.roots[len(p.roots)-1]                        // grab
 		p.roots = p.roots[:len(p.roots)-1]                         // pop
 		leftRoot.niece, n.niece = n.niece, leftRoot.niece          // swap
-		nHash := parentHash(leftRoot.data, n.data)                 // hash
+		nHash := p.Hasher().ParentHash(h+1, leftRoot.data, n.data) // hash
 		n = &polNode{data: nHash, niece: [2]*polNode{leftRoot, n}} // new
 		p.hashesEver++
 
@@ -216,7 +250,7 @@ func (p *Pollard) rem2(dels []uint64) error {
 
 	if p.positionMap != nil { // if fulpol, remove hashes from posMap
 		for _, delpos := range dels {
-			delete(p.positionMap, p.read(delpos).Mini())
+			p.deletePosition(p.read(delpos).Mini())
 		}
 	}
 
@@ -228,6 +262,7 @@ func (p *Pollard) rem2(dels []uint64) error {
 		if err != nil {
 			return err
 		}
+		p.touch(n)
 		if n.remember == true {
 			p.currentRemember--
 			n.remember = false
@@ -301,7 +336,9 @@ func (p *Pollard) rem2(dels []uint64) error {
 				// supposed to exist.
 				continue
 			}
-			hn.dest.data = hn.sib.auntOp()
+			p.touch(hn.dest)
+			p.touch(hn.sib)
+			hn.dest.data = hn.sib.auntOp(p.Hasher(), h+1)
 			hn.sib.prune()
 		}
 	}
@@ -321,6 +358,7 @@ func (p *Pollard) rem2(dels []uint64) error {
 		if nt == nil {
 			return fmt.Errorf("want root %d at %d but nil", i, positionList.list[i])
 		}
+		p.touch(nt)
 		if ntsib == nil {
 			// when turning a node into a root, it's "nieces" are really children,
 			// so should become it's sibling's nieces.
@@ -358,8 +396,8 @@ func (p *Pollard) swapNodes(s arrow, row uint8) (*hashableNode, error) {
 		run := uint64(1 << row)
 		// happens before the actual swap, so swapping a and b
 		for i := uint64(0); i < run; i++ {
-			p.positionMap[p.read(a+i).Mini()] = b + i
-			p.positionMap[p.read(b+i).Mini()] = a + i
+			p.setPosition(p.read(a+i).Mini(), b+i)
+			p.setPosition(p.read(b+i).Mini(), a+i)
 		}
 	}
 
@@ -387,6 +425,10 @@ func (p *Pollard) swapNodes(s arrow, row uint8) (*hashableNode, error) {
 
 	bhn.position = parent(s.to, p.rows())
 	// do the actual swap here
+	p.touch(a)
+	p.touch(asib)
+	p.touch(b)
+	p.touch(bsib)
 	err = polSwap(a, asib, b, bsib)
 	if err != nil {
 		return nil, err
@@ -463,6 +505,7 @@ func (p *Pollard) grabPos(
 
 		// if a sib doesn't exist, need to create it and hook it in
 		if n.niece[lrSib] == nil {
+			p.touch(n)
 			n.niece[lrSib] = &polNode{}
 		}
 		n, nsib = n.niece[lr], n.niece[lrSib]
@@ -490,6 +533,7 @@ func (p *Pollard) grabPos(
 // a good toString method for  forest.
 func (p *Pollard) toFull() (*Forest, error) {
 	ff := NewForest(RamForest, nil, "", 0)
+	ff.hasher = p.hasher
 	ff.rows = p.rows()
 	ff.numLeaves = p.numLeaves
 	ff.data = new(ramForestData)
@@ -3,6 +3,7 @@ package accumulator
 import (
 	"fmt"
 	"math/rand"
+	"reflect"
 	"testing"
 )
 
@@ -335,3 +336,135 @@ func TestCache(t *testing.T) {
 		fmt.Println(p.ToString())
 	}
 }
+
+func TestPollardHashers(t *testing.T) {
+	hashers := []Hasher{Sha256Hasher, TaggedSha256Hasher, CheapTestHasher,
+		RowCommitting(DefaultHasher), RowCommitting(Sha256Hasher)}
+	for _, h := range hashers {
+		rand.Seed(3)
+		err := pollardWithHasher(h, 10)
+		if err != nil {
+			t.Fatalf("hasher %d: %s", h.ID(), err.Error())
+		}
+	}
+}
+
+// pollardWithHasher runs a forest and pollard using the given hasher and
+// checks that they agree with each other, and not with the default hasher.
+func pollardWithHasher(h Hasher, blocks int32) error {
+	f := NewForest(RamForest, nil, "", 0)
+	err := f.SetHasher(h)
+	if err != nil {
+		return err
+	}
+	defaultF := NewForest(RamForest, nil, "", 0)
+
+	var p Pollard
+	err = p.SetHasher(h)
+	if err != nil {
+		return err
+	}
+
+	sn := newSimChain(0x07)
+	for b := int32(0); b < blocks; b++ {
+		adds, _, delHashes := sn.NextBlock(rand.Uint32() & 0x1f)
+
+		bp, err := f.ProveBatch(delHashes)
+		if err != nil {
+			return err
+		}
+		err = f.VerifyBatchProof(delHashes, bp)
+		if err != nil {
+			return err
+		}
+		// a proof with one hasher shouldn't verify with another
+		if len(bp.Proof) > 0 && defaultF.numLeaves == f.numLeaves {
+			err = defaultF.VerifyBatchProof(delHashes, bp)
+			if err == nil {
+				return fmt.Errorf("proof verified with wrong hasher")
+			}
+		}
+		err = p.IngestBatchProof(delHashes, bp)
+		if err != nil {
+			return err
+		}
+
+		_, err = f.Modify(adds, bp.Targets)
+		if err != nil {
+			return err
+		}
+		_, err = defaultF.Modify(adds, bp.Targets)
+		if err != nil {
+			return err
+		}
+		err = p.Modify(adds, bp.Targets)
+		if err != nil {
+			return err
+		}
+
+		fullRoots := f.getRoots()
+		polRoots := p.rootHashesForward()
+		defaultRoots := defaultF.getRoots()
+		if len(fullRoots) != len(polRoots) {
+			return fmt.Errorf("block %d full %d roots, pol %d roots",
+				sn.blockHeight, len(fullRoots), len(polRoots))
+		}
+		for i, pr := range polRoots {
+			if pr != fullRoots[i] {
+				return fmt.Errorf("block %d root %d mismatch, full %x pol %x",
+					sn.blockHeight, i, fullRoots[i][:4], pr[:4])
+			}
+		}
+		// single leaf roots are the same, but the biggest tree has to differ
+		if f.numLeaves > 1 && fullRoots[0] == defaultRoots[0] {
+			return fmt.Errorf("block %d root same as with default hasher",
+				sn.blockHeight)
+		}
+	}
+
+	return nil
+}
+
+// A pollard started from a forest's roots part way through should keep up
+// with the forest from there
+func TestPollardSetRoots(t *testing.T) {
+	rand.Seed(4)
+	f := NewForest(RamForest, nil, "", 0)
+	var p Pollard
+	sn := newSimChain(0x07)
+	for b := 0; b < 20; b++ {
+		adds, _, delHashes := sn.NextBlock(rand.Uint32() & 0x1f)
+		bp, err := f.ProveBatch(delHashes)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b >= 10 {
+			err = p.IngestBatchProof(delHashes, bp)
+			if err != nil {
+				t.Fatalf("block %d %s", b, err.Error())
+			}
+			err = p.Modify(adds, bp.Targets)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err = f.Modify(adds, bp.Targets)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b == 9 {
+			err = p.SetRoots(f.numLeaves, f.GetRoots())
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if !reflect.DeepEqual(p.GetRoots(), f.GetRoots()) {
+		t.Fatalf("pollard %x, forest %x", p.GetRoots(), f.GetRoots())
+	}
+
+	err := p.SetRoots(f.numLeaves, f.GetRoots()[1:])
+	if err == nil {
+		t.Fatal("set too few roots")
+	}
+}
@@ -13,7 +13,8 @@ import (
 func (p *Pollard) VerifyBatchProof(toProve []Hash, bp BatchProof) error {
 	// verify the batch proof.
 	rootHashes := p.rootHashesForward()
-	_, _, err := verifyBatchProof(toProve, bp, rootHashes, p.numLeaves,
+	_, _, err := verifyBatchProof(
+		toProve, bp, rootHashes, p.numLeaves, p.Hasher(),
 		// pass a closure that checks the pollard for cached nodes.
 		// returns true and the hash value of the node if it exists.
 		// returns false if the node does not exist or the hash value is empty.
@@ -40,7 +41,8 @@ func (p *Pollard) VerifyBatchProof(toProve []Hash, bp BatchProof) error {
 func (p *Pollard) IngestBatchProof(toProve []Hash, bp BatchProof) error {
 	// verify the batch proof.
 	rootHashes := p.rootHashesForward()
-	trees, roots, err := verifyBatchProof(toProve, bp, rootHashes, p.numLeaves,
+	trees, roots, err := verifyBatchProof(
+		toProve, bp, rootHashes, p.numLeaves, p.Hasher(),
 		// pass a closure that checks the pollard for cached nodes.
 		// returns true and the hash value of the node if it exists.
 		// returns false if the node does not exist or the hash value is empty.
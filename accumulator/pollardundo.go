@@ -0,0 +1,137 @@
+package accumulator
+
+import (
+	"fmt"
+)
+
+/*
+The pollard can't undo a block the way the forest does.  The forest has
+every hash so it only needs the deleted leaves to go back, but the pollard
+forgets most of the nodes it would need to get back the old roots.
+
+So instead the pollard keeps a log of what each of the last UndoDepth
+calls to Modify changed.  Before Modify writes to a node it saves the
+node's old contents, and before it changes the positionMap of a full
+pollard it saves the old entry.  Undo puts all of those back, last change
+first, along with the old roots.  That gets back exactly the pollard from
+before the Modify, including every leaf it was remembering.
+
+The log holds on to the nodes it saved, so they're still there to write
+back to even if Modify dropped them from the tree.  It's about as big as
+the work Modify did, so keeping it is cheap next to the Modify itself.
+*/
+
+// pollardState is what's needed to undo one call to Modify
+type pollardState struct {
+	numLeaves       uint64
+	currentRemember uint64
+	roots           []*polNode
+
+	// nodes and positions are the old contents of everything Modify
+	// changed, in the order it changed them
+	nodes     []nodeUndo
+	positions []positionUndo
+}
+
+// nodeUndo is a node and what it held before Modify changed it
+type nodeUndo struct {
+	n   *polNode
+	old polNode
+}
+
+// positionUndo is a positionMap entry from before Modify changed it
+type positionUndo struct {
+	mini   MiniHash
+	pos    uint64
+	exists bool
+}
+
+// saveState starts a new entry in the undo history, dropping the oldest if
+// there are more than UndoDepth.  Changes get logged to it until endState.
+func (p *Pollard) saveState() {
+	if p.UndoDepth <= 0 {
+		p.history = nil
+		return
+	}
+	s := &pollardState{
+		numLeaves:       p.numLeaves,
+		currentRemember: p.currentRemember,
+		roots:           make([]*polNode, len(p.roots)),
+	}
+	copy(s.roots, p.roots)
+	p.history = append(p.history, s)
+	if int32(len(p.history)) > p.UndoDepth {
+		p.history = p.history[int32(len(p.history))-p.UndoDepth:]
+	}
+	p.logging = s
+}
+
+// endState stops logging changes to the undo history
+func (p *Pollard) endState() {
+	p.logging = nil
+}
+
+// touch saves the contents of a node before it's changed
+func (p *Pollard) touch(n *polNode) {
+	if p.logging == nil || n == nil {
+		return
+	}
+	p.logging.nodes = append(p.logging.nodes, nodeUndo{n: n, old: *n})
+}
+
+// setPosition sets where a leaf is in the positionMap, saving the old entry
+func (p *Pollard) setPosition(mini MiniHash, pos uint64) {
+	p.touchPosition(mini)
+	p.positionMap[mini] = pos
+}
+
+// deletePosition removes a leaf from the positionMap, saving the old entry
+func (p *Pollard) deletePosition(mini MiniHash) {
+	p.touchPosition(mini)
+	delete(p.positionMap, mini)
+}
+
+// touchPosition saves a positionMap entry before it's changed
+func (p *Pollard) touchPosition(mini MiniHash) {
+	if p.logging == nil {
+		return
+	}
+	pos, exists := p.positionMap[mini]
+	p.logging.positions = append(p.logging.positions,
+		positionUndo{mini: mini, pos: pos, exists: exists})
+}
+
+// UndoCapacity returns how many blocks can currently be undone
+func (p *Pollard) UndoCapacity() int32 {
+	return int32(len(p.history))
+}
+
+// Undo reverts the last call to Modify, including everything that was
+// cached.
+func (p *Pollard) Undo() error {
+	if len(p.history) == 0 {
+		return fmt.Errorf("Pollard.Undo: no history to undo to (depth %d)",
+			p.UndoDepth)
+	}
+
+	s := p.history[len(p.history)-1]
+	p.history = p.history[:len(p.history)-1]
+
+	for i := len(s.nodes) - 1; i >= 0; i-- {
+		*s.nodes[i].n = s.nodes[i].old
+	}
+	for i := len(s.positions) - 1; i >= 0; i-- {
+		u := s.positions[i]
+		if u.exists {
+			p.positionMap[u.mini] = u.pos
+		} else {
+			delete(p.positionMap, u.mini)
+		}
+	}
+
+	p.numLeaves = s.numLeaves
+	p.currentRemember = s.currentRemember
+	p.roots = s.roots
+
+	return nil
+}
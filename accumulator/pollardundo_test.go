@@ -0,0 +1,222 @@
+package accumulator
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestPollardUndo(t *testing.T) {
+	for z := 0; z < 10; z++ {
+		rand.Seed(int64(z))
+		err := pollardUndoRandom(30, false)
+		if err == nil {
+			err = pollardUndoRandom(30, true)
+		}
+		if err != nil {
+			fmt.Printf("randseed %d\n", z)
+			t.Fatal(err)
+		}
+	}
+}
+
+// pollardUndoRandom undoes every 3rd block on both a forest and a pollard
+// and checks that they still agree, and keep agreeing after.  The pollard
+// has to still remember the same leaves after the undo as before the block.
+func pollardUndoRandom(blocks int32, full bool) error {
+	f := NewForest(RamForest, nil, "", 0)
+	var p Pollard
+	if full {
+		p = NewFullPollard()
+	}
+	p.UndoDepth = 4
+
+	sc := newSimChain(0x07)
+	sc.lookahead = 400
+	for b := int32(0); b < blocks; b++ {
+		adds, durations, delHashes := sc.NextBlock(rand.Uint32() & 0x0f)
+
+		bp, err := f.ProveBatch(delHashes)
+		if err != nil {
+			return err
+		}
+		err = p.IngestBatchProof(delHashes, bp)
+		if err != nil {
+			return err
+		}
+		before := p.GetRoots()
+		remembered, err := rememberedLeaves(&p)
+		if err != nil {
+			return err
+		}
+
+		ub, err := f.Modify(adds, bp.Targets)
+		if err != nil {
+			return err
+		}
+		err = p.Modify(adds, bp.Targets)
+		if err != nil {
+			return err
+		}
+
+		if b%3 == 2 {
+			err = f.Undo(*ub)
+			if err != nil {
+				return err
+			}
+			err = p.Undo()
+			if err != nil {
+				return err
+			}
+			sc.BackOne(adds, durations, delHashes)
+
+			if !reflect.DeepEqual(p.GetRoots(), before) {
+				return fmt.Errorf("block %d roots after undo %x, before %x",
+					b, p.GetRoots(), before)
+			}
+			after, err := rememberedLeaves(&p)
+			if err != nil {
+				return err
+			}
+			if !reflect.DeepEqual(after, remembered) {
+				return fmt.Errorf("block %d remembered %d leaves after undo, "+
+					"%d before", b, len(after), len(remembered))
+			}
+			if full {
+				err = p.PosMapSanity()
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if !p.equalToForestIfThere(f) {
+			return fmt.Errorf("block %d pollard doesn't match forest", b)
+		}
+
+		if !reflect.DeepEqual(p.GetRoots(), f.GetRoots()) {
+			return fmt.Errorf("block %d pollard roots %x forest %x",
+				b, p.GetRoots(), f.GetRoots())
+		}
+	}
+
+	if p.UndoCapacity() > p.UndoDepth {
+		return fmt.Errorf("undo history %d longer than depth %d",
+			p.UndoCapacity(), p.UndoDepth)
+	}
+	return nil
+}
+
+func TestPollardUndoLimits(t *testing.T) {
+	var p Pollard
+	leaves := []Leaf{{Hash: Hash{1}}, {Hash: Hash{2}}}
+	err := p.Modify(leaves, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// no history kept by default
+	err = p.Undo()
+	if err == nil {
+		t.Fatal("undo with no history should fail")
+	}
+
+	// only UndoDepth blocks back
+	p.UndoDepth = 1
+	err = p.Modify([]Leaf{{Hash: Hash{3}}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Modify([]Leaf{{Hash: Hash{4}}}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Undo()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Undo()
+	if err == nil {
+		t.Fatal("undo past UndoDepth should fail")
+	}
+}
+
+// TestPollardUndoRemember checks that a leaf the pollard remembered can
+// still be proven from the cache alone after the block is undone, even
+// when the block moved it.
+func TestPollardUndoRemember(t *testing.T) {
+	var p Pollard
+	p.UndoDepth = 1
+	f := NewForest(RamForest, nil, "", 0)
+
+	adds := make([]Leaf, 8)
+	for i := range adds {
+		adds[i] = Leaf{Hash: Hash{byte(i + 1)}, Remember: i == 7}
+	}
+	_, err := f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// deleting 2 moves 7 over
+	dels := []Hash{adds[2].Hash}
+	bp, err := f.ProveBatch(dels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.IngestBatchProof(dels, bp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Modify([]Leaf{{Hash: Hash{9}}}, bp.Targets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.Undo()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = cachedProof(&p, 7, adds[7].Hash)
+	if err != nil {
+		t.Fatalf("remembered leaf not provable after undo: %v", err)
+	}
+}
+
+// rememberedLeaves returns the leaves the pollard is remembering, by
+// position.  Every one has to be provable with nothing but the cache.
+func rememberedLeaves(p *Pollard) (map[uint64]Hash, error) {
+	leaves := make(map[uint64]Hash)
+	for pos := uint64(0); pos < p.numLeaves; pos++ {
+		n, _, _, err := p.readPos(pos)
+		if err != nil || n == nil || !n.remember {
+			continue
+		}
+		_, err = cachedProof(p, pos, n.data)
+		if err != nil {
+			return nil, fmt.Errorf("remembered leaf %d: %v", pos, err)
+		}
+		leaves[pos] = n.data
+	}
+	return leaves, nil
+}
+
+// cachedProof builds a proof for the leaf at pos out of the nodes the
+// pollard has cached, and checks it against the roots.
+func cachedProof(p *Pollard, pos uint64, leaf Hash) (BatchProof, error) {
+	bp := BatchProof{Targets: []uint64{pos}}
+	var positions []uint64
+	ProofPositions(bp.Targets, p.numLeaves, p.rows(), &positions)
+	for _, proofPos := range positions {
+		n, _, _, err := p.readPos(proofPos)
+		if err != nil || n == nil || n.data == empty {
+			return bp, fmt.Errorf("position %d not cached", proofPos)
+		}
+		bp.Proof = append(bp.Proof, n.data)
+	}
+	return bp, p.VerifyBatchProof([]Hash{leaf}, bp)
+}
@@ -15,8 +15,9 @@ type polNode struct {
 }
 
 // auntOp returns the hash of a nodes nieces. crashes if you call on nil nieces.
-func (n *polNode) auntOp() Hash {
-	return parentHash(n.niece[0].data, n.niece[1].data)
+// row is the row of the node being hashed.
+func (n *polNode) auntOp(h Hasher, row uint8) Hash {
+	return h.ParentHash(row, n.niece[0].data, n.niece[1].data)
 }
 
 // auntable tells you if you can call auntOp on a node
@@ -109,7 +110,9 @@ func (p *Pollard) rootHashesForward() []Hash {
 // idea as verifyBatchProof
 
 // current serialization is just 8byte numleaves, followed by all the hashes
-// (in small to big order)
+// (in small to big order), followed by the 1 byte hasher id.
+// Older serializations don't have the hasher id; those are read as using
+// the DefaultHasher.
 
 // WritePollard writes the numLeaves field and only the roots into the given writer.
 // Cached leaves are not included in the writer
@@ -125,7 +128,8 @@ func (p *Pollard) WritePollard(w io.Writer) error {
 			return err
 		}
 	}
-	return nil
+	_, err = w.Write([]byte{byte(p.Hasher().ID())})
+	return err
 }
 
 // RestorePollard restores the pollard from the given reader
@@ -146,13 +150,44 @@ func (p *Pollard) RestorePollard(r io.Reader) error {
 			return s
 		}
 	}
+	return p.readHasherID(r)
+}
+
+// SetRoots starts the pollard over from just its roots, biggest first like
+// GetRoots gives them, for numLeaves leaves.  Nothing is cached and there's
+// no undo history.  The pollard's hasher has to be the one the roots were
+// made with.
+func (p *Pollard) SetRoots(numLeaves uint64, roots []Hash) error {
+	if len(roots) != int(numRoots(numLeaves)) {
+		return fmt.Errorf("SetRoots: %d roots for %d leaves, expect %d",
+			len(roots), numLeaves, numRoots(numLeaves))
+	}
+	p.numLeaves = numLeaves
+	p.roots = make([]*polNode, len(roots))
+	for i := range roots {
+		p.roots[i] = &polNode{data: roots[i]}
+	}
+	p.history = nil
 	return nil
 }
 
+// readHasherID reads the hasher id at the end of the serialized pollard and
+// checks it against the pollard's hasher.  Nothing left to read means it was
+// written before hasher ids were, so it used the DefaultHasher.
+func (p *Pollard) readHasherID(r io.Reader) error {
+	var id [1]byte
+	_, err := io.ReadFull(r, id[:])
+	if err != nil && err != io.EOF {
+		return err
+	}
+	return checkHasherID(HasherID(id[0]), p.hasher)
+}
+
 // Serialize serializes the numLeaves field and only the roots into a byte slice.
 // Cached leaves are not included in the byte slice
 func (p *Pollard) Serialize() ([]byte, error) {
-	size := 8 + len(p.roots) // 8 for uint64 numLeaves
+	// 8 for uint64 numLeaves, 32 per root, 1 for the hasher id
+	size := 8 + (len(p.roots) * 32) + 1
 	serialized := make([]byte, 0, size)
 
 	buf := bytes.NewBuffer(serialized)
@@ -169,6 +204,11 @@ func (p *Pollard) Serialize() ([]byte, error) {
 		}
 	}
 
+	err = buf.WriteByte(byte(p.Hasher().ID()))
+	if err != nil {
+		return nil, err
+	}
+
 	return buf.Bytes(), nil
 }
 
@@ -195,5 +235,5 @@ func (p *Pollard) Deserialize(serialized []byte) error {
 		}
 	}
 
-	return nil
+	return p.readHasherID(reader)
 }
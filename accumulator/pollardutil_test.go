@@ -38,3 +38,50 @@ func TestPollardSerializeDeserialize(t *testing.T) {
 		t.Fatal("Bytes Unequal")
 	}
 }
+
+func TestPollardSerializeHasher(t *testing.T) {
+	var p Pollard
+	err := p.SetHasher(Sha256Hasher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaves := make([]Leaf, 5)
+	for i := 0; i < len(leaves); i++ {
+		leaves[i].Hash[0] = uint8(i + 1)
+	}
+	err = p.add(leaves)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// can't change the hasher once there are leaves
+	err = p.SetHasher(DefaultHasher)
+	if err == nil {
+		t.Fatal("SetHasher allowed on non-empty pollard")
+	}
+
+	serialized, err := p.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// restoring with the default hasher should fail
+	var q Pollard
+	err = q.Deserialize(serialized)
+	if err == nil {
+		t.Fatal("Deserialize allowed mismatched hasher")
+	}
+
+	var r Pollard
+	r.SetHasher(Sha256Hasher)
+	err = r.Deserialize(serialized)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// serializations without a hasher id are read as the default
+	var s Pollard
+	err = s.Deserialize(serialized[:len(serialized)-1])
+	if err != nil {
+		t.Fatal(err)
+	}
+}
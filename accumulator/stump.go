@@ -0,0 +1,338 @@
+package accumulator
+
+import (
+	"fmt"
+)
+
+// Stump is the accumulator with nothing but its roots.  It can check
+// proofs, and work out the next roots from a block's adds and the proof of
+// its deletions, without keeping any of the tree.
+type Stump struct {
+	NumLeaves uint64
+	// Roots are biggest first, like GetRoots gives them
+	Roots []Hash
+
+	// hasher computes the parent hashes.  nil means DefaultHasher.
+	hasher Hasher
+}
+
+// Hasher returns the hasher the stump uses
+func (s *Stump) Hasher() Hasher {
+	return hasherOrDefault(s.hasher)
+}
+
+// SetHasher sets the hash function for the stump.  It has to be the one the
+// roots were made with.
+func (s *Stump) SetHasher(h Hasher) {
+	s.hasher = h
+}
+
+// Verify checks that the proof proves the targets, in the order they were
+// proven in, against the roots
+func (s *Stump) Verify(targets []Hash, bp BatchProof) error {
+	_, _, err := verifyBatchProof(
+		targets, bp, s.Roots, s.NumLeaves, s.Hasher(), nil)
+	return err
+}
+
+// Update deletes the leaves proven by bp, then adds adds, like Modify does
+// to a forest or pollard.  delHashes are the hashes of the leaves being
+// deleted, in the order they were proven in.  If the proof doesn't verify
+// the stump is left as it was.
+func (s *Stump) Update(adds []Leaf, bp BatchProof, delHashes []Hash) error {
+	for _, a := range adds {
+		if a.Hash == empty {
+			return fmt.Errorf("Can't add empty (all 0s) leaf to accumulator")
+		}
+	}
+	trees, _, err := verifyBatchProof(
+		delHashes, bp, s.Roots, s.NumLeaves, s.Hasher(), nil)
+	if err != nil {
+		return err
+	}
+	if uint64(len(bp.Targets)) > s.NumLeaves {
+		return fmt.Errorf("can't delete %d leaves, only %d exist",
+			len(bp.Targets), s.NumLeaves)
+	}
+
+	// a copy so the adds don't write over the caller's roots
+	roots := make([]Hash, len(s.Roots))
+	copy(roots, s.Roots)
+	if len(bp.Targets) != 0 {
+		known := make(map[uint64]Hash)
+		addProofTree(known, trees, bp.Targets, delHashes)
+		roots, err = s.remove(
+			known, bp.Targets, treeRows(s.NumLeaves), nil)
+		if err != nil {
+			return err
+		}
+	}
+	numLeaves := s.NumLeaves - uint64(len(bp.Targets))
+	s.Roots = s.addLeaves(nil, roots, numLeaves, 0, adds)
+	s.NumLeaves = numLeaves + uint64(len(adds))
+	return nil
+}
+
+// UpdateProof brings bp, a proof of some leaves before a block, up to after
+// the block.  targets are the leaves bp proves, in the order they were
+// proven in.  adds, delProof and delHashes are the block, the same as
+// Update takes; the stump is from before the block and isn't changed.
+// The leaves the block deletes are left out of the new proof, and the ones
+// that are still there are returned with it, in the same order.
+func (s *Stump) UpdateProof(bp BatchProof, targets []Hash, adds []Leaf,
+	delProof BatchProof, delHashes []Hash) (BatchProof, []Hash, error) {
+
+	trees, _, err := verifyBatchProof(
+		targets, bp, s.Roots, s.NumLeaves, s.Hasher(), nil)
+	if err != nil {
+		return BatchProof{}, nil, err
+	}
+	delTrees, _, err := verifyBatchProof(
+		delHashes, delProof, s.Roots, s.NumLeaves, s.Hasher(), nil)
+	if err != nil {
+		return BatchProof{}, nil, err
+	}
+	if uint64(len(delProof.Targets)) > s.NumLeaves {
+		return BatchProof{}, nil, fmt.Errorf(
+			"can't delete %d leaves, only %d exist",
+			len(delProof.Targets), s.NumLeaves)
+	}
+
+	// both proofs together have every node that changes on the way from
+	// the targets up to the roots
+	known := make(map[uint64]Hash)
+	addProofTree(known, trees, bp.Targets, targets)
+	addProofTree(known, delTrees, delProof.Targets, delHashes)
+
+	deleted := make(map[uint64]bool)
+	for _, t := range delProof.Targets {
+		deleted[t] = true
+	}
+	var nextBP BatchProof
+	var nextTargets []Hash
+	for i, t := range bp.Targets {
+		if !deleted[t] {
+			nextBP.Targets = append(nextBP.Targets, t)
+			nextTargets = append(nextTargets, targets[i])
+		}
+	}
+
+	// work in enough rows for before and after the block, like the forest
+	// does.  Leaves are at the same positions whatever the rows.
+	numLeaves := s.NumLeaves - uint64(len(delProof.Targets))
+	nextNumLeaves := numLeaves + uint64(len(adds))
+	rows := treeRows(s.NumLeaves)
+	if treeRows(nextNumLeaves) > rows {
+		rows = treeRows(nextNumLeaves)
+	}
+	known = translatePositions(known, treeRows(s.NumLeaves), rows)
+
+	// the targets move with the deletions
+	roots, err := s.remove(known, delProof.Targets, rows, nextBP.Targets)
+	if err != nil {
+		return BatchProof{}, nil, err
+	}
+	s.addLeaves(known, roots, numLeaves, rows, adds)
+
+	nextRows := treeRows(nextNumLeaves)
+	known = translatePositions(known, rows, nextRows)
+	sortedTargets := make([]uint64, len(nextBP.Targets))
+	copy(sortedTargets, nextBP.Targets)
+	sortUint64s(sortedTargets)
+	positionList := NewPositionList()
+	defer positionList.Free()
+	ProofPositions(sortedTargets, nextNumLeaves, nextRows, &positionList.list)
+	nextBP.Proof = make([]Hash, len(positionList.list))
+	for i, pos := range positionList.list {
+		h, ok := known[pos]
+		if !ok {
+			return BatchProof{}, nil, fmt.Errorf(
+				"UpdateProof: no hash for proof position %d", pos)
+		}
+		nextBP.Proof[i] = h
+	}
+	return nextBP, nextTargets, nil
+}
+
+// addProofTree puts everything a verified proof says about the tree in
+// known, by position
+func addProofTree(known map[uint64]Hash, trees [][]miniTree,
+	targets []uint64, targetHashes []Hash) {
+
+	for _, tree := range trees {
+		for _, mt := range tree {
+			known[mt.parent.Pos] = mt.parent.Val
+			known[mt.leftChild.Pos] = mt.leftChild.Val
+			known[mt.rightChild.Pos] = mt.rightChild.Val
+		}
+	}
+	for i, t := range targets {
+		known[t] = targetHashes[i]
+	}
+}
+
+// addLeaves adds adds on to roots, numLeaves leaves, and gives the new
+// roots.  If known isn't nil, the new nodes are put in it too, at their
+// positions in a forest of rows rows.
+func (s *Stump) addLeaves(known map[uint64]Hash, roots []Hash,
+	numLeaves uint64, rows uint8, adds []Leaf) []Hash {
+
+	for _, a := range adds {
+		n := a.Hash
+		pos := numLeaves
+		if known != nil {
+			known[pos] = n
+		}
+		for h := uint8(0); (numLeaves>>h)&1 == 1; h++ {
+			n = s.Hasher().ParentHash(h+1, roots[len(roots)-1], n)
+			roots = roots[:len(roots)-1]
+			if known != nil {
+				pos = parent(pos, rows)
+				known[pos] = n
+			}
+		}
+		roots = append(roots, n)
+		numLeaves++
+	}
+	return roots
+}
+
+// remove does the same swaps and hashes as Forest.removev4, but only on the
+// positions in known, in a forest of rows rows, and gives the roots after.
+// known has to have everything in the proof of dels.  The leaf positions
+// in track are moved along with the leaves.
+func (s *Stump) remove(known map[uint64]Hash, delsUn []uint64, rows uint8,
+	track []uint64) ([]Hash, error) {
+
+	dels := make([]uint64, len(delsUn))
+	copy(dels, delsUn)
+	sortUint64s(dels)
+
+	positionList := NewPositionList()
+	defer positionList.Free()
+	getRootsForwards(s.NumLeaves, rows, &positionList.list)
+	for i, pos := range positionList.list {
+		known[pos] = s.Roots[i]
+	}
+
+	var hashDirt []uint64
+	swapRows := remTrans2(dels, s.NumLeaves, rows)
+	for r := uint8(0); r < rows; r++ {
+		hashDirt = updateDirt(hashDirt, swapRows[r], s.NumLeaves, rows)
+		swapKnown(known, swapRows[r], r, rows, track)
+		for _, pos := range hashDirt {
+			left, lok := known[child(pos, rows)]
+			right, rok := known[child(pos, rows)|1]
+			if !lok || !rok {
+				// not under any of the new roots, or it'd be known
+				delete(known, pos)
+				continue
+			}
+			known[pos] = s.Hasher().ParentHash(
+				detectRow(pos, rows), left, right)
+		}
+	}
+
+	positionList.list = positionList.list[:0]
+	getRootsForwards(s.NumLeaves-uint64(len(dels)), rows, &positionList.list)
+	roots := make([]Hash, len(positionList.list))
+	for i, pos := range positionList.list {
+		root, ok := known[pos]
+		if !ok {
+			return nil, fmt.Errorf("Stump: root %d at %d not known "+
+				"after deleting", i, pos)
+		}
+		roots[i] = root
+	}
+	return roots, nil
+}
+
+// swapKnown applies a row's swaps to the known positions, and the leaf
+// positions in track.  Each swap moves the whole subtree under both nodes,
+// like Forest.swapNodes.
+func swapKnown(known map[uint64]Hash, swaps []arrow, row, rows uint8,
+	track []uint64) {
+
+	if len(swaps) == 0 {
+		return
+	}
+	// do the swaps on just the nodes in this row first, so later swaps in
+	// the row move what earlier ones put there.  from[pos] is where what's
+	// now at pos started.
+	from := make(map[uint64]uint64)
+	origin := func(pos uint64) uint64 {
+		if o, ok := from[pos]; ok {
+			return o
+		}
+		return pos
+	}
+	for _, s := range swaps {
+		from[s.from], from[s.to] = origin(s.to), origin(s.from)
+	}
+	to := make(map[uint64]uint64, len(from))
+	for pos, o := range from {
+		if pos != o {
+			to[o] = pos
+		}
+	}
+	if len(to) == 0 {
+		return
+	}
+
+	// move gives where pos goes, if it's under a node that moves
+	move := func(pos uint64) (uint64, bool) {
+		r := detectRow(pos, rows)
+		if r > row {
+			return pos, false
+		}
+		ancestor := parentMany(pos, row-r, rows)
+		dest, ok := to[ancestor]
+		if !ok {
+			return pos, false
+		}
+		offset := pos - childMany(ancestor, row-r, rows)
+		return childMany(dest, row-r, rows) + offset, true
+	}
+
+	moved := make(map[uint64]Hash)
+	for pos, h := range known {
+		dest, ok := move(pos)
+		if ok {
+			moved[dest] = h
+			delete(known, pos)
+		}
+	}
+	for pos, h := range moved {
+		known[pos] = h
+	}
+	for i, pos := range track {
+		track[i], _ = move(pos)
+	}
+}
+
+// translatePositions gives known with the positions changed from a forest
+// of fromRows rows to one of toRows.  Nodes that don't fit are dropped.
+func translatePositions(known map[uint64]Hash,
+	fromRows, toRows uint8) map[uint64]Hash {
+
+	if fromRows == toRows {
+		return known
+	}
+	// rowStart is the position of the first node in row r
+	rowStart := func(r, rows uint8) uint64 {
+		return (2 << rows) - (2 << (rows - r))
+	}
+	translated := make(map[uint64]Hash, len(known))
+	for pos, h := range known {
+		r := detectRow(pos, fromRows)
+		if r > toRows {
+			continue
+		}
+		offset := pos - rowStart(r, fromRows)
+		if offset >= 1<<(toRows-r) {
+			continue
+		}
+		translated[rowStart(r, toRows)+offset] = h
+	}
+	return translated
+}
@@ -0,0 +1,174 @@
+package accumulator
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+func TestStumpUpdate(t *testing.T) {
+	hashers := []Hasher{DefaultHasher, RowCommitting(DefaultHasher)}
+	for _, h := range hashers {
+		rand.Seed(5)
+		err := stumpWithHasher(h, 0x07, 500)
+		if err != nil {
+			t.Fatalf("hasher %d: %s", h.ID(), err.Error())
+		}
+	}
+	// long lived leaves, so more of the tree moves around
+	rand.Seed(6)
+	err := stumpWithHasher(DefaultHasher, 0x3f, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// stumpWithHasher runs a forest and a stump side by side and checks the
+// stump keeps the same roots
+func stumpWithHasher(h Hasher, duration uint32, blocks int) error {
+	f := NewForest(RamForest, nil, "", 0)
+	err := f.SetHasher(h)
+	if err != nil {
+		return err
+	}
+	var s Stump
+	s.SetHasher(h)
+
+	sn := newSimChain(duration)
+	for b := 0; b < blocks; b++ {
+		adds, _, delHashes := sn.NextBlock(rand.Uint32() & 0x3f)
+		bp, err := f.ProveBatch(delHashes)
+		if err != nil {
+			return err
+		}
+		err = s.Verify(delHashes, bp)
+		if err != nil {
+			return err
+		}
+		err = s.Update(adds, bp, delHashes)
+		if err != nil {
+			return err
+		}
+		_, err = f.Modify(adds, bp.Targets)
+		if err != nil {
+			return err
+		}
+		if s.NumLeaves != f.numLeaves ||
+			!reflect.DeepEqual(s.Roots, f.GetRoots()) {
+			return fmt.Errorf("block %d stump %d leaves %x, forest %d leaves %x",
+				b, s.NumLeaves, s.Roots, f.numLeaves, f.GetRoots())
+		}
+	}
+	return nil
+}
+
+func TestStumpBadProof(t *testing.T) {
+	f := NewForest(RamForest, nil, "", 0)
+	var adds []Leaf
+	for i := 0; i < 11; i++ {
+		adds = append(adds, Leaf{Hash: Hash{byte(i + 1)}})
+	}
+	_, err := f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := Stump{NumLeaves: f.numLeaves, Roots: f.GetRoots()}
+
+	dels := []Hash{adds[2].Hash, adds[7].Hash}
+	bp, err := f.ProveBatch(dels)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wrong := []Hash{adds[2].Hash, adds[8].Hash}
+	err = s.Verify(wrong, bp)
+	if err == nil {
+		t.Fatal("verified the wrong leaves")
+	}
+	err = s.Update(nil, bp, wrong)
+	if err == nil {
+		t.Fatal("updated with the wrong leaves")
+	}
+	if s.NumLeaves != 11 || !reflect.DeepEqual(s.Roots, f.GetRoots()) {
+		t.Fatal("stump changed by a bad update")
+	}
+}
+
+func TestStumpUpdateProof(t *testing.T) {
+	hashers := []Hasher{DefaultHasher, RowCommitting(DefaultHasher)}
+	for _, h := range hashers {
+		rand.Seed(7)
+		err := updateProofWithHasher(h, 0x0f, 300)
+		if err != nil {
+			t.Fatalf("hasher %d: %s", h.ID(), err.Error())
+		}
+	}
+}
+
+// updateProofWithHasher keeps a proof of some leaves up to date block by
+// block, and checks it's the same as the forest proves each time
+func updateProofWithHasher(h Hasher, duration uint32, blocks int) error {
+	f := NewForest(RamForest, nil, "", 0)
+	err := f.SetHasher(h)
+	if err != nil {
+		return err
+	}
+	var s Stump
+	s.SetHasher(h)
+
+	var wallet []Hash
+	var walletProof BatchProof
+	sn := newSimChain(duration)
+	for b := 0; b < blocks; b++ {
+		// pick new leaves every so often, and carry the proof between
+		if b%8 == 0 {
+			wallet = wallet[:0]
+			for pos := uint64(0); pos < f.numLeaves; pos++ {
+				if rand.Intn(4) == 0 {
+					wallet = append(wallet, f.data.read(pos))
+				}
+			}
+			rand.Shuffle(len(wallet), func(i, j int) {
+				wallet[i], wallet[j] = wallet[j], wallet[i]
+			})
+			walletProof, err = f.ProveBatch(wallet)
+			if err != nil {
+				return err
+			}
+		}
+
+		adds, _, delHashes := sn.NextBlock(rand.Uint32() & 0x3f)
+		bp, err := f.ProveBatch(delHashes)
+		if err != nil {
+			return err
+		}
+		walletProof, wallet, err = s.UpdateProof(
+			walletProof, wallet, adds, bp, delHashes)
+		if err != nil {
+			return fmt.Errorf("block %d: %s", b, err.Error())
+		}
+		err = s.Update(adds, bp, delHashes)
+		if err != nil {
+			return err
+		}
+		_, err = f.Modify(adds, bp.Targets)
+		if err != nil {
+			return err
+		}
+
+		expect, err := f.ProveBatch(wallet)
+		if err != nil {
+			return err
+		}
+		// an empty proof from the forest has nil slices
+		if walletProof.ToString() != expect.ToString() {
+			return fmt.Errorf("block %d updated proof %s, expect %s",
+				b, walletProof.ToString(), expect.ToString())
+		}
+		err = s.Verify(wallet, walletProof)
+		if err != nil {
+			return fmt.Errorf("block %d: %s", b, err.Error())
+		}
+	}
+	return nil
+}
@@ -61,8 +61,8 @@ type simLeaf struct {
 }
 
 // parentHash gets you the merkle parent of two children hashes.
+// Doesn't commit to the row; use RowCommitting for that.
 func parentHash(l, r Hash) Hash {
-	// TODO So far no committing to height.
 	if l == empty || r == empty {
 		panic("got an empty leaf here. ")
 	}
@@ -0,0 +1,105 @@
+package bridgenode
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// Newer versions of bitcoind obfuscate the blk and rev files by xoring them
+// with a key in blocks/xor.dat.  Byte n of a file is xored with byte n % 8
+// of the key, so offsets into the files are the same as for plain files.
+// There's no xor.dat in older datadirs, and a key of all zeros means the
+// files aren't obfuscated.
+
+// xorKeyFile is the name of bitcoind's key file in the blocks directory
+const xorKeyFile = "xor.dat"
+
+// xorKeySize is how long the key is
+const xorKeySize = 8
+
+// readXorKey reads the obfuscation key for the blk and rev files in
+// blockDir.  It returns nil if they aren't obfuscated.
+func readXorKey(blockDir string) ([]byte, error) {
+	key, err := ioutil.ReadFile(filepath.Join(blockDir, xorKeyFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != xorKeySize {
+		return nil, fmt.Errorf("%s is %d bytes, expect %d",
+			xorKeyFile, len(key), xorKeySize)
+	}
+	for _, b := range key {
+		if b != 0 {
+			return key, nil
+		}
+	}
+	return nil, nil
+}
+
+// blockFile is a blk or rev file that reads as plain data whether or not
+// it's obfuscated.  Read and Seek work like they do on the os.File.
+type blockFile struct {
+	*os.File
+	key []byte
+	// pos is where the next Read starts, for lining up the key
+	pos int64
+}
+
+// openBlockFile opens a blk or rev file in blockDir for reading
+func openBlockFile(blockDir, name string) (*blockFile, error) {
+	key, err := readXorKey(blockDir)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(filepath.Join(blockDir, name))
+	if err != nil {
+		return nil, err
+	}
+	return &blockFile{File: f, key: key}, nil
+}
+
+// Read reads from the file and undoes the obfuscation
+func (bf *blockFile) Read(b []byte) (int, error) {
+	n, err := bf.File.Read(b)
+	xorBytes(b[:n], bf.key, bf.pos)
+	bf.pos += int64(n)
+	return n, err
+}
+
+// ReadAt reads from off in the file and undoes the obfuscation
+func (bf *blockFile) ReadAt(b []byte, off int64) (int, error) {
+	n, err := bf.File.ReadAt(b, off)
+	xorBytes(b[:n], bf.key, off)
+	return n, err
+}
+
+// Seek sets where the next Read starts
+func (bf *blockFile) Seek(offset int64, whence int) (int64, error) {
+	pos, err := bf.File.Seek(offset, whence)
+	if err != nil {
+		return pos, err
+	}
+	bf.pos = pos
+	return pos, nil
+}
+
+// xorBytes xors b with key in place, where b starts at pos in the file.
+// Does nothing if key is nil.
+func xorBytes(b, key []byte, pos int64) {
+	if len(key) == 0 {
+		return
+	}
+	k := int(pos % int64(len(key)))
+	for i := range b {
+		b[i] ^= key[k]
+		k++
+		if k == len(key) {
+			k = 0
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package bridgenode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+)
+
+// writeObfuscated writes a file the way bitcoind does when it has key
+func writeObfuscated(t *testing.T, name string, b, key []byte) {
+	obfuscated := make([]byte, len(b))
+	copy(obfuscated, b)
+	xorBytes(obfuscated, key, 0)
+	err := ioutil.WriteFile(name, obfuscated, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestXorBlockFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xortest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	key := []byte{0x5a, 0x01, 0xff, 0x80, 0x33, 0xc4, 0x07, 0x99}
+	err = ioutil.WriteFile(filepath.Join(dir, xorKeyFile), key, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// two blocks with just a coinbase each.  The script lengths are odd
+	// so the second block doesn't line up with the key.
+	var blocks []wire.MsgBlock
+	var blk, rev, offsets bytes.Buffer
+	magic := []byte{0x0b, 0x11, 0x09, 0x07}
+	var prev chainhash.Hash
+	for i := 0; i < 2; i++ {
+		coinbase := wire.NewMsgTx(1)
+		coinbase.AddTxIn(wire.NewTxIn(
+			wire.NewOutPoint(&chainhash.Hash{}, 0xffffffff),
+			bytes.Repeat([]byte{byte(i + 1)}, 3+2*i), nil))
+		coinbase.AddTxOut(wire.NewTxOut(50e8, []byte{0x51}))
+		var b wire.MsgBlock
+		b.Header.PrevBlock = prev
+		b.Header.Nonce = uint32(i)
+		b.AddTransaction(coinbase)
+		prev = b.BlockHash()
+		blocks = append(blocks, b)
+
+		var size [4]byte
+		var entry [12]byte
+		binary.BigEndian.PutUint32(entry[4:8], uint32(blk.Len()))
+		blk.Write(magic)
+		binary.LittleEndian.PutUint32(size[:], uint32(b.SerializeSize()))
+		blk.Write(size[:])
+		err = b.Serialize(&blk)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// no undo for a coinbase, so it's a count of 0 then the checksum
+		rev.Write(magic)
+		binary.LittleEndian.PutUint32(size[:], 1)
+		rev.Write(size[:])
+		binary.BigEndian.PutUint32(entry[8:12], uint32(rev.Len()))
+		rev.WriteByte(0)
+		rev.Write(make([]byte, 32))
+		offsets.Write(entry[:])
+	}
+	// the preallocated space after the blocks
+	blk.Write(make([]byte, 100))
+
+	writeObfuscated(t, filepath.Join(dir, "blk00000.dat"), blk.Bytes(), key)
+	writeObfuscated(t, filepath.Join(dir, "rev00000.dat"), rev.Bytes(), key)
+	offsetFileName := filepath.Join(dir, "offset.dat")
+	err = ioutil.WriteFile(offsetFileName, offsets.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	headers, end, err := readNewHeaders(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(headers) != 2 || int(end) != blk.Len()-100 {
+		t.Fatalf("read %d headers to %d, expect 2 to %d",
+			len(headers), end, blk.Len()-100)
+	}
+	for i, h := range headers {
+		if chainhash.Hash(h.CurrentHeaderHash) != blocks[i].BlockHash() {
+			t.Fatalf("header %d hash %x, expect %s",
+				i, h.CurrentHeaderHash, blocks[i].BlockHash())
+		}
+	}
+
+	for i, b := range blocks {
+		var expect bytes.Buffer
+		b.Serialize(&expect)
+		got, err := GetBlockBytesFromFile(int32(i+1), offsetFileName, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, expect.Bytes()) {
+			t.Fatalf("block %d from file %x, expect %x",
+				i+1, got, expect.Bytes())
+		}
+	}
+
+	offsetFile, err := os.Open(offsetFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer offsetFile.Close()
+	gotBlocks, gotRevs, err := GetRawBlocksFromDisk(1, 2, offsetFile, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gotBlocks) != 2 || len(gotRevs) != 2 {
+		t.Fatalf("got %d blocks %d revs, expect 2",
+			len(gotBlocks), len(gotRevs))
+	}
+	for i := range blocks {
+		if gotBlocks[i].BlockHash() != blocks[i].BlockHash() {
+			t.Fatalf("block %d hash %s, expect %s", i+1,
+				gotBlocks[i].BlockHash(), blocks[i].BlockHash())
+		}
+		if len(gotRevs[i].Txs) != 0 {
+			t.Fatalf("rev %d has %d txs, expect 0",
+				i+1, len(gotRevs[i].Txs))
+		}
+	}
+}
+
+func TestReadXorKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xortest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// no key file, then a key of zeros, are both plain files
+	for _, write := range []bool{false, true} {
+		if write {
+			err = ioutil.WriteFile(filepath.Join(dir, xorKeyFile),
+				make([]byte, xorKeySize), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		key, err := readXorKey(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key != nil {
+			t.Fatalf("got key %x, expect none", key)
+		}
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, xorKeyFile), []byte{1, 2}, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = readXorKey(dir)
+	if err == nil {
+		t.Fatal("no error for a short key")
+	}
+}
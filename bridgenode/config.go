@@ -8,13 +8,23 @@ import (
 
 	"github.com/btcsuite/btcd/chaincfg"
 	"github.com/btcsuite/btcutil"
+	"github.com/mit-dci/utreexo/accumulator"
 )
 
 var HelpMsg = `
-Usage: server [OPTION]
+Usage: server [fsck|repair|verify] [OPTION]
 A dynamic hash based accumulator designed for the Bitcoin UTXO set
 The bridgenode server generates proofs and serves to the CSN node.
 
+COMMANDS:
+  fsck                         check the proof and undo data then exit
+  repair                       check the proof and undo data, making new
+                               proofs for any that are corrupt.  Corrupt
+                               undo data can't be repaired
+  verify                       check the proofs prove the blocks by replaying
+                               them through a pollard, carrying on from the
+                               last checkpoint
+
 OPTIONS:
   -net=mainnet                 configure whether to use mainnet. Optional.
   -net=regtest                 configure whether to use regtest. Optional.
@@ -22,6 +32,9 @@ OPTIONS:
   Defaults to disk
   -net=signet                 configure whether to use signet. Optional.
   -forest                      select forest type to use (ram, cow, cache, disk). Defaults to disk
+  -hashmode                    parent hash mode (legacy, rowcommit). Defaults to legacy.
+                               rowcommit commits to the row in every parent hash.
+                               CSNs must use the same mode.
 
   -datadir="path/to/directory" set a custom DATADIR.
                                Defaults to the Bitcoin Core DATADIR path
@@ -31,6 +44,15 @@ OPTIONS:
   -cpuprof                     configure whether to use use cpu profiling
   -memprof                     configure whether to use use heap profiling
   -serve		       immediately serve whatever data is built
+  -memttl                      keep the txid index for TTL lookups in memory.
+                               Faster, but needs 8 bytes of ram per tx
+  -follow                      keep building and serving proofs as bitcoind
+                               writes new blocks.  They show up once it
+                               writes its block index, up to an hour later
+  -maxfilesize=128             size in MB the proof, undo and ttl files get
+                               before starting new ones
+  -prune=<blocks>              only keep proofs and undo data for the last
+                               <blocks> blocks. At least 1000.
 `
 
 // bit of a hack. Standard flag lib doesn't allow flag.Parse(os.Args[2]).
@@ -49,12 +71,20 @@ var (
 		`quit generating proofs after the given block height. (meant for testing)`)
 	cowMaxCache = argCmd.Int("cowmaxcache", 4000,
 		`how much memory to use in MB for the copy-on-write forest`)
+	hashModeCmd = argCmd.String("hashmode", "legacy",
+		`Set the parent hash mode (legacy, rowcommit). Usage: "-hashmode=rowcommit"`)
 	memTTL = argCmd.Bool("memttl", false,
 		`keep the ttls in memory instead of on disk. Uses lots of ram.`)
 	serve = argCmd.Bool("serve", false,
 		`immediately start server without building or checking proof data`)
 	noServeCmd = argCmd.Bool("noserve", false,
 		`don't serve proofs after finishing generating them`)
+	followCmd = argCmd.Bool("follow", false,
+		`keep building proofs for new blocks, serving them as they're built`)
+	maxFileSizeCmd = argCmd.Int("maxfilesize", defaultMaxFileSize>>20,
+		`size in MB the proof, undo and ttl files get before starting new ones`)
+	pruneCmd = argCmd.Int("prune", 0,
+		`only keep proofs and undo data for this many of the latest blocks`)
 	traceCmd = argCmd.String("trace", "",
 		`Enable trace. Usage: 'trace='path/to/file'`)
 	cpuProfCmd = argCmd.String("cpuprof", "",
@@ -75,10 +105,17 @@ type forestDir struct {
 	forestLastSyncedBlockHeightFile string
 	cowForestCurFile                string
 	cowForestDir                    string
+	// where ReplayProofs got to last time
+	checkpointFile string
+	// the roots after every block, see writeRoots
+	rootFiles splitPaths
 }
 
 type proofDir struct {
-	base        string
+	base   string
+	pFiles splitPaths
+	// the single file archive from before the data was split up, see
+	// migrateSplitFiles
 	pFile       string
 	pOffsetFile string
 	lastPOffset string
@@ -88,17 +125,29 @@ type offsetDir struct {
 	base                      string
 	OffsetFile                string
 	lastIndexOffsetHeightFile string
+	// how far the offset file has been built, see offsetIndexer
+	stateFile string
 }
 
 type undoDir struct {
-	base       string
+	base      string
+	undoFiles splitPaths
+	// from before the data was split up
 	undoFile   string
 	offsetFile string
+	// hashes of the blocks the undo blocks are for. Used to find the fork
+	// point on a reorg
+	blockHashFile string
 }
 type ttlDir struct {
-	base       string
-	ttlsetFile string
-	OffsetFile string
+	base     string
+	ttlFiles splitPaths
+	// from before the data was split up.  The offsets are where each
+	// block ends instead of where it starts.
+	ttlsetFile     string
+	OffsetFile     string
+	txidFile       string
+	txidOffsetFile string
 }
 
 // All your utreexo bridgenode file paths in a nice and convinent struct
@@ -108,6 +157,8 @@ type utreeDir struct {
 	ForestDir forestDir
 	TtlDir    ttlDir
 	UndoDir   undoDir
+	// LeafIndexDir is the leveldb of outpoint to LeafData, see leafIndex
+	LeafIndexDir string
 }
 
 // init an utreeDir with a selected basepath. Has all the names for the forest
@@ -118,11 +169,14 @@ func initUtreeDir(basePath string) utreeDir {
 		OffsetFile: filepath.Join(offBase, "offsetfile.dat"),
 		lastIndexOffsetHeightFile: filepath.Join(offBase,
 			"lastindexoffsetheightfile.dat"),
+		stateFile: filepath.Join(offBase, "offsetstate.dat"),
 	}
 
 	proofBase := filepath.Join(basePath, "proofdata")
 	proof := proofDir{
-		base:        proofBase,
+		base: proofBase,
+		pFiles: splitPaths{dir: proofBase, prefix: "proof",
+			indexFile: filepath.Join(proofBase, "proofindex.dat")},
 		pFile:       filepath.Join(proofBase, "proof.dat"),
 		pOffsetFile: filepath.Join(proofBase, "proofoffset.dat"),
 		lastPOffset: filepath.Join(proofBase, "lastproofoffset.dat"),
@@ -138,18 +192,28 @@ func initUtreeDir(basePath string) utreeDir {
 			"forestlastsyncedheight.dat"),
 		cowForestDir:     cowDir,
 		cowForestCurFile: filepath.Join(cowDir, "CURRENT"),
+		checkpointFile:   filepath.Join(forestBase, "verifycheckpoint.dat"),
+		rootFiles: splitPaths{dir: forestBase, prefix: "roots",
+			indexFile: filepath.Join(forestBase, "rootsindex.dat")},
 	}
 	ttlBase := filepath.Join(basePath, "ttldata")
 	ttl := ttlDir{
-		base:       ttlBase,
-		ttlsetFile: filepath.Join(ttlBase, "ttldata.dat"),
-		OffsetFile: filepath.Join(ttlBase, "offsetfile.dat"),
+		base: ttlBase,
+		ttlFiles: splitPaths{dir: ttlBase, prefix: "ttl",
+			indexFile: filepath.Join(ttlBase, "ttlindex.dat")},
+		ttlsetFile:     filepath.Join(ttlBase, "ttldata.dat"),
+		OffsetFile:     filepath.Join(ttlBase, "offsetfile.dat"),
+		txidFile:       filepath.Join(ttlBase, "txidFile"),
+		txidOffsetFile: filepath.Join(ttlBase, "txidOffsetFile"),
 	}
 	undoBase := filepath.Join(basePath, "undoblockdata")
 	undo := undoDir{
-		base:       undoBase,
-		undoFile:   filepath.Join(undoBase, "undo.dat"),
-		offsetFile: filepath.Join(undoBase, "offset.dat"),
+		base: undoBase,
+		undoFiles: splitPaths{dir: undoBase, prefix: "undo",
+			indexFile: filepath.Join(undoBase, "undoindex.dat")},
+		undoFile:      filepath.Join(undoBase, "undo.dat"),
+		offsetFile:    filepath.Join(undoBase, "offset.dat"),
+		blockHashFile: filepath.Join(undoBase, "blockhash.dat"),
 	}
 
 	return utreeDir{
@@ -158,6 +222,8 @@ func initUtreeDir(basePath string) utreeDir {
 		ForestDir: forest,
 		TtlDir:    ttl,
 		UndoDir:   undo,
+
+		LeafIndexDir: filepath.Join(basePath, "leafindex"),
 	}
 }
 
@@ -181,15 +247,15 @@ func makePaths(dir utreeDir) error {
 	}
 	err = os.MkdirAll(dir.TtlDir.base, os.ModePerm)
 	if err != nil {
-		return fmt.Errorf("init makePaths error %s")
+		return fmt.Errorf("init makePaths error %s", err.Error())
 	}
 	err = os.MkdirAll(dir.UndoDir.base, os.ModePerm)
 	if err != nil {
-		return fmt.Errorf("init makePaths error %s")
+		return fmt.Errorf("init makePaths error %s", err.Error())
 	}
 	err = os.MkdirAll(dir.TtlDir.base, os.ModePerm)
 	if err != nil {
-		return fmt.Errorf("init makePaths error %s")
+		return fmt.Errorf("init makePaths error %s", err.Error())
 	}
 	return nil
 }
@@ -226,6 +292,10 @@ type Config struct {
 	// type of the forest we're using
 	forestType forestType
 
+	// hasher for the forest. The proofs generated are only valid for
+	// accumulators using the same one.
+	hasher accumulator.Hasher
+
 	// quitAfter syncing to this block height
 	quitAfter int32
 
@@ -241,6 +311,15 @@ type Config struct {
 	// don't serve after generating proofs
 	noServe bool
 
+	// keep building proofs as new blocks come in
+	follow bool
+
+	// how big the proof, undo and ttl files get, see splitFile
+	maxFileSize uint32
+
+	// how many blocks to keep proofs and undo data for.  0 keeps them all.
+	prune int32
+
 	// enable tracing
 	TraceProf string
 
@@ -333,9 +412,34 @@ func Parse(args []string) (*Config, error) {
 		return nil, errWrongForestType(*forestTypeCmd)
 	}
 
+	switch *hashModeCmd {
+	case "legacy":
+		cfg.hasher = accumulator.DefaultHasher
+	case "rowcommit":
+		cfg.hasher = accumulator.RowCommitting(accumulator.DefaultHasher)
+	default:
+		return nil, errWrongHashMode(*hashModeCmd)
+	}
+
 	cfg.quitAfter = int32(*quitAfterCmd)
 	cfg.noServe = *noServeCmd
 	cfg.serve = *serve
+	cfg.follow = *followCmd
+	if cfg.follow && cfg.serve {
+		return nil, errFollowFlag("-serve")
+	}
+	if cfg.follow && cfg.quitAfter > 0 {
+		return nil, errFollowFlag("-quitafter")
+	}
+	// offsets in the files are 4 bytes
+	if *maxFileSizeCmd < 1 || *maxFileSizeCmd >= 1<<12 {
+		return nil, errMaxFileSize(*maxFileSizeCmd)
+	}
+	cfg.maxFileSize = uint32(*maxFileSizeCmd) << 20
+	if *pruneCmd != 0 && *pruneCmd < minPrune {
+		return nil, errPrune(*pruneCmd)
+	}
+	cfg.prune = int32(*pruneCmd)
 
 	return &cfg, nil
 }
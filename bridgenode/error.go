@@ -8,9 +8,13 @@ import (
 var (
 	ErrNoDataDir       = errors.New("No bitcoind datadir")
 	ErrWrongForestType = errors.New("Invalid forest type of")
+	ErrWrongHashMode   = errors.New("Invalid hash mode of")
 	ErrInvalidNetwork  = errors.New("Invalid/not supported net flag given")
 	ErrBuildProofs     = errors.New("BuildProofs error")
 	ErrArchiveServer   = errors.New("ArchiveServer error")
+	ErrFollowFlag      = errors.New("Can't follow with flag")
+	ErrMaxFileSize     = errors.New("Invalid max file size of")
+	ErrPrune           = errors.New("Invalid prune depth of")
 )
 
 func errNoDataDir(path string) error {
@@ -22,6 +26,10 @@ func errWrongForestType(fType string) error {
 	return fmt.Errorf("%s: %s", ErrWrongForestType, fType)
 }
 
+func errWrongHashMode(mode string) error {
+	return fmt.Errorf("%s: %s", ErrWrongHashMode, mode)
+}
+
 func errInvalidNetwork(nType string) error {
 	return fmt.Errorf("%s: %s", ErrInvalidNetwork, nType)
 }
@@ -33,3 +41,16 @@ func errBuildProofs(s error) error {
 func errArchiveServer(s error) error {
 	return fmt.Errorf("%s: %s", ErrArchiveServer, s)
 }
+
+func errFollowFlag(flag string) error {
+	return fmt.Errorf("%s: %s", ErrFollowFlag, flag)
+}
+
+func errMaxFileSize(size int) error {
+	return fmt.Errorf("%s: %d MB, must be 1 to 4095", ErrMaxFileSize, size)
+}
+
+func errPrune(blocks int) error {
+	return fmt.Errorf("%s: %d blocks, must be at least %d",
+		ErrPrune, blocks, minPrune)
+}
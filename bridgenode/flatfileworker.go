@@ -13,19 +13,23 @@ import (
 
 /*
 Proof file format is somewhat like the blk.dat and rev.dat files.  But it's
-always in order!  The offset file is in 8 byte chunks, so to find the proof
-data for block 100 (really 101), seek to byte 800 and read 8 bytes.
-
-The proof file is: 4 bytes empty (zeros for now, could do something else later)
-4 bytes proof length, then the proof data.
-
-Offset file is: 8 byte int64 offset.  Right now it's all 1 big file, can
-change to 4 byte which file and 4 byte offset within file like the blk/rev but
-we're not running on fat32 so works OK for now.
-
-the offset file will start with 16 zero-bytes.  The first offset is 0 because
-there is no block 0.  The next is 0 because block 1 starts at byte 0 of proof.dat.
-then the second offset, at byte 16, is 12 or so, as that's block 2 in the proof.dat.
+always in order!  The data is split over numbered files with an index of
+where each block starts, see splitFile.  To find the proof data for block
+100, read the 8 bytes at byte 800 of the index for the file number and
+offset.
+
+Each proof is: 4 bytes magic (aaffaafe), 4 bytes proof length, 4 bytes
+crc32 of the proof data, then the proof data.  Undo blocks are stored the
+same way.  Records from before the checksums start with aaffaaff and don't
+have the crc32.
+
+TTLs are in their own split files.  Each block gets a record appended when
+it's built, with a 4 byte slot for each of its outputs, so a TTL is found by
+the height the output was created at and its index among the block's
+outputs.  The slot is filled in once, when the output is spent.  The proofs
+don't have the TTLs in them, so once a proof is written it doesn't change;
+the server puts the block's TTLs into the UData when it sends the proof
+out.  Proofs from the old proof.dat have a zero for each output there.
 */
 
 /*
@@ -42,109 +46,143 @@ and send it over to the ttl worker.
 also gets offset values from flatFileBlockWorker so it knows it's safe to write
 to those locations.
 Then it writes all the TTL values to the correct places in by checking all the
-offsetInRam values and writing to the correct 4-byte location in the proof file.
+offsetInRam values and writing to the correct 4-byte location in the TTL files.
 
 */
 
 // shared state for the flat file worker methods
 type flatFileState struct {
-	heightOffsets         []int64
-	proofFile, offsetFile *os.File
-	finishedHeight        int32
-	currentOffset         int64
-	fileWait              *sync.WaitGroup
+	// where each block starts
+	heightOffsets  []filePos
+	files          *splitFile
+	finishedHeight int32
+	fileWait       *sync.WaitGroup
+	// how many blocks to keep, or 0 for all of them
+	prune int32
+
+	// only used by the undo worker
+	blockHashFile *os.File
 }
 
+// blockUndo is an undo block along with the hash of the block it undoes.
+// The hashes are saved so that on a reorg we can tell where the chains split.
+type blockUndo struct {
+	undo      accumulator.UndoBlock
+	blockHash [32]byte
+}
+
+// flatFileWorkerProof writes proofs to the proof files.  If tip isn't nil
+// it's moved up after each one's written, so the server can send it out.
+// If prune isn't 0, files with only proofs older than the last prune
+// blocks are deleted.  Once proofChan is closed it closes the files and
+// tells fileWait.
 func flatFileWorkerProof(
 	proofChan chan btcacc.UData,
 	utreeDir utreeDir,
-	fileWait *sync.WaitGroup) {
+	maxSize uint32,
+	prune int32,
+	fileWait *sync.WaitGroup,
+	tip *chainTip) {
 
 	var pf flatFileState
 	var err error
 
-	pf.offsetFile, err = os.OpenFile(
-		utreeDir.ProofDir.pOffsetFile, os.O_CREATE|os.O_RDWR, 0600)
-	if err != nil {
-		panic(err)
-	}
-
-	pf.proofFile, err = os.OpenFile(
-		utreeDir.ProofDir.pFile, os.O_CREATE|os.O_WRONLY, 0600)
+	pf.files, err = openSplitFile(utreeDir.ProofDir.pFiles, maxSize, false)
 	if err != nil {
 		panic(err)
 	}
 
 	pf.fileWait = fileWait
+	pf.prune = prune
 
 	err = pf.ffInit()
 	if err != nil {
 		panic(err)
 	}
 
-	for {
-		ud := <-proofChan
+	for ud := range proofChan {
 		err = pf.writeProofBlock(ud)
 		if err != nil {
 			panic(err)
 		}
+		if tip != nil {
+			tip.set(ud.Height)
+		}
+	}
+	err = pf.files.close()
+	if err != nil {
+		panic(err)
 	}
+	fileWait.Done()
 }
 
+// flatFileWorkerUndo writes undo blocks to the undo files, and the hashes
+// of the blocks they undo to the block hash file, until undoChan is closed
 func flatFileWorkerUndo(
-	undoChan chan accumulator.UndoBlock,
+	undoChan chan blockUndo,
 	utreeDir utreeDir,
+	maxSize uint32,
+	prune int32,
 	fileWait *sync.WaitGroup) {
 
 	var uf flatFileState
 	var err error
 
-	uf.offsetFile, err = os.OpenFile(
-		utreeDir.UndoDir.offsetFile, os.O_CREATE|os.O_RDWR, 0600)
+	uf.files, err = openSplitFile(utreeDir.UndoDir.undoFiles, maxSize, false)
 	if err != nil {
 		panic(err)
 	}
 
-	uf.proofFile, err = os.OpenFile(
-		utreeDir.UndoDir.undoFile, os.O_CREATE|os.O_WRONLY, 0600)
+	uf.blockHashFile, err = os.OpenFile(
+		utreeDir.UndoDir.blockHashFile, os.O_CREATE|os.O_WRONLY, 0600)
 	if err != nil {
 		panic(err)
 	}
 
 	uf.fileWait = fileWait
+	uf.prune = prune
 
 	err = uf.ffInit()
 	if err != nil {
 		panic(err)
 	}
-	for {
-		undo := <-undoChan
-		err = uf.writeUndoBlock(undo)
+	for bu := range undoChan {
+		// write the hash first; writeUndoBlock tells the waitgroup we're done
+		_, err = uf.blockHashFile.WriteAt(
+			bu.blockHash[:], int64(32*bu.undo.Height))
+		if err != nil {
+			panic(err)
+		}
+		err = uf.writeUndoBlock(bu.undo)
 		if err != nil {
 			panic(err)
 		}
-
 	}
-
+	err = uf.blockHashFile.Close()
+	if err != nil {
+		panic(err)
+	}
+	err = uf.files.close()
+	if err != nil {
+		panic(err)
+	}
+	fileWait.Done()
 }
 
+// flatFileWorkerTTL makes room in the TTL files for each block's outputs,
+// and fills in the TTLs of the outputs each block spends, until
+// numOutputsChan is closed
 func flatFileWorkerTTL(
 	ttlResultChan chan ttlResultBlock,
 	numOutputsChan chan allocNSkipTTL,
 	utreeDir utreeDir,
+	maxSize uint32,
 	fileWait *sync.WaitGroup) {
 
 	var tf flatFileState
 	var err error
 
-	tf.offsetFile, err = os.OpenFile(
-		utreeDir.TtlDir.OffsetFile, os.O_CREATE|os.O_RDWR, 0600)
-	if err != nil {
-		panic(err)
-	}
-
-	tf.proofFile, err = os.OpenFile(
-		utreeDir.TtlDir.ttlsetFile, os.O_CREATE|os.O_RDWR, 0600)
+	tf.files, err = openSplitFile(utreeDir.TtlDir.ttlFiles, maxSize, false)
 	if err != nil {
 		panic(err)
 	}
@@ -155,21 +193,22 @@ func flatFileWorkerTTL(
 		panic(err)
 	}
 
-	for {
-		// expand TTL file by 4 byte for every utxo in this block
-		allocNSkip := <-numOutputsChan
-		numOutputs := allocNSkip.totalOut
-		// fmt.Printf("h %d %d utxos truncating from %d to %d\n",
-		// len(tf.heightOffsets), size,
-		// tf.currentOffset, tf.currentOffset+int64(size*4))
-
-		err = tf.proofFile.Truncate(tf.currentOffset + int64(numOutputs*4))
+	for allocNSkip := range numOutputsChan {
+		// allocate 4 bytes in the TTL files for every utxo in this block
+		size := allocNSkip.totalOut * 4
+		height := int32(len(tf.heightOffsets))
+		pos, err := tf.files.alloc(height, size)
+		if err != nil {
+			panic(err)
+		}
+		// zero it in case there's something left from before a crash
+		err = tf.files.writeAt(make([]byte, size), pos)
 		if err != nil {
 			panic(err)
 		}
 
 		// mark the TTLs which are unspendable.  Much easier than skipping them.
-		err = tf.writeSkipped(tf.currentOffset, allocNSkip.outskip)
+		err = tf.writeSkipped(pos, allocNSkip.outskip)
 		if err != nil {
 			panic(err)
 		}
@@ -180,115 +219,51 @@ func flatFileWorkerTTL(
 		if err != nil {
 			panic(err)
 		}
-		// append tf offsets after writing ttl data
-		tf.heightOffsets = append(tf.heightOffsets, tf.currentOffset)
-		// increment currentoffset value
-		tf.currentOffset = tf.currentOffset + int64(numOutputs*4)
-
-		err = binary.Write(tf.offsetFile, binary.BigEndian, tf.currentOffset)
-		if err != nil {
-			panic(err)
-		}
+		tf.heightOffsets = append(tf.heightOffsets, pos)
 	}
-
+	err = tf.files.close()
+	if err != nil {
+		panic(err)
+	}
+	fileWait.Done()
 }
 
 func (ff *flatFileState) ffInit() error {
-	// seek to end to get the number of offsets in the file (# of blocks)
-	offsetFileSize, err := ff.offsetFile.Seek(0, 2)
+	height, err := ff.files.height()
 	if err != nil {
 		return err
 	}
-	if offsetFileSize%8 != 0 {
-		return fmt.Errorf("offset file not mulitple of 8 bytes")
-	}
-
-	// resume setup -- read all existing offsets to ram
-	if offsetFileSize > 0 {
-		// offsetFile already exists so read the whole thing and send over the
-		// channel to the ttl worker.
-		savedHeight := int32(offsetFileSize/8) - 1
-		// TODO I'm not really sure why theres a -1 there
-		// seek back to the file start / block "0"
-		_, err := ff.offsetFile.Seek(0, 0)
-		if err != nil {
-			return err
-		}
-		ff.heightOffsets = make([]int64, savedHeight)
-		for ff.finishedHeight < savedHeight {
-			err = binary.Read(ff.offsetFile, binary.BigEndian, &ff.currentOffset)
-			if err != nil {
-				fmt.Printf("couldn't populate in-ram offsets on startup")
-				return err
-			}
-			ff.heightOffsets[ff.finishedHeight] = ff.currentOffset
-			ff.finishedHeight++
-		}
-
-		// set currentOffset to the end of the proof file
-		ff.currentOffset, err = ff.proofFile.Seek(0, 2)
+	// read all existing offsets to ram
+	ff.heightOffsets = make([]filePos, height+1)
+	for h := range ff.heightOffsets {
+		ff.heightOffsets[h], err = ff.files.pos(int32(h))
 		if err != nil {
+			fmt.Printf("couldn't populate in-ram offsets on startup")
 			return err
 		}
-
-	} else { // first time startup
-		// there is no block 0 so leave that empty
-		// fmt.Printf("setting h=1\n")
-		_, err = ff.offsetFile.Write(make([]byte, 8))
-		if err != nil {
-			return err
-		}
-		// do the same with the in-ram slice
-		ff.heightOffsets = make([]int64, 1)
-		// does nothing.  We're *finished* writing block 0
-		ff.finishedHeight = 0
 	}
-
+	ff.finishedHeight = height
 	return nil
 }
 
 func (uf *flatFileState) writeUndoBlock(ub accumulator.UndoBlock) error {
-	undoSize := ub.SerializeSize()
-	buf := make([]byte, undoSize)
-
-	// write the offset of current of undo block to offset file
-	buf = buf[:8]
-	uf.heightOffsets = append(uf.heightOffsets, uf.currentOffset)
-
-	binary.BigEndian.PutUint64(buf, uint64(uf.currentOffset))
-	_, err := uf.offsetFile.WriteAt(buf, int64(8*ub.Height))
-	if err != nil {
-		return err
-	}
-
-	// write to undo file
-	_, err = uf.proofFile.WriteAt([]byte{0xaa, 0xff, 0xaa, 0xff}, uf.currentOffset)
-	if err != nil {
-		return err
-	}
-
-	//prefix with size of the undoblocks
-	buf = buf[:4]
-	binary.BigEndian.PutUint32(buf, uint32(undoSize))
-	_, err = uf.proofFile.WriteAt(buf, uf.currentOffset+4)
-	if err != nil {
-		return err
-	}
-
 	// Serialize UndoBlock
-	buf = buf[:0]
-	bytesBuf := bytes.NewBuffer(buf)
-	err = ub.Serialize(bytesBuf)
+	bytesBuf := bytes.NewBuffer(make([]byte, 0, ub.SerializeSize()))
+	err := ub.Serialize(bytesBuf)
 	if err != nil {
 		return err
 	}
 
-	_, err = uf.proofFile.WriteAt(bytesBuf.Bytes(), uf.currentOffset+4+4)
+	err = uf.files.writeRecord(ub.Height, bytesBuf.Bytes())
 	if err != nil {
 		return err
 	}
-
-	uf.currentOffset = uf.currentOffset + int64(undoSize) + 8
+	if uf.prune != 0 {
+		err = uf.files.prune(ub.Height - uf.prune + 1)
+		if err != nil {
+			return err
+		}
+	}
 	uf.finishedHeight++
 
 	uf.fileWait.Done()
@@ -300,57 +275,23 @@ func (pf *flatFileState) writeProofBlock(ud btcacc.UData) error {
 	// fmt.Printf("udata height %d flat file height %d\n",
 	// ud.Height, ff.finishedHeight)
 
-	// get the new block proof
-	// put offset in ram
-	// write to offset file so we can resume; offset file is only
-	// read on startup and always incremented so we shouldn't need to seek
-
-	// pre-allocated the needed buffer
-	udSize := ud.SerializeSize()
-	lilBuf := make([]byte, udSize)
-
-	// write write the offset of the current proof to the offset file
-	lilBuf = lilBuf[:8]
-	pf.heightOffsets = append(pf.heightOffsets, pf.currentOffset)
-
-	binary.BigEndian.PutUint64(lilBuf, uint64(pf.currentOffset))
-	_, err := pf.offsetFile.WriteAt(lilBuf, int64(8*ud.Height))
-	if err != nil {
-		return err
-	}
-
-	// write to proof file
-	_, err = pf.proofFile.WriteAt([]byte{0xaa, 0xff, 0xaa, 0xff}, pf.currentOffset)
-	if err != nil {
-		return err
-	}
-
-	// prefix with size
-	lilBuf = lilBuf[:4]
-	binary.BigEndian.PutUint32(lilBuf, uint32(udSize))
-	// +4 to account for the 4 magic bytes
-	_, err = pf.proofFile.WriteAt(lilBuf, pf.currentOffset+4)
-	if err != nil {
-		return err
-	}
-
 	// Serialize proof
-	lilBuf = lilBuf[:0]
-	bigBuf := bytes.NewBuffer(lilBuf)
-	err = ud.Serialize(bigBuf)
+	bigBuf := bytes.NewBuffer(make([]byte, 0, ud.SerializeSize()))
+	err := ud.Serialize(bigBuf)
 	if err != nil {
 		return err
 	}
 
-	// Write to the file
-	// +4 +4 to account for the 4 magic bytes and the 4 size bytes
-	_, err = pf.proofFile.WriteAt(bigBuf.Bytes(), pf.currentOffset+4+4)
+	err = pf.files.writeRecord(ud.Height, bigBuf.Bytes())
 	if err != nil {
 		return err
 	}
-
-	// 4B magic & 4B size comes first
-	pf.currentOffset += int64(ud.SerializeSize()) + 8
+	if pf.prune != 0 {
+		err = pf.files.prune(ud.Height - pf.prune + 1)
+		if err != nil {
+			return err
+		}
+	}
 	pf.finishedHeight++
 
 	if ud.Height != pf.finishedHeight {
@@ -372,13 +313,12 @@ type allocNSkipTTL struct {
 // block as they're created.  Anything using this TTL data knows that these
 // outputs can be skipped.
 func (tf *flatFileState) writeSkipped(
-	startOffset int64, outskip []uint32) error {
+	start filePos, outskip []uint32) error {
 
 	skipBytes := [4]byte{0x7f, 0xff, 0xff, 0xff}
 
 	for _, idxInBlock := range outskip {
-		_, err := tf.proofFile.WriteAt(
-			skipBytes[:], startOffset+(int64(idxInBlock)*4))
+		err := tf.files.writeAt(skipBytes[:], start.add(idxInBlock*4))
 		if err != nil {
 			return err
 		}
@@ -401,42 +341,36 @@ func (tf *flatFileState) writeTTLs(ttlRes ttlResultBlock) error {
 		binary.BigEndian.PutUint32(
 			ttlArr[:], uint32(ttlRes.destroyHeight-c.createHeight))
 
-		// calculate location of that txo's ttl value in the proof file:
+		// calculate location of that txo's ttl value in the ttl files:
 		// write it's lifespan as a 4 byte int32 (bit of a waste as
 		// 2 or 3 bytes would work)
-		loc := tf.heightOffsets[c.createHeight] + int64(c.indexWithinBlock)*4
+		loc := tf.heightOffsets[c.createHeight].add(
+			uint32(c.indexWithinBlock) * 4)
 
 		// first, read the data there to make sure it's empty.
 		// If there's something already there, we messed up & should panic.
 		// TODO once everything works great can remove this
 
-		n, err := tf.proofFile.ReadAt(readEmpty[:], loc)
-		if n != 4 && err != nil {
+		err := tf.files.readAt(readEmpty[:], loc)
+		if err != nil {
 			fmt.Printf("ttl destroyH %d createH %d idxinblock %d\n",
 				ttlRes.destroyHeight, c.createHeight, c.indexWithinBlock)
-			fmt.Printf("want to read byte %d = hO[%d]=%d + %d * 4\n",
-				loc, c.createHeight,
-				tf.heightOffsets[c.createHeight], c.indexWithinBlock)
-			s, _ := tf.proofFile.Stat()
-			return fmt.Errorf("proofFile.ReadAt %d size %d %s",
-				loc, s.Size(), err.Error())
+			return fmt.Errorf("ttl read file %d offset %d %s",
+				loc.fileNum, loc.offset, err.Error())
 		}
 
 		if readEmpty != expectedEmpty {
-			return fmt.Errorf("writeTTLs Wanted to overwrite byte %d with %x "+
-				"but %x was already there. desth %d createh %d idxinblk %d",
-				loc, ttlArr, readEmpty, ttlRes.destroyHeight,
-				c.createHeight, c.indexWithinBlock)
+			return fmt.Errorf("writeTTLs Wanted to overwrite file %d byte %d "+
+				"with %x but %x was already there. desth %d createh %d "+
+				"idxinblk %d", loc.fileNum, loc.offset, ttlArr, readEmpty,
+				ttlRes.destroyHeight, c.createHeight, c.indexWithinBlock)
 		}
 
-		// fmt.Printf("  writeTTLs overwrite byte %d with %x "+
-		// "desth %d createh %d idxinblk %d\n",
-		// loc, ttlArr, ttlRes.destroyHeight, c.createHeight, c.indexWithinBlock)
-
 		// fmt.Printf("overwriting %x with %x\t", readEmpty, ttlArr)
-		_, err = tf.proofFile.WriteAt(ttlArr[:], loc)
+		err = tf.files.writeAt(ttlArr[:], loc)
 		if err != nil {
-			return fmt.Errorf("proofFile.WriteAt %d %s", loc, err.Error())
+			return fmt.Errorf("ttl write file %d offset %d %s",
+				loc.fileNum, loc.offset, err.Error())
 		}
 
 	}
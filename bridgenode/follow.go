@@ -0,0 +1,192 @@
+package bridgenode
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+/*
+Follow mode:
+
+Normally the bridge node builds proofs up to the last block in the offset
+file and stops.  With -follow, BlockAndRevReader doesn't stop there.  Every
+followPollInterval it looks at the blk files for blocks it hasn't indexed
+yet, and once bitcoind has written the undo data for them, adds them to the
+offset file and carries on building proofs and TTLs.
+
+The server runs alongside, serving up to the last block whose proof has
+been written.  CSNs that can wait (FeatureTip) are kept connected at the tip
+and get new blocks as they come in.
+
+If bitcoind switches to another branch, the offset file gets cut back to
+the fork and moves onto the new branch.  Once the blocks already sent into
+the pipeline are done, BuildProofs rolls back to the fork like it would on
+startup, moves the server's tip back, and carries on along the new branch.
+Waiting CSNs get the new blocks, see they don't connect and undo their own
+tips.
+*/
+
+// followPollInterval is how often to look for new blocks in follow mode.
+// It's a var so tests don't have to wait as long.
+var followPollInterval = 10 * time.Second
+
+// tipInterval is how often the server sends a MsgTip to clients waiting for
+// new blocks.  It needs to be well under the clients' stall timeout.
+const tipInterval = 30 * time.Second
+
+// chainTip is the last block the server can serve.  In follow mode it goes
+// up as proofs get written.
+type chainTip struct {
+	mtx    sync.Mutex
+	height int32
+	// newBlock is closed when the height goes up, then replaced.  It's nil
+	// if the tip never moves.
+	newBlock chan bool
+	// if capped, the tip can't go past limit.  The offset file has been
+	// cut back there and the proofs above it are for blocks that are gone.
+	capped bool
+	limit  int32
+}
+
+// newChainTip returns a chainTip at height.  If follow isn't set it always
+// stays there.
+func newChainTip(height int32, follow bool) *chainTip {
+	ct := &chainTip{height: height}
+	if follow {
+		ct.newBlock = make(chan bool)
+	}
+	return ct
+}
+
+// get returns the tip height, and the channel that's closed when it changes
+func (ct *chainTip) get() (int32, chan bool) {
+	ct.mtx.Lock()
+	defer ct.mtx.Unlock()
+	return ct.height, ct.newBlock
+}
+
+// set moves the tip up to height, or to the limit if it's capped lower
+func (ct *chainTip) set(height int32) {
+	ct.mtx.Lock()
+	defer ct.mtx.Unlock()
+	if ct.capped && height > ct.limit {
+		height = ct.limit
+	}
+	ct.height = height
+	close(ct.newBlock)
+	ct.newBlock = make(chan bool)
+}
+
+// cut brings the tip down to height if it's above, and keeps it from going
+// past there until uncap is called
+func (ct *chainTip) cut(height int32) {
+	ct.mtx.Lock()
+	defer ct.mtx.Unlock()
+	if !ct.capped || height < ct.limit {
+		ct.capped, ct.limit = true, height
+	}
+	if ct.height > ct.limit {
+		ct.height = ct.limit
+	}
+}
+
+// uncap lets the tip go up again after a reorg, once the proofs match the
+// offset file
+func (ct *chainTip) uncap() {
+	ct.mtx.Lock()
+	defer ct.mtx.Unlock()
+	ct.capped = false
+}
+
+// waitForBlocks updates the offset index every followPollInterval until
+// there are blocks past height, or the block at height, hash, has left the
+// chain.  It returns the new tip and whether there was a reorg, or stop if
+// haltRequest came in first.
+func (ix *offsetIndexer) waitForBlocks(height int32, hash [32]byte,
+	haltRequest chan bool) (tip int32, reorg, stop bool) {
+
+	for {
+		select {
+		case <-haltRequest:
+			return height, false, true
+		case <-time.After(followPollInterval):
+		}
+		tip, err := ix.update()
+		if err != nil {
+			fmt.Printf("follow: %s\n", err.Error())
+			continue
+		}
+		if tip < height {
+			return tip, true, false
+		}
+		ours, err := ix.hashAt(height)
+		if err != nil {
+			fmt.Printf("follow: %s\n", err.Error())
+			continue
+		}
+		if ours != hash {
+			return tip, true, false
+		}
+		if tip > height {
+			return tip, false, false
+		}
+	}
+}
+
+// followReorg rolls back to where the chain the offset file is on now
+// leaves the blocks we built, so building can carry on along the new chain.
+// The server's tip was already cut back when the offset file was repointed,
+// so it doesn't send out blocks that are gone; it's let go again at the
+// end.  The leaf index and root files get closed for rollBack and opened
+// again.
+func followReorg(cfg *Config, ps *proofServer, leaves *leafIndex,
+	rootFiles *splitFile, tip *chainTip, follower *offsetIndexer,
+	height int32) (*leafIndex, *splitFile, int32, error) {
+
+	forkHeight, err := findForkHeight(cfg, height, follower.height)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	fmt.Printf("reorg: rolling back from height %d to %d\n",
+		height, forkHeight)
+	if tip != nil {
+		tip.cut(forkHeight)
+	}
+
+	ps.mtx.Lock()
+	ps.leaves = nil
+	err = leaves.close()
+	if err == nil {
+		err = rootFiles.close()
+	}
+	if err == nil {
+		err = rollBack(cfg, ps.forest, height, forkHeight)
+	}
+	if err == nil {
+		// the files are cut back now, so the saved forest has to match
+		err = syncBridgeNodeData(ps.forest, forkHeight, cfg)
+	}
+	ps.mtx.Unlock()
+	if err != nil {
+		return nil, nil, 0, err
+	}
+
+	leaves, err = openBuildLeafIndex(cfg, forkHeight)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	rootFiles, err = openRootFiles(cfg, forkHeight)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if tip != nil {
+		ps.mtx.Lock()
+		ps.leaves = leaves
+		ps.mtx.Unlock()
+		tip.uncap()
+	}
+	// read up to the new tip
+	cfg.quitAfter = follower.height
+	return leaves, rootFiles, forkHeight, nil
+}
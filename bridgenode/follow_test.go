@@ -0,0 +1,192 @@
+package bridgenode
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestChainTip(t *testing.T) {
+	tip := newChainTip(10, true)
+	height, newBlock := tip.get()
+	if height != 10 {
+		t.Fatalf("tip at %d, expect 10", height)
+	}
+	go tip.set(11)
+	select {
+	case <-newBlock:
+	case <-time.After(time.Second):
+		t.Fatal("no new block signal")
+	}
+	height, _ = tip.get()
+	if height != 11 {
+		t.Fatalf("tip at %d, expect 11", height)
+	}
+
+	// once it's cut back it stays there until uncap
+	tip.cut(9)
+	tip.set(12)
+	height, _ = tip.get()
+	if height != 9 {
+		t.Fatalf("cut tip at %d, expect 9", height)
+	}
+	tip.uncap()
+	tip.set(12)
+	height, _ = tip.get()
+	if height != 12 {
+		t.Fatalf("tip at %d, expect 12", height)
+	}
+
+	fixed := newChainTip(10, false)
+	_, newBlock = fixed.get()
+	if newBlock != nil {
+		t.Fatal("fixed tip can move")
+	}
+}
+
+func TestWaitForBlocksReorg(t *testing.T) {
+	dir, err := ioutil.TempDir("", "followtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg, fc := newOffsetTest(t, dir)
+	followPollInterval = 10 * time.Millisecond
+	defer func() { followPollInterval = 10 * time.Second }()
+
+	chain := fc.addBlocks(-1, 3)
+	fc.write(0, chain...)
+	fc.index(true, chain...)
+	ix, err := openOffsetIndexer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ix.close()
+	_, err = ix.update()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a block on top is just a new tip
+	next := fc.addBlock(chain[2])
+	fc.write(0, next)
+	fc.index(true, next)
+	tip, reorg, stop := ix.waitForBlocks(3, fc.hashes[chain[2]], nil)
+	if tip != 4 || reorg || stop {
+		t.Fatalf("got tip %d reorg %v stop %v, expect 4", tip, reorg, stop)
+	}
+
+	// then 4 and 5 on another branch from 3 replace 4
+	branch := fc.addBlocks(chain[2], 2)
+	fc.write(0, branch...)
+	fc.index(true, branch...)
+	tip, reorg, stop = ix.waitForBlocks(4, fc.hashes[next], nil)
+	if tip != 5 || !reorg || stop {
+		t.Fatalf("got tip %d reorg %v stop %v, expect 5 and a reorg",
+			tip, reorg, stop)
+	}
+}
+
+// A reorg while following saves the forest without closing it, so building
+// can carry on with it, and what's saved restores to the same forest.
+func TestFollowReorgDiskForest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "followtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := buildTestProofs(t, dir, 6, diskForest)
+	// the same chain up to 4, for the roots to expect after the reorg
+	ramDir := filepath.Join(dir, "ram")
+	err = os.Mkdir(ramDir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	built, err := restoreForest(buildTestProofs(t, ramDir, 4, ramForest))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := built.GetRoots()
+
+	forest, err := restoreForest(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaves, err := openBuildLeafIndex(cfg, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootFiles, err := openRootFiles(cfg, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// blocks 5 and 6 were built on are no longer in the chain
+	hashFile, err := os.OpenFile(
+		cfg.UtreeDir.UndoDir.blockHashFile, os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = hashFile.WriteAt(bytes.Repeat([]byte{0xff}, 64), 5*32)
+	hashFile.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// no txids to clear, but rollBack needs the files
+	err = ioutil.WriteFile(cfg.UtreeDir.TtlDir.txidFile, nil, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(
+		cfg.UtreeDir.TtlDir.txidOffsetFile, make([]byte, 7*8), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ps := &proofServer{forest: forest, leaves: leaves}
+	tip := newChainTip(6, true)
+	follower := &offsetIndexer{cfg: cfg, height: 6, served: tip}
+
+	leaves, rootFiles, height, err := followReorg(
+		cfg, ps, leaves, rootFiles, tip, follower, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leaves.close()
+	defer rootFiles.close()
+	if height != 4 {
+		t.Fatalf("rolled back to %d, expect 4", height)
+	}
+	served, _ := tip.get()
+	if served != 4 {
+		t.Fatalf("tip at %d after the reorg, expect 4", served)
+	}
+	if !reflect.DeepEqual(forest.GetRoots(), expect) {
+		t.Fatalf("roots after the reorg %v, expect %v",
+			forest.GetRoots(), expect)
+	}
+
+	// building goes on from the same forest, which was saved as it is
+	saved, err := restoreForest(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(saved.GetRoots(), expect) {
+		t.Fatalf("saved roots %v, expect %v", saved.GetRoots(), expect)
+	}
+	savedHeight, err := restoreHeight(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if savedHeight != 4 {
+		t.Fatalf("saved height %d, expect 4", savedHeight)
+	}
+	tip.set(5)
+	served, _ = tip.get()
+	if served != 5 {
+		t.Fatalf("tip at %d after building on, expect 5", served)
+	}
+}
@@ -0,0 +1,272 @@
+package bridgenode
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcutil"
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/btcacc"
+	"github.com/mit-dci/utreexo/util"
+)
+
+/*
+Fsck reads every proof and undo record that's kept and checks that it
+matches its checksum and deserializes for the right block.  With repair
+set it then makes new proofs for the bad ones:
+
+A copy of the forest in ram is undone, using the undo records, back to
+just before the lowest bad proof.  Then the blocks from there on are read
+from the blk files and put back in to the copy like when building, and the
+bad proofs are written over with the ones that come out.  The TTLs aren't
+in the proofs, so they come out exactly the same as before.  At the end the
+copy is back where it started, which is checked against the roots from
+before.  The saved forest is never changed, so if the repair stops partway
+it's still good, but the copy needs as much ram as a ram forest.
+
+The undo records are needed to go back, so bad undo records can't be fixed
+this way; the only thing to do then is build again from scratch.
+*/
+
+// Fsck checks the proof and undo records, and makes new proofs for any bad
+// ones if repair is set
+func Fsck(cfg *Config, repair bool) error {
+	err := migrateSplitFiles(cfg.UtreeDir, cfg.maxFileSize)
+	if err != nil {
+		return err
+	}
+	height, err := restoreHeight(cfg)
+	if err != nil {
+		return err
+	}
+	start := int32(1)
+	if cfg.prune != 0 && height-cfg.prune+1 > start {
+		start = height - cfg.prune + 1
+	}
+
+	badProofs, badUndos, err := checkRecords(cfg.UtreeDir, start, height)
+	if err != nil {
+		return err
+	}
+	if len(badProofs) == 0 && len(badUndos) == 0 {
+		fmt.Printf("proofs and undo blocks %d to %d ok\n", start, height)
+		return nil
+	}
+	if len(badUndos) != 0 {
+		return fmt.Errorf("%d bad undo blocks.  repair can't make undo "+
+			"blocks again, or undo back past them to fix proofs.  "+
+			"Delete %s and build again",
+			len(badUndos), filepath.Dir(cfg.UtreeDir.UndoDir.base))
+	}
+	if !repair {
+		return fmt.Errorf("%d bad proofs, run repair to make them again",
+			len(badProofs))
+	}
+	return repairProofs(cfg, height, badProofs)
+}
+
+// checkRecords reads the proofs and undo blocks from start to end and
+// returns the heights of the ones that are bad
+func checkRecords(dir utreeDir, start, end int32) (
+	badProofs, badUndos []int32, err error) {
+
+	proofFiles, err := openSplitFile(dir.ProofDir.pFiles, 0, true)
+	if err != nil {
+		return
+	}
+	defer proofFiles.close()
+	undoFiles, err := openSplitFile(dir.UndoDir.undoFiles, 0, true)
+	if err != nil {
+		return
+	}
+	defer undoFiles.close()
+
+	for h := start; h <= end; h++ {
+		if h%10000 == 0 {
+			fmt.Printf("checked to h %d\n", h)
+		}
+		err = checkProof(proofFiles, h)
+		if err != nil {
+			fmt.Printf("bad proof %d: %s\n", h, err.Error())
+			badProofs = append(badProofs, h)
+		}
+		err = checkUndo(undoFiles, h)
+		if err != nil {
+			fmt.Printf("bad undo block %d: %s\n", h, err.Error())
+			badUndos = append(badUndos, h)
+		}
+	}
+	return badProofs, badUndos, nil
+}
+
+// checkProof reads the proof for block height and makes sure it's all
+// there
+func checkProof(proofFiles *splitFile, height int32) error {
+	b, err := proofFiles.readRecord(height)
+	if err != nil {
+		return err
+	}
+	r := bytes.NewReader(b)
+	var ud btcacc.UData
+	err = ud.Deserialize(r)
+	if err != nil {
+		return err
+	}
+	if r.Len() != 0 {
+		return fmt.Errorf("%d bytes left over", r.Len())
+	}
+	if ud.Height != height {
+		return fmt.Errorf("proof is for block %d", ud.Height)
+	}
+	return nil
+}
+
+// checkUndo reads the undo block for block height and makes sure it's
+// all there
+func checkUndo(undoFiles *splitFile, height int32) error {
+	b, err := undoFiles.readRecord(height)
+	if err != nil {
+		return err
+	}
+	r := bytes.NewReader(b)
+	var ub accumulator.UndoBlock
+	err = ub.Deserialize(r)
+	if err != nil {
+		return err
+	}
+	if r.Len() != 0 {
+		return fmt.Errorf("%d bytes left over", r.Len())
+	}
+	return nil
+}
+
+// repairProofs undoes a ram copy of the forest from height to just before
+// the first bad proof, then goes forward again writing new proofs for the
+// bad ones
+func repairProofs(cfg *Config, height int32, bad []int32) error {
+	saved, err := restoreForest(cfg)
+	if err != nil {
+		return err
+	}
+	roots := saved.GetRoots()
+	forest := saved.RamCopy()
+
+	low := bad[0]
+	fmt.Printf("undoing from %d back to %d\n", height, low-1)
+	for h := height; h >= low; h-- {
+		ub, err := readUndoBlock(cfg.UtreeDir.UndoDir, h)
+		if err != nil {
+			return err
+		}
+		err = forest.Undo(ub)
+		if err != nil {
+			return fmt.Errorf("undo h %d %s", h, err.Error())
+		}
+	}
+
+	proofFiles, err := openSplitFile(
+		cfg.UtreeDir.ProofDir.pFiles, cfg.maxFileSize, false)
+	if err != nil {
+		return err
+	}
+	defer proofFiles.close()
+	offsetFile, err := os.Open(cfg.UtreeDir.OffsetDir.OffsetFile)
+	if err != nil {
+		return err
+	}
+	defer offsetFile.Close()
+	hashFile, err := os.Open(cfg.UtreeDir.UndoDir.blockHashFile)
+	if err != nil {
+		return err
+	}
+	defer hashFile.Close()
+
+	ps := &proofServer{forest: forest}
+	isBad := make(map[int32]bool)
+	for _, h := range bad {
+		isBad[h] = true
+	}
+	for h := low; h <= height; {
+		blocks, revs, err := GetRawBlocksFromDisk(
+			h, height-h+1, offsetFile, cfg.BlockDir)
+		if err != nil {
+			return err
+		}
+		if len(blocks) == 0 {
+			return fmt.Errorf("no block %d in %s", h, cfg.BlockDir)
+		}
+		for i := range blocks {
+			bnr := blockAndRev{
+				Height: h,
+				Blk:    btcutil.NewBlock(&blocks[i]),
+				Rev:    revs[i],
+			}
+			bnr.inCount, bnr.outCount, bnr.inSkipList, bnr.outSkipList =
+				util.DedupeBlock(bnr.Blk)
+
+			// make sure it's the block the proofs were built on
+			var hash chainhash.Hash
+			_, err = hashFile.ReadAt(hash[:], int64(32*h))
+			if err != nil {
+				return err
+			}
+			if *bnr.Blk.Hash() != hash {
+				return fmt.Errorf("block %d is %s but proofs are for %s. "+
+					"Start the bridge node to roll back the reorg first",
+					h, bnr.Blk.Hash(), hash)
+			}
+
+			ud, _, err := connectBlock(ps, nil, &bnr)
+			if err != nil {
+				return fmt.Errorf("h %d %s", h, err.Error())
+			}
+			if isBad[h] {
+				b, err := repairedProof(proofFiles, ud, bnr.outCount)
+				if err != nil {
+					return err
+				}
+				err = proofFiles.rewriteRecord(h, b)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("rewrote proof %d\n", h)
+			}
+			h++
+		}
+	}
+
+	if !reflect.DeepEqual(forest.GetRoots(), roots) {
+		return fmt.Errorf("forest roots %x after repair, expect %x",
+			forest.GetRoots(), roots)
+	}
+	return nil
+}
+
+// repairedProof serializes ud to write over a bad proof.  It has to be the
+// same size as the old one.  Proofs from the old proof.dat have a zero TTL
+// for each output, so if there's room for those it puts them in too.
+func repairedProof(proofFiles *splitFile, ud btcacc.UData,
+	outCount uint32) ([]byte, error) {
+
+	var buf bytes.Buffer
+	err := ud.Serialize(&buf)
+	if err != nil {
+		return nil, err
+	}
+	_, size, err := proofFiles.blockSize(ud.Height)
+	if err != nil {
+		return nil, err
+	}
+	if size != uint32(buf.Len())+recordHeaderSize+4*outCount ||
+		outCount == 0 {
+		return buf.Bytes(), nil
+	}
+	ud.TxoTTLs = make([]int32, outCount)
+	buf.Reset()
+	err = ud.Serialize(&buf)
+	return buf.Bytes(), err
+}
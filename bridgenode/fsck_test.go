@@ -0,0 +1,285 @@
+package bridgenode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/util"
+)
+
+// writeTestChain writes n blocks with just a coinbase each to blk00000.dat
+// and rev00000.dat in blockDir, and their offsets to offsetFileName
+func writeTestChain(t *testing.T, blockDir, offsetFileName string,
+	n int) []wire.MsgBlock {
+
+	var blocks []wire.MsgBlock
+	var blk, rev, offsets bytes.Buffer
+	magic := []byte{0x0b, 0x11, 0x09, 0x07}
+	var prev chainhash.Hash
+	for i := 0; i < n; i++ {
+		coinbase := wire.NewMsgTx(1)
+		coinbase.AddTxIn(wire.NewTxIn(
+			wire.NewOutPoint(&chainhash.Hash{}, 0xffffffff),
+			[]byte{byte(i + 1), 0x51}, nil))
+		coinbase.AddTxOut(wire.NewTxOut(50e8, []byte{0x51}))
+		coinbase.AddTxOut(wire.NewTxOut(1e8, []byte{0x52}))
+		var b wire.MsgBlock
+		b.Header.PrevBlock = prev
+		b.AddTransaction(coinbase)
+		prev = b.BlockHash()
+		blocks = append(blocks, b)
+
+		var size [4]byte
+		var entry [12]byte
+		binary.BigEndian.PutUint32(entry[4:8], uint32(blk.Len()))
+		blk.Write(magic)
+		binary.LittleEndian.PutUint32(size[:], uint32(b.SerializeSize()))
+		blk.Write(size[:])
+		err := b.Serialize(&blk)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		rev.Write(magic)
+		binary.LittleEndian.PutUint32(size[:], 1)
+		rev.Write(size[:])
+		binary.BigEndian.PutUint32(entry[8:12], uint32(rev.Len()))
+		rev.WriteByte(0)
+		rev.Write(make([]byte, 32))
+		offsets.Write(entry[:])
+	}
+	for name, b := range map[string][]byte{
+		filepath.Join(blockDir, "blk00000.dat"): blk.Bytes(),
+		filepath.Join(blockDir, "rev00000.dat"): rev.Bytes(),
+		offsetFileName:                          offsets.Bytes(),
+	} {
+		err := ioutil.WriteFile(name, b, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return blocks
+}
+
+// buildTestProofs sets up a bridge node in dir with a forest of type ft,
+// and builds proofs and undo blocks for a chain of n blocks like BuildProofs
+// does.  Proof 4 has a zero TTL for each output like the ones from the old
+// proof.dat.
+func buildTestProofs(t *testing.T, dir string, n int, ft forestType) *Config {
+	cfg := &Config{
+		BlockDir:    dir,
+		UtreeDir:    initUtreeDir(filepath.Join(dir, "utreexo")),
+		forestType:  ft,
+		hasher:      accumulator.DefaultHasher,
+		maxFileSize: 200,
+	}
+	err := makePaths(cfg.UtreeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blocks := writeTestChain(t, dir, cfg.UtreeDir.OffsetDir.OffsetFile, n)
+
+	forest, err := createForest(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	proofFiles, err := openSplitFile(
+		cfg.UtreeDir.ProofDir.pFiles, cfg.maxFileSize, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proofFiles.close()
+	undoFiles, err := openSplitFile(
+		cfg.UtreeDir.UndoDir.undoFiles, cfg.maxFileSize, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer undoFiles.close()
+	var hashes bytes.Buffer
+	hashes.Write(make([]byte, 32))
+	ps := &proofServer{forest: forest}
+	for i := range blocks {
+		bnr := blockAndRev{Height: int32(i + 1),
+			Blk: btcutil.NewBlock(&blocks[i])}
+		bnr.inCount, bnr.outCount, bnr.inSkipList, bnr.outSkipList =
+			util.DedupeBlock(bnr.Blk)
+		ud, ub, err := connectBlock(ps, nil, &bnr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bnr.Height == 4 {
+			ud.TxoTTLs = make([]int32, bnr.outCount)
+		}
+		var proof, undo bytes.Buffer
+		ud.Serialize(&proof)
+		ub.Serialize(&undo)
+		err = proofFiles.writeRecord(bnr.Height, proof.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = undoFiles.writeRecord(bnr.Height, undo.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+		hashes.Write(bnr.Blk.Hash()[:])
+	}
+	err = ioutil.WriteFile(
+		cfg.UtreeDir.UndoDir.blockHashFile, hashes.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = saveBridgeNodeData(forest, int32(n), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg
+}
+
+func TestRepairProofs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fscktest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := buildTestProofs(t, dir, 6, ramForest)
+	proofFiles, err := openSplitFile(
+		cfg.UtreeDir.ProofDir.pFiles, cfg.maxFileSize, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proofFiles.close()
+
+	err = Fsck(cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// mess up proofs 3, 4 and 5
+	expect := make(map[int32][]byte)
+	for _, h := range []int32{3, 4, 5} {
+		expect[h], err = proofFiles.readRecord(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pos, err := proofFiles.pos(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = proofFiles.writeAt([]byte{0xff, 0xff}, pos.add(recordHeaderSize))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = Fsck(cfg, false)
+	if err == nil {
+		t.Fatal("no error checking corrupt proofs")
+	}
+
+	err = Fsck(cfg, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for h, b := range expect {
+		got, err := GetUDataBytesFromFile(cfg.UtreeDir.ProofDir, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, b) {
+			t.Fatalf("proof %d repaired to %x, expect %x", h, got, b)
+		}
+	}
+	err = Fsck(cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A repair that stops partway leaves the saved forest as it was
+func TestRepairProofsFails(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fscktest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := buildTestProofs(t, dir, 6, diskForest)
+	forest, err := restoreForest(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := forest.GetRoots()
+
+	// proof 3 is bad, and the proofs are for a different block 5
+	proofFiles, err := openSplitFile(
+		cfg.UtreeDir.ProofDir.pFiles, cfg.maxFileSize, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos, err := proofFiles.pos(3)
+	if err == nil {
+		err = proofFiles.writeAt(
+			[]byte{0xff, 0xff}, pos.add(recordHeaderSize))
+	}
+	proofFiles.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashFile, err := os.OpenFile(
+		cfg.UtreeDir.UndoDir.blockHashFile, os.O_RDWR, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer hashFile.Close()
+	var hash [32]byte
+	_, err = hashFile.ReadAt(hash[:], 5*32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = hashFile.WriteAt(bytes.Repeat([]byte{0xff}, 32), 5*32)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = Fsck(cfg, true)
+	if err == nil {
+		t.Fatal("repaired proofs for the wrong block")
+	}
+	forest, err = restoreForest(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(forest.GetRoots(), roots) {
+		t.Fatalf("forest roots %x after a failed repair, expect %x",
+			forest.GetRoots(), roots)
+	}
+	height, err := restoreHeight(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if height != 6 {
+		t.Fatalf("forest at height %d after a failed repair, expect 6",
+			height)
+	}
+
+	// with the right block it can be repaired after all
+	_, err = hashFile.WriteAt(hash[:], 5*32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Fsck(cfg, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Fsck(cfg, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -9,8 +9,11 @@ import (
 	"sync"
 	"time"
 
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcutil"
 	"github.com/mit-dci/utreexo/accumulator"
 	"github.com/mit-dci/utreexo/btcacc"
+	"github.com/mit-dci/utreexo/util"
 )
 
 /*
@@ -26,7 +29,8 @@ thread.  This path converts the block & rev data into accumulator adds & dels
 with blockToAddDel(), then calls GenUData() to generate a proof for the
 deletions, which it sends via proofChan to the FlatFileWriter() which writes
 the proof to disk.  Then it calls Modify() on the accumulator, removing the
-deleted hashes and adding new ones.
+deleted hashes and adding new ones, and writes the new roots to the roots
+files.
 
 TTL PATH:
 The block & rev data is first sent to BNRTTLSpliter(), which spawns 2 new
@@ -36,21 +40,22 @@ outputs go to the TxidSortWriterWorker() (barely even outputs; just TXIDs and
 number of outputs)
 
 TxidSortWriterWorker() builds a flat file of per-block sorted, truncated TXIDs.
+With -memttl the file is kept in memory and only written out at the end.
 TTLLookupWorker() looks up inputs in this sorted TXID file, and obtains position
 data for the TTL value of a UTXO.  We already have the TTL data for the UTXO
 from the current block height and the rev data which tells the utxo creation
-height.  We want to write the TTL into the TTL area of the proof block, but
-we need to look up where in the block this UTXO was created, and that's what
-TTLLookupWorker() gets us.  Once we have the full TTL result, we send that
-via ttlResultChan to FlatFileWriter()
+height.  We want to write the TTL into the TTL files at the UTXO's creation
+height, but we need to look up where in the block this UTXO was created, and
+that's what TTLLookupWorker() gets us.  Once we have the full TTL result, we
+send that via ttlResultChan to flatFileWorkerTTL()
 
 FLAT FILE:
-FlatFileWriter() takes in proof data as well as TTL data.  When it gets a
-proof block it appends that to the end of the proof file, allocating a bunch
-of empty space in the beginning for TTL values.
-When it gets a TTL result block, it writes the TTL values to various previous
-blocks, overwriting the allocated empty (zero) data in the TTL region of the
-proof block.
+flatFileWorkerProof() and flatFileWorkerUndo() append each proof and undo
+block to their files, and never change them after that.
+flatFileWorkerTTL() allocates 4 bytes in the TTL files for every output in a
+block, all zero.  When it gets a TTL result block, it writes the TTL values
+over the zeros of the blocks the spent outputs were created in.  The TTLs
+are only put in the proofs when the server sends them out.
 
 */
 
@@ -88,13 +93,92 @@ func BuildProofs(cfg *Config, sig chan bool) error {
 
 	fmt.Printf("Starting forest: %s\n", forest.ToString())
 
+	leaves, err := openBuildLeafIndex(cfg, finishedHeight)
+	if err != nil {
+		return err
+	}
+
+	rootFiles, err := openRootFiles(cfg, finishedHeight)
+	if err != nil {
+		return err
+	}
+
+	// In follow mode, serve while building.  The server shares the forest
+	// and only goes up to the blocks whose proofs have been written.
+	ps := &proofServer{forest: forest}
+	var follower *offsetIndexer
+	var tip *chainTip
+	if cfg.follow {
+		follower, err = openOffsetIndexer(cfg)
+		if err != nil {
+			return err
+		}
+		if !cfg.noServe {
+			ps.leaves = leaves
+			tip = newChainTip(finishedHeight, true)
+			follower.served = tip
+			go blockServer(tip, cfg, ps, make(chan bool), make(chan bool, 1))
+		}
+	}
+
+	fmt.Println("Building Proofs and ttls...")
+	for {
+		var reorg bool
+		finishedHeight, reorg, err = buildBlocks(cfg, ps, leaves, rootFiles,
+			tip, follower, finishedHeight, haltRequest)
+		if err != nil {
+			return err
+		}
+		if !reorg {
+			break
+		}
+		leaves, rootFiles, finishedHeight, err = followReorg(cfg, ps, leaves,
+			rootFiles, tip, follower, finishedHeight)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = rootFiles.close()
+	if err != nil {
+		return err
+	}
+	err = leaves.close()
+	if err != nil {
+		return err
+	}
+
+	// Save the current state so genproofs can be resumed
+	ps.mtx.Lock()
+	err = saveBridgeNodeData(forest, finishedHeight, cfg)
+	ps.mtx.Unlock()
+	if err != nil {
+		panic(err)
+	}
+
+	fmt.Printf("Done writing. Height %d Forest: %s",
+		finishedHeight, forest.ToString())
+
+	// Tell stopBuildProofs that it's ok to exit
+	haltAccept <- true
+	return nil
+}
+
+// buildBlocks runs the pipeline from the block after finishedHeight until
+// the reader stops, and waits for everything to be written.  It returns
+// the last block built, and whether the reader stopped because of a reorg.
+func buildBlocks(cfg *Config, ps *proofServer, leaves *leafIndex,
+	rootFiles *splitFile, tip *chainTip, follower *offsetIndexer,
+	finishedHeight int32, haltRequest chan bool) (int32, bool, error) {
+
 	// BlockAndRevReader will push blocks into here
 	blockAndRevProofChan := make(chan blockAndRev, 10) // blocks for accumulator
 	blockAndRevTTLChan := make(chan blockAndRev, 10)   // same thing, but for TTL
 	ttlResultChan := make(chan ttlResultBlock, 10)     // from lookup to flat ttl writer
 	proofChan := make(chan btcacc.UData, 10)           // to flat writer
-	undoChan := make(chan accumulator.UndoBlock, 10)   // to undoblock writer
+	undoChan := make(chan blockUndo, 10)               // to undoblock writer
 	skipChan := make(chan allocNSkipTTL, 10)           // empty leaves for TTLs
+	reorgChan := make(chan bool, 1)                    // reader saw a reorg
 
 	fileWait := new(sync.WaitGroup)
 
@@ -102,16 +186,23 @@ func BuildProofs(cfg *Config, sig chan bool) error {
 	// Reads util the lastIndexOffsetHeight
 
 	go BlockAndRevReader(
-		blockAndRevProofChan, blockAndRevTTLChan,
-		haltRequest, fileWait, cfg, finishedHeight)
-
-	go flatFileWorkerProof(proofChan, cfg.UtreeDir, fileWait)
-	go flatFileWorkerUndo(undoChan, cfg.UtreeDir, fileWait)
-	go flatFileWorkerTTL(ttlResultChan, skipChan, cfg.UtreeDir, fileWait)
-
-	go BNRTTLSpliter(blockAndRevTTLChan, ttlResultChan, cfg.UtreeDir)
-
-	fmt.Println("Building Proofs and ttls...")
+		blockAndRevProofChan, blockAndRevTTLChan, haltRequest, reorgChan,
+		fileWait, cfg, finishedHeight, follower)
+
+	// the flat file workers tell fileWait when they've closed their files
+	fileWait.Add(3)
+	go flatFileWorkerProof(proofChan, cfg.UtreeDir,
+		cfg.maxFileSize, cfg.prune, fileWait, tip)
+	go flatFileWorkerUndo(undoChan, cfg.UtreeDir,
+		cfg.maxFileSize, cfg.prune, fileWait)
+	go flatFileWorkerTTL(
+		ttlResultChan, skipChan, cfg.UtreeDir, cfg.maxFileSize, fileWait)
+
+	// the TTL workers have to finish writing the txid files too, which
+	// with -memttl is all done at the end
+	fileWait.Add(1)
+	go BNRTTLSpliter(blockAndRevTTLChan, ttlResultChan,
+		cfg.UtreeDir, cfg.memTTL, fileWait)
 
 	for {
 		// fmt.Printf("block on blockAndRevProofChan read?\n")
@@ -129,34 +220,25 @@ func BuildProofs(cfg *Config, sig chan bool) error {
 		// send number of outputs, including skipped, to allocate TTL space
 		skipChan <- allocNSkipTTL{bnr.outCount, bnr.outSkipList}
 
-		// Get the add and remove data needed from the block & undo block
-		// wants the skiplist to omit proofs
-		blockAdds, delLeaves, err := bnr.toAddDel()
+		ud, undoblock, err := connectBlock(ps, leaves, &bnr)
 		if err != nil {
-			return err
+			return finishedHeight, false, err
 		}
 
-		// use the accumulator to get inclusion proofs, and produce a block
-		// proof with all data needed to verify the block
-		ud, err := btcacc.GenUData(delLeaves, forest, bnr.Height)
+		// the roots go in before the proof, so they're there by the time
+		// the server gets to the block
+		err = writeRoots(ps, rootFiles, bnr.Height)
 		if err != nil {
-			return err
+			return finishedHeight, false, err
 		}
-		// We don't know the TTL values, but know how many spots to allocate
-		ud.TxoTTLs = make([]int32, bnr.outCount)
 
 		// fmt.Printf("block on proofchan?\n")
 		// send proof udata to channel to be written to disk
 		proofChan <- ud
 
-		undoblock, err := forest.Modify(blockAdds, ud.AccProof.Targets)
-		if err != nil {
-			return err
-		}
-		undoblock.Height = bnr.Height // set undoBlocks Height
 		// send undoBlock data to undo channel to be written to the disk
 		// fmt.Printf("block on undochan?\n")
-		undoChan <- *undoblock
+		undoChan <- blockUndo{undo: *undoblock, blockHash: *bnr.Blk.Hash()}
 
 		finishedHeight = bnr.Height
 		if finishedHeight%1000 == 0 {
@@ -165,21 +247,171 @@ func BuildProofs(cfg *Config, sig chan bool) error {
 		}
 
 	}
+	close(proofChan)
+	close(undoChan)
+	close(skipChan)
 
 	// Wait for the file workers to finish
 	fileWait.Wait()
 
-	// Save the current state so genproofs can be resumed
-	err = saveBridgeNodeData(forest, finishedHeight, cfg)
+	select {
+	case <-reorgChan:
+		return finishedHeight, true, nil
+	default:
+	}
+	return finishedHeight, false, nil
+}
+
+// connectBlock proves the leaves the block spends, then takes them out of
+// the forest and puts the new ones in.  It holds the proofServer lock so
+// proof queries don't see the forest or leaf index half way through a block.
+func connectBlock(ps *proofServer, leaves *leafIndex, bnr *blockAndRev) (
+	ud btcacc.UData, undoblock *accumulator.UndoBlock, err error) {
+
+	// Get the add and remove data needed from the block & undo block
+	// wants the skiplist to omit proofs
+	blockAdds, addLeaves, delLeaves, err := bnr.toAddDel(ps.forest.Hasher())
 	if err != nil {
-		panic(err)
+		return
 	}
 
-	fmt.Printf("Done writing. Height %d Forest: %s",
-		finishedHeight, forest.ToString())
+	ps.mtx.Lock()
+	defer ps.mtx.Unlock()
 
-	// Tell stopBuildProofs that it's ok to exit
-	haltAccept <- true
+	// use the accumulator to get inclusion proofs, and produce a block
+	// proof with all data needed to verify the block
+	ud, err = btcacc.GenUData(delLeaves, ps.forest, bnr.Height)
+	if err != nil {
+		return
+	}
+	// The TTLs aren't known yet.  They go in the TTL files as the outputs
+	// get spent, and the server puts them in when it sends the proof.
+
+	undoblock, err = ps.forest.Modify(blockAdds, ud.AccProof.Targets)
+	if err != nil {
+		return
+	}
+	undoblock.Height = bnr.Height // set undoBlocks Height
+
+	if leaves != nil {
+		err = leaves.connectBlock(bnr.Height, addLeaves, delLeaves)
+	}
+	return
+}
+
+// openBuildLeafIndex opens the leaf index to be updated from height on.
+// An index that's behind the proofs, like a new one next to proofs from
+// before there was an index, is caught up from the blocks.  One that's
+// ahead, because the bridge node crashed after writing it but before saving
+// the forest, is rolled back.
+func openBuildLeafIndex(cfg *Config, height int32) (*leafIndex, error) {
+	leaves, err := openLeafIndex(cfg.UtreeDir.LeafIndexDir)
+	if err != nil {
+		return nil, err
+	}
+	indexHeight, err := leaves.height()
+	if err == nil && indexHeight > height {
+		err = rollBackLeafIndex(cfg, leaves, indexHeight, height)
+	}
+	if err == nil && indexHeight < height {
+		err = catchUpLeafIndex(cfg, leaves, indexHeight, height)
+	}
+	if err != nil {
+		leaves.close()
+		return nil, err
+	}
+	return leaves, nil
+}
+
+// rollBackLeafIndex takes the blocks after height back out of the leaf
+// index
+func rollBackLeafIndex(cfg *Config, leaves *leafIndex,
+	indexHeight, height int32) error {
+
+	ok, err := leaves.canRollBack(height)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("leaf index at height %d can't roll back to the "+
+			"proofs at %d. Delete %s and it'll be built again from the "+
+			"blocks", indexHeight, height, cfg.UtreeDir.LeafIndexDir)
+	}
+	fmt.Printf("leaf index at height %d, rolling back to %d\n",
+		indexHeight, height)
+	for h := indexHeight; h > height; h-- {
+		err = leaves.disconnectBlock(h)
+		if err != nil {
+			return fmt.Errorf("leaf index h %d %s", h, err.Error())
+		}
+	}
+	return nil
+}
+
+// catchUpLeafIndex puts the blocks after indexHeight up to height in the
+// leaf index.  They're read from bitcoind's files again, and have to be the
+// ones the proofs were built from.
+func catchUpLeafIndex(cfg *Config, leaves *leafIndex,
+	indexHeight, height int32) error {
+
+	fmt.Printf("leaf index at height %d, catching up to %d\n",
+		indexHeight, height)
+	offsetFile, err := os.Open(cfg.UtreeDir.OffsetDir.OffsetFile)
+	if err != nil {
+		return err
+	}
+	defer offsetFile.Close()
+	hashFile, err := os.Open(cfg.UtreeDir.UndoDir.blockHashFile)
+	if err != nil {
+		return err
+	}
+	defer hashFile.Close()
+
+	for h := indexHeight + 1; h <= height; {
+		// only reads as far as the end of the blk file anyway
+		count := height - h + 1
+		if count > 1000 {
+			count = 1000
+		}
+		blocks, revs, err := GetRawBlocksFromDisk(
+			h, count, offsetFile, cfg.BlockDir)
+		if err != nil {
+			return err
+		}
+		if len(blocks) == 0 {
+			return fmt.Errorf("no block %d in %s", h, cfg.BlockDir)
+		}
+		for i := range blocks {
+			bnr := blockAndRev{
+				Height: h,
+				Blk:    btcutil.NewBlock(&blocks[i]),
+				Rev:    revs[i],
+			}
+			var hash chainhash.Hash
+			_, err = hashFile.ReadAt(hash[:], int64(32*h))
+			if err != nil {
+				return err
+			}
+			if *bnr.Blk.Hash() != hash {
+				return fmt.Errorf("block %d is %s but proofs are for %s",
+					h, bnr.Blk.Hash(), hash)
+			}
+			bnr.inCount, bnr.outCount, bnr.inSkipList, bnr.outSkipList =
+				util.DedupeBlock(bnr.Blk)
+			_, addLeaves, delLeaves, err := bnr.toAddDel(cfg.hasher)
+			if err != nil {
+				return fmt.Errorf("h %d %s", h, err.Error())
+			}
+			err = leaves.connectBlock(h, addLeaves, delLeaves)
+			if err != nil {
+				return err
+			}
+			if h%10000 == 0 {
+				fmt.Printf("leaf index at %d of %d\n", h, height)
+			}
+			h++
+		}
+	}
 	return nil
 }
 
@@ -211,19 +443,15 @@ func stopBuildProofs(
 	fmt.Println("User exit signal received. Exiting...")
 
 	select {
-	// If offsetfile is there or was built, don't remove it
+	// If offsetfile is there or was built, tell the main loop to stop
 	case <-offsetfinished:
 		haltRequest <- true
-	// If nothing is received, delete offsetfile and other directories
+	// If nothing is received, the offsetfile is still being built.  It
+	// saves how far it got as it goes, so just exit.
 	// Don't wait for done channel from the main BuildProofs() for loop
 	default:
-		fmt.Println("offsetfile incomplete, removing...")
-		// May not work sometimes.
-		err := os.RemoveAll(cfg.UtreeDir.OffsetDir.base)
-		if err != nil {
-			fmt.Println("ERR. offsetdata/ directory not removed. Please manually remove it.")
-		}
-		fmt.Println("Exiting...")
+		fmt.Println("offsetfile incomplete, will carry on next time. " +
+			"Exiting...")
 		os.Exit(0)
 	}
 
@@ -235,7 +463,12 @@ func stopBuildProofs(
 // go through all the proofs and just try to deserialize them
 func VerifyProofs(cfg *Config) error {
 
-	for h := int32(1); h < cfg.quitAfter; h++ {
+	start := int32(1)
+	if cfg.prune != 0 && cfg.quitAfter-cfg.prune+1 > start {
+		// the older ones are gone
+		start = cfg.quitAfter - cfg.prune + 1
+	}
+	for h := start; h < cfg.quitAfter; h++ {
 		if h%100 == 0 {
 			fmt.Printf("verify h %d\n", h)
 		}
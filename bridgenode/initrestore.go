@@ -16,33 +16,22 @@ func InitBridgeNodeState(
 	cfg *Config, offsetFinished chan bool) (forest *accumulator.Forest,
 	height int32, err error) {
 
-	// Default behavior is that the user should delete all offsetdata
-	// if they have new blk*.dat files to sync
-	// User needs to re-index blk*.dat files when added new files to sync
-
-	// Both the blk*.dat offset and rev*.dat offset is checked at the same time
-	// If either is incomplete or not complete, they're both removed and made
-	// anew
-	// Check if the offsetfiles for both rev*.dat and blk*.dat are present
-	var knownTipHeight int32
-	if util.HasAccess(cfg.UtreeDir.OffsetDir.OffsetFile) {
-		knownTipHeight, err = restoreLastIndexOffsetHeight(
-			cfg.UtreeDir.OffsetDir, offsetFinished)
-		if err != nil {
-			err = fmt.Errorf("restoreLastIndexOffsetHeight error: %s", err.Error())
-			return
-		}
-	} else {
-		fmt.Println("Offsetfile not present or half present. " +
-			"Indexing offset for blocks blk*.dat files...")
-		knownTipHeight, err = createOffsetData(cfg, offsetFinished)
-		if err != nil {
-			err = fmt.Errorf("createOffsetData error: %s", err.Error())
-			return
-		}
-		fmt.Printf("known tip height %d\n", knownTipHeight)
+	// Proofs, undo blocks and ttls used to be in one big file each
+	err = migrateSplitFiles(cfg.UtreeDir, cfg.maxFileSize)
+	if err != nil {
+		return
 	}
 
+	// Index any blk*.dat files, or parts of them, that are new since last
+	// time.  The offset data picks up from where it got to before, so
+	// there's no need to delete it when there are new blocks.
+	knownTipHeight, err := createOffsetData(cfg, offsetFinished)
+	if err != nil {
+		err = fmt.Errorf("createOffsetData error: %s", err.Error())
+		return
+	}
+	fmt.Printf("known tip height %d\n", knownTipHeight)
+
 	if checkForestExists(cfg) {
 		fmt.Println("Has access to forest, resuming")
 		forest, err = restoreForest(cfg)
@@ -56,6 +45,31 @@ func InitBridgeNodeState(
 			return
 		}
 		fmt.Printf("restore height %d\n", height)
+
+		// check that the blocks we've built on are still in the chain
+		var forkHeight int32
+		forkHeight, err = findForkHeight(cfg, height, knownTipHeight)
+		if err != nil {
+			err = fmt.Errorf("findForkHeight error: %s", err.Error())
+			return
+		}
+		if forkHeight < height {
+			fmt.Printf("reorg: rolling back from height %d to %d\n",
+				height, forkHeight)
+			err = rollBack(cfg, forest, height, forkHeight)
+			if err != nil {
+				err = fmt.Errorf("rollBack error: %s", err.Error())
+				return
+			}
+			height = forkHeight
+			// the files are cut back now, so save the forest to match
+			err = syncBridgeNodeData(forest, height, cfg)
+			if err != nil {
+				err = fmt.Errorf("syncBridgeNodeData error: %s",
+					err.Error())
+				return
+			}
+		}
 	} else {
 		fmt.Println("Creating new forest")
 		// TODO Add a path for CowForest here
@@ -74,7 +88,9 @@ func InitBridgeNodeState(
 		err = fmt.Errorf("Quitafter %d after known tip of %d",
 			cfg.quitAfter, knownTipHeight)
 	}
-	if cfg.quitAfter <= height { // quit after too low, already past that
+	// when following it's fine to be at the tip already; we'll wait
+	if cfg.quitAfter <= height && !cfg.follow {
+		// quit after too low, already past that
 		err = fmt.Errorf("Quitafter %d not after saved height of %d",
 			cfg.quitAfter, height)
 	}
@@ -84,10 +100,24 @@ func InitBridgeNodeState(
 
 // saveBridgeNodeData saves the state of the bridgenode so that when the
 // user restarts, they'll be able to resume.
-// Saves height, forest fields, and pOffset
+// Saves height, forest fields, and pOffset.  The forest is closed after.
 func saveBridgeNodeData(
 	forest *accumulator.Forest, height int32, cfg *Config) error {
 
+	return writeBridgeNodeData(forest, height, cfg, false)
+}
+
+// syncBridgeNodeData saves the same state as saveBridgeNodeData but leaves
+// the forest open, for saving in the middle of a run.
+func syncBridgeNodeData(
+	forest *accumulator.Forest, height int32, cfg *Config) error {
+
+	return writeBridgeNodeData(forest, height, cfg, true)
+}
+
+func writeBridgeNodeData(forest *accumulator.Forest, height int32,
+	cfg *Config, keepOpen bool) error {
+
 	switch cfg.forestType {
 	case ramForest:
 		forestFile, err := os.OpenFile(
@@ -96,6 +126,7 @@ func saveBridgeNodeData(
 		if err != nil {
 			return err
 		}
+		defer forestFile.Close()
 		err = forest.WriteForestToDisk(forestFile, true, false)
 		if err != nil {
 			return err
@@ -114,6 +145,7 @@ func saveBridgeNodeData(
 	if err != nil {
 		return err
 	}
+	defer heightFile.Close()
 	err = binary.Write(heightFile, binary.BigEndian, height)
 	if err != nil {
 		return err
@@ -125,31 +157,20 @@ func saveBridgeNodeData(
 	if err != nil {
 		return err
 	}
-	err = forest.WriteMiscData(miscForestFile)
-	if err != nil {
-		return err
+	defer miscForestFile.Close()
+	if keepOpen {
+		return forest.SaveMiscData(miscForestFile)
 	}
-
-	return nil
+	return forest.WriteMiscData(miscForestFile)
 }
 
-// createOffsetData restores the offsetfile needed to index the
+// createOffsetData builds or adds on to the offsetfile needed to index the
 // blocks in the raw blk*.dat and raw rev*.dat files.
 func createOffsetData(
 	cfg *Config, offsetFinished chan bool) (
 	lastIndexOffsetHeight int32, err error) {
 
-	// Set the Block Header hash
-	// buildOffsetFile matches the header hash to organize
-	// for blk*.dat files
-	hash, err := util.GenHashForNet(cfg.params)
-	if err != nil {
-		return 0, err
-	}
-
-	// TODO allow the user to pass a custom offsetfile path and
-	// custom lastOffsetHeight path instead of just ""
-	lastIndexOffsetHeight, err = buildOffsetFile(cfg, *hash, "", "")
+	lastIndexOffsetHeight, err = buildOffsetFile(cfg)
 	if err != nil {
 		return 0, err
 	}
@@ -166,11 +187,9 @@ func createForest(cfg *Config) (
 	switch cfg.forestType {
 	case ramForest:
 		forest = accumulator.NewForest(accumulator.RamForest, nil, "", 0)
-		return
 	case cowForest:
 		forest = accumulator.NewForest(accumulator.CowForest, nil,
 			cfg.UtreeDir.ForestDir.cowForestDir, cfg.cowMaxCache)
-		return
 	default:
 		// Where the forestfile exists
 		forestFile, err := os.OpenFile(
@@ -187,6 +206,7 @@ func createForest(cfg *Config) (
 		}
 	}
 
+	err = forest.SetHasher(cfg.hasher)
 	return
 }
 
@@ -206,7 +226,8 @@ func restoreForest(cfg *Config) (
 		}
 		forest, err = accumulator.RestoreForest(
 			miscForestFile, nil, false, false,
-			cfg.UtreeDir.ForestDir.cowForestDir, cfg.cowMaxCache)
+			cfg.UtreeDir.ForestDir.cowForestDir, cfg.cowMaxCache,
+			cfg.hasher)
 
 	default:
 		var (
@@ -236,7 +257,8 @@ func restoreForest(cfg *Config) (
 		}
 
 		forest, err = accumulator.RestoreForest(
-			miscForestFile, forestFile, inRam, cache, "", 0)
+			miscForestFile, forestFile, inRam, cache, "", 0,
+			cfg.hasher)
 
 	}
 
@@ -267,14 +289,15 @@ func restoreHeight(cfg *Config) (height int32, err error) {
 }
 
 // restoreLastIndexOffsetHeight restores the lastIndexOffsetHeight
-func restoreLastIndexOffsetHeight(offsetDir offsetDir, offsetFinished chan bool) (
+func restoreLastIndexOffsetHeight(offsetDir offsetDir) (
 	lastIndexOffsetHeight int32, err error) {
 
 	f, err := os.OpenFile(
-		offsetDir.lastIndexOffsetHeightFile, os.O_CREATE|os.O_RDWR, 0600)
+		offsetDir.lastIndexOffsetHeightFile, os.O_RDONLY, 0600)
 	if err != nil {
 		return 0, err
 	}
+	defer f.Close()
 
 	// grab the last block height from currentoffsetheight
 	// currentoffsetheight saves the last height from the offsetfile
@@ -282,10 +305,6 @@ func restoreLastIndexOffsetHeight(offsetDir offsetDir, offsetFinished chan bool)
 	if err != nil {
 		return 0, err
 	}
-	// if there is a offset file, we should pass true to offsetFinished
-	// to let stopParse() know that it shouldn't delete offsetfile
-	offsetFinished <- true
-
 	return
 }
 
@@ -0,0 +1,237 @@
+package bridgenode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/mit-dci/utreexo/btcacc"
+	"github.com/syndtr/goleveldb/leveldb"
+)
+
+/*
+The leaf index maps every outpoint in the accumulator to its LeafData, so
+the bridge node can answer questions about utxos without a full node.
+
+It's a leveldb with these keys:
+
+  'o' | 32B txid | 4B index  ->  compact LeafData (no outpoint)
+  'a' | 4B height            ->  the outpoints added in that block
+  'd' | 4B height            ->  the LeafDatas spent in that block
+  'h'                        ->  4B height of the last block in the index
+
+The 'a' and 'd' entries are only kept for the last leafIndexUndoDepth
+blocks.  They let a block be taken back out on a reorg, or when the index
+got ahead of the forest because of a crash, with nothing but the index.
+
+Each block is one leveldb batch along with the height, so the index is
+always at some block boundary.  It can still be at a different one than
+the forest, which is only saved on the way out; see openBuildLeafIndex.
+*/
+
+// leafIndexUndoDepth is how many blocks back the leaf index can be rolled
+// back
+const leafIndexUndoDepth = 1000
+
+var leafIndexHeightKey = []byte{'h'}
+
+// leafIndex is the on-disk outpoint to LeafData index
+type leafIndex struct {
+	db *leveldb.DB
+}
+
+// openLeafIndex opens the leaf index, making it if it's not there
+func openLeafIndex(path string) (*leafIndex, error) {
+	db, err := leveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &leafIndex{db: db}, nil
+}
+
+func (li *leafIndex) close() error {
+	return li.db.Close()
+}
+
+// outPointKey is the key for an outpoint's LeafData
+func outPointKey(hash [32]byte, index uint32) []byte {
+	k := make([]byte, 37)
+	k[0] = 'o'
+	copy(k[1:33], hash[:])
+	binary.BigEndian.PutUint32(k[33:37], index)
+	return k
+}
+
+// addsKey is the key for the outpoints added in a block
+func addsKey(height int32) []byte {
+	k := make([]byte, 5)
+	k[0] = 'a'
+	binary.BigEndian.PutUint32(k[1:5], uint32(height))
+	return k
+}
+
+// delsKey is the key for the LeafDatas spent in a block
+func delsKey(height int32) []byte {
+	k := addsKey(height)
+	k[0] = 'd'
+	return k
+}
+
+// height returns the last block in the index, 0 if it's empty
+func (li *leafIndex) height() (int32, error) {
+	b, err := li.db.Get(leafIndexHeightKey, nil)
+	if err == leveldb.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(b) != 4 {
+		return 0, fmt.Errorf("leaf index height %d bytes, expect 4", len(b))
+	}
+	return int32(binary.BigEndian.Uint32(b)), nil
+}
+
+// connectBlock adds a block's new utxos and drops the ones it spends
+func (li *leafIndex) connectBlock(height int32,
+	adds, dels []btcacc.LeafData) error {
+
+	batch := new(leveldb.Batch)
+	var delBuf bytes.Buffer
+	for _, ld := range dels {
+		batch.Delete(outPointKey(ld.TxHash, ld.Index))
+		err := ld.Serialize(&delBuf)
+		if err != nil {
+			return err
+		}
+	}
+	batch.Put(delsKey(height), delBuf.Bytes())
+
+	var buf bytes.Buffer
+	addOPs := make([]byte, 0, 36*len(adds))
+	for _, ld := range adds {
+		buf.Reset()
+		err := ld.SerializeCompact(&buf)
+		if err != nil {
+			return err
+		}
+		batch.Put(outPointKey(ld.TxHash, ld.Index), buf.Bytes())
+		addOPs = append(addOPs, ld.TxHash[:]...)
+		addOPs = append(addOPs, 0, 0, 0, 0)
+		binary.BigEndian.PutUint32(addOPs[len(addOPs)-4:], ld.Index)
+	}
+	batch.Put(addsKey(height), addOPs)
+	if height > leafIndexUndoDepth {
+		batch.Delete(addsKey(height - leafIndexUndoDepth))
+		batch.Delete(delsKey(height - leafIndexUndoDepth))
+	}
+
+	var hb [4]byte
+	binary.BigEndian.PutUint32(hb[:], uint32(height))
+	batch.Put(leafIndexHeightKey, hb[:])
+	return li.db.Write(batch, nil)
+}
+
+// canRollBack says whether the index still has what it needs to go back
+// to forkHeight
+func (li *leafIndex) canRollBack(forkHeight int32) (bool, error) {
+	height, err := li.height()
+	if err != nil {
+		return false, err
+	}
+	if height <= forkHeight {
+		return true, nil
+	}
+	// disconnectBlock needs both entries for each block.  They're written
+	// and pruned together, so if the oldest block to go has them the rest
+	// do too.
+	ok, err := li.db.Has(addsKey(forkHeight+1), nil)
+	if err != nil || !ok {
+		return false, err
+	}
+	return li.db.Has(delsKey(forkHeight+1), nil)
+}
+
+// disconnectBlock undoes connectBlock for the block at the tip of the
+// index
+func (li *leafIndex) disconnectBlock(height int32) error {
+
+	tip, err := li.height()
+	if err != nil {
+		return err
+	}
+	if tip != height {
+		return fmt.Errorf("leaf index at height %d, can't disconnect %d",
+			tip, height)
+	}
+	addOPs, err := li.db.Get(addsKey(height), nil)
+	if err == leveldb.ErrNotFound {
+		return fmt.Errorf("leaf index doesn't have the adds for height %d",
+			height)
+	}
+	if err != nil {
+		return err
+	}
+	if len(addOPs)%36 != 0 {
+		return fmt.Errorf("height %d adds %d bytes, not a multiple of 36",
+			height, len(addOPs))
+	}
+	delBytes, err := li.db.Get(delsKey(height), nil)
+	if err == leveldb.ErrNotFound {
+		return fmt.Errorf("leaf index doesn't have the spends for height %d",
+			height)
+	}
+	if err != nil {
+		return err
+	}
+
+	batch := new(leveldb.Batch)
+	for i := 0; i < len(addOPs); i += 36 {
+		var hash [32]byte
+		copy(hash[:], addOPs[i:i+32])
+		batch.Delete(outPointKey(
+			hash, binary.BigEndian.Uint32(addOPs[i+32:i+36])))
+	}
+	var buf bytes.Buffer
+	for r := bytes.NewReader(delBytes); r.Len() != 0; {
+		var ld btcacc.LeafData
+		err = ld.Deserialize(r)
+		if err != nil {
+			return fmt.Errorf("height %d spends %s", height, err.Error())
+		}
+		buf.Reset()
+		err = ld.SerializeCompact(&buf)
+		if err != nil {
+			return err
+		}
+		batch.Put(outPointKey(ld.TxHash, ld.Index), buf.Bytes())
+	}
+	batch.Delete(addsKey(height))
+	batch.Delete(delsKey(height))
+
+	var hb [4]byte
+	binary.BigEndian.PutUint32(hb[:], uint32(height-1))
+	batch.Put(leafIndexHeightKey, hb[:])
+	return li.db.Write(batch, nil)
+}
+
+// getLeafData looks up the LeafData of a utxo
+func (li *leafIndex) getLeafData(op wire.OutPoint) (
+	ld btcacc.LeafData, found bool, err error) {
+
+	b, err := li.db.Get(outPointKey(op.Hash, op.Index), nil)
+	if err == leveldb.ErrNotFound {
+		return ld, false, nil
+	}
+	if err != nil {
+		return
+	}
+	err = ld.DeserializeCompact(bytes.NewReader(b))
+	if err != nil {
+		return
+	}
+	ld.TxHash = btcacc.Hash(op.Hash)
+	ld.Index = op.Index
+	return ld, true, nil
+}
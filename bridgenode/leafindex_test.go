@@ -0,0 +1,162 @@
+package bridgenode
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/mit-dci/utreexo/btcacc"
+)
+
+func TestLeafIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "leafindextest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	li, err := openLeafIndex(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer li.close()
+
+	leaf := func(txid byte, index uint32, height int32) btcacc.LeafData {
+		ld := btcacc.LeafData{
+			Index:    index,
+			Height:   height,
+			Amt:      5000,
+			PkScript: []byte{0x00, 0x14, txid},
+		}
+		ld.TxHash[0] = txid
+		return ld
+	}
+	check := func(ld btcacc.LeafData, want bool) {
+		t.Helper()
+		op := wire.OutPoint{Hash: chainhash.Hash(ld.TxHash), Index: ld.Index}
+		got, found, err := li.getLeafData(op)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found != want {
+			t.Fatalf("%s found %v, expect %v", ld.OPString(), found, want)
+		}
+		if found && !reflect.DeepEqual(got, ld) {
+			t.Fatalf("got %s, expect %s", got.ToString(), ld.ToString())
+		}
+	}
+
+	a, b, c := leaf(1, 0, 1), leaf(1, 1, 1), leaf(2, 0, 2)
+	err = li.connectBlock(1, []btcacc.LeafData{a, b}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = li.connectBlock(2, []btcacc.LeafData{c}, []btcacc.LeafData{a})
+	if err != nil {
+		t.Fatal(err)
+	}
+	height, err := li.height()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if height != 2 {
+		t.Fatalf("index at height %d, expect 2", height)
+	}
+	check(a, false)
+	check(b, true)
+	check(c, true)
+
+	ok, err := li.canRollBack(1)
+	if err != nil || !ok {
+		t.Fatalf("can't roll back to 1: %v", err)
+	}
+	err = li.disconnectBlock(1)
+	if err == nil {
+		t.Fatal("disconnected a block that isn't the tip")
+	}
+	err = li.disconnectBlock(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(a, true)
+	check(b, true)
+	check(c, false)
+	height, err = li.height()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if height != 1 {
+		t.Fatalf("index at height %d, expect 1", height)
+	}
+}
+
+func TestOpenBuildLeafIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "leafindextest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := buildTestProofs(t, dir, 6, ramForest)
+	// the same blocks again, to check the index against
+	blocks := writeTestChain(t, dir, cfg.UtreeDir.OffsetDir.OffsetFile, 6)
+
+	expectHeight := func(li *leafIndex, want int32) {
+		t.Helper()
+		height, err := li.height()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if height != want {
+			t.Fatalf("index at height %d, expect %d", height, want)
+		}
+	}
+
+	// the proofs were built without an index, so it's caught up from the
+	// blocks
+	li, err := openBuildLeafIndex(cfg, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectHeight(li, 6)
+	for i := range blocks {
+		op := wire.OutPoint{Hash: blocks[i].Transactions[0].TxHash(), Index: 1}
+		ld, found, err := li.getLeafData(op)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !found || ld.Height != int32(i+1) || ld.Amt != 1e8 {
+			t.Fatalf("block %d coinbase output found %v %s",
+				i+1, found, ld.ToString())
+		}
+	}
+
+	// a block past the proofs, like from a crash before the forest was
+	// saved, gets taken back out
+	extra := btcacc.LeafData{Index: 3, Height: 7, Amt: 1}
+	extra.TxHash[0] = 7
+	err = li.connectBlock(7, []btcacc.LeafData{extra}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = li.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	li, err = openBuildLeafIndex(cfg, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer li.close()
+	expectHeight(li, 6)
+	_, found, err := li.getLeafData(
+		wire.OutPoint{Hash: chainhash.Hash(extra.TxHash), Index: 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if found {
+		t.Fatal("leaf from past the proofs still in the index")
+	}
+}
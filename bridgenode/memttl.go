@@ -0,0 +1,99 @@
+package bridgenode
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// ttlStore is the txid file or txid offset file the TTL workers use.  It's
+// the file on disk, or with -memttl a memFile copy of it.
+type ttlStore interface {
+	io.Writer
+	io.ReaderAt
+	io.Closer
+}
+
+// openTTLStore opens the txid or txid offset file, ready to be added on to.
+// If inRam it's read in to a memFile.  Also gives how many bytes are in it.
+func openTTLStore(name string, inRam bool) (ttlStore, int64, error) {
+	if inRam {
+		mf, err := openMemFile(name)
+		if err != nil {
+			return nil, 0, err
+		}
+		return mf, int64(len(mf.data)), nil
+	}
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, 0, err
+	}
+	// writes go at the end
+	size, err := f.Seek(0, 2)
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, size, nil
+}
+
+// memFile keeps a whole file in ram so the TTL lookups don't have to seek
+// around on disk.  Writes are added on to the end, and only go to the file
+// when it's closed.
+type memFile struct {
+	mtx  sync.RWMutex
+	file *os.File
+	data []byte
+	// how much of data is in the file already
+	onDisk int
+}
+
+// openMemFile reads the file name in to ram
+func openMemFile(name string) (*memFile, error) {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &memFile{file: f, data: data, onDisk: len(data)}, nil
+}
+
+// Write adds b to the end
+func (mf *memFile) Write(b []byte) (int, error) {
+	mf.mtx.Lock()
+	mf.data = append(mf.data, b...)
+	mf.mtx.Unlock()
+	return len(b), nil
+}
+
+// ReadAt reads from off like a file does
+func (mf *memFile) ReadAt(b []byte, off int64) (int, error) {
+	mf.mtx.RLock()
+	defer mf.mtx.RUnlock()
+	if off >= int64(len(mf.data)) {
+		return 0, io.EOF
+	}
+	n := copy(b, mf.data[off:])
+	if n < len(b) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Close writes everything added since it was opened to the file
+func (mf *memFile) Close() error {
+	mf.mtx.Lock()
+	defer mf.mtx.Unlock()
+	_, err := mf.file.WriteAt(mf.data[mf.onDisk:], int64(mf.onDisk))
+	if err != nil {
+		mf.file.Close()
+		return err
+	}
+	mf.onDisk = len(mf.data)
+	return mf.file.Close()
+}
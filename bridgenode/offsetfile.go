@@ -2,277 +2,620 @@ package bridgenode
 
 import (
 	"bufio"
+	"bytes"
 	"crypto/sha256"
 	"encoding/binary"
-	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
 	"os"
 	"path/filepath"
 
+	"github.com/btcsuite/btcd/blockchain"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/mit-dci/utreexo/util"
+	"github.com/syndtr/goleveldb/leveldb"
 )
 
-// buildOffsetFile builds an offsetFile which acts as an index
-// for block locations since blk*.dat files generated by Bitcoin Core
-// has blocks out of order.
-//
-// If you have more blk*.dat files to generate an index for, just
-// delete the current offsetfile directory and run genproofs again.
-// Fairly quick process with one blk*.dat file taking a few seconds.
+/*
+The offset file is an index of where each block is, since blk*.dat files
+generated by Bitcoin Core have blocks out of order.  It's 12 bytes per
+block: 4 bytes blk file number, 4 bytes offset in that file, 4 bytes offset
+of the undo data in the rev file with the same number.
+
+Which block goes at each height comes from bitcoind's block index.  Each
+block's entry there has its height, status, prev hash and difficulty, and
+where its block and undo data are.  The blk files are only read to find
+blocks that are new since last time.  Then, like bitcoind, the tip is the
+block with the most work on top of where it leaves our chain, and if that's
+more than our chain has past that point, the offset file is cut back to the
+fork and filled in up to the new tip.  On a tie the blocks already in the
+offset file stay, the same as bitcoind keeps the branch it saw first.
+Blocks bitcoind hasn't connected yet (no undo data) get looked at again
+next time.  So do blocks that aren't in the block index at all yet:
+bitcoind only writes the index to disk about once an hour, so when
+following, new blocks can take that long to show up.
+
+How far it's gotten is saved in the offset state file:
+
+  4B height | 32B tip hash | 4B blk file number | 4B offset in that file |
+  4B count | 32B hashes of blocks that aren't connected yet
+
+So next time only the blk files past that point get read.  The state is
+saved after each blk file.  If we stop in the middle of one, the offset file
+gets cut back to the saved height on the next start.
+*/
+
+// offsetIndexer adds blocks to the offset file as it finds them in the blk
+// files
+type offsetIndexer struct {
+	cfg        *Config
+	offsetFile *os.File
+
+	// tip and height are the last block in the offset file
+	tip    util.Hash
+	height int32
+
+	// pending are blocks we've read that bitcoind hasn't connected yet
+	pending [][32]byte
+
+	// fileNum and fileOffset are how far we've read into the blk files
+	fileNum    uint32
+	fileOffset uint32
+
+	// served is the server's tip when following, so it can be cut back
+	// before blocks it could send leave the offset file
+	served *chainTip
+}
+
+// buildOffsetFile builds the offset file, or adds on to it if it's already
+// there, with any new blocks in the blk files.
 //
 // Returns the last block height that it processed.
-func buildOffsetFile(cfg *Config, tip util.Hash,
-	cOffsetFile, cLastOffsetHeightFile string) (int32, error) {
-
-	// Map to store Block Header Hashes for sorting purposes
-	// blk*.dat files aren't in block order so this is needed
-	nextMap := make(map[[32]byte]RawHeaderData)
+func buildOffsetFile(cfg *Config) (int32, error) {
+	ix, err := openOffsetIndexer(cfg)
+	if err != nil {
+		return 0, err
+	}
+	defer ix.close()
+	return ix.update()
+}
 
-	var offsetFile *os.File
+// openOffsetIndexer picks up from the offset state file.  If there isn't
+// one but there's an offset file from before there was a state file, it
+// starts from the last block in that.  Otherwise it starts from genesis.
+func openOffsetIndexer(cfg *Config) (*offsetIndexer, error) {
+	ix := &offsetIndexer{cfg: cfg}
+	var err error
+	ix.offsetFile, err = os.OpenFile(
+		cfg.UtreeDir.OffsetDir.OffsetFile, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
 
-	// If empty string is given, just use the default path
-	// If not, then use the custom one given
-	if cOffsetFile == "" {
-		var err error
-		offsetFile, err = os.OpenFile(
-			cfg.UtreeDir.OffsetDir.OffsetFile, os.O_CREATE|os.O_WRONLY, 0600)
-		if err != nil {
-			panic(err)
-		}
-	} else {
-		var err error
-		offsetFile, err = os.OpenFile(cOffsetFile,
-			os.O_CREATE|os.O_WRONLY, 0600)
-		if err != nil {
-			panic(err)
+	switch {
+	case util.HasAccess(cfg.UtreeDir.OffsetDir.stateFile):
+		err = ix.loadState()
+	case util.HasAccess(cfg.UtreeDir.OffsetDir.lastIndexOffsetHeightFile):
+		err = ix.fromOffsetFile()
+	default:
+		var genesis *util.Hash
+		genesis, err = util.GenHashForNet(cfg.params)
+		if err == nil {
+			ix.tip = *genesis
 		}
 	}
+	if err != nil {
+		ix.offsetFile.Close()
+		return nil, err
+	}
 
-	lvdb, err := OpenIndexFile(cfg.BlockDir)
+	// anything past height is from a run that got stopped part way
+	err = ix.offsetFile.Truncate(int64(12 * ix.height))
 	if err != nil {
-		return 0, err
+		ix.offsetFile.Close()
+		return nil, err
+	}
+	_, err = ix.offsetFile.Seek(int64(12*ix.height), 0)
+	if err != nil {
+		ix.offsetFile.Close()
+		return nil, err
 	}
+	return ix, nil
+}
 
-	bufDB := BufferDB(lvdb)
-	lvdb.Close()
+// fromOffsetFile starts from the last block in an offset file made without
+// a state file.  It reads the blk file with that block from right after
+// it.  Blocks written before it in the file are already in the offset file
+// or are found through the block index from the blocks after them.
+func (ix *offsetIndexer) fromOffsetFile() error {
+	var err error
+	ix.height, err = restoreLastIndexOffsetHeight(ix.cfg.UtreeDir.OffsetDir)
+	if err != nil {
+		return err
+	}
+	if ix.height < 1 {
+		return fmt.Errorf("offset file says height %d", ix.height)
+	}
+	ix.tip, err = blockHashAtHeight(ix.cfg, ix.height)
+	if err != nil {
+		return err
+	}
+	var entry [8]byte
+	_, err = ix.offsetFile.ReadAt(entry[:], int64(12*(ix.height-1)))
+	if err != nil {
+		return err
+	}
+	ix.fileNum = binary.BigEndian.Uint32(entry[0:4])
+	offset := binary.BigEndian.Uint32(entry[4:8])
 
-	var lastOffsetHeight int32
+	// the block's magic bytes and size are at offset
+	f, err := openBlockFile(
+		ix.cfg.BlockDir, fmt.Sprintf("blk%05d.dat", ix.fileNum))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var record [8]byte
+	_, err = f.ReadAt(record[:], int64(offset))
+	if err != nil {
+		return err
+	}
+	ix.fileOffset = offset + 8 + binary.LittleEndian.Uint32(record[4:8])
+	return nil
+}
 
-	// Allocate buffered reader for readRawHeadersFromFile
-	// Less overhead to pre allocate and reuse
-	bufReader := bufio.NewReaderSize(nil, (1<<20)*128) // 128M
-	wr := bufio.NewWriter(nil)
+func (ix *offsetIndexer) close() error {
+	return ix.offsetFile.Close()
+}
 
-	defer offsetFile.Close()
-	for fileNum := 0; ; fileNum++ {
-		fileName := fmt.Sprintf("blk%05d.dat", fileNum)
-		filePath := filepath.Join(cfg.BlockDir, fileName)
-		fmt.Printf("Building offsetfile... %s\n", fileName)
+// update reads any new blocks from the blk files and moves the offset file
+// to the best chain they're on.  It returns the new tip height.
+func (ix *offsetIndexer) update() (int32, error) {
+	lvdb, err := OpenIndexFile(ix.cfg.BlockDir)
+	if err != nil {
+		return ix.height, err
+	}
+	defer lvdb.Close()
 
-		_, err := os.Stat(filePath)
-		if os.IsNotExist(err) {
-			fmt.Printf("%s doesn't exist; done building\n", filePath)
+	for {
+		fileName := filepath.Join(
+			ix.cfg.BlockDir, fmt.Sprintf("blk%05d.dat", ix.fileNum))
+		if !util.HasAccess(fileName) {
 			break
 		}
-		// grab headers from the .dat file as RawHeaderData type
-		rawheaders, err :=
-			readRawHeadersFromFile(bufReader, filePath, uint32(fileNum), bufDB)
+		if ix.fileOffset == 0 {
+			fmt.Printf("Building offsetfile... %s\n", fileName)
+		}
+		headers, end, err := readNewHeaders(
+			ix.cfg.BlockDir, ix.fileNum, ix.fileOffset)
 		if err != nil {
-			panic(err)
+			return ix.height, err
 		}
-		tip, lastOffsetHeight, err = writeBlockOffset(
-			rawheaders, nextMap, wr, offsetFile, lastOffsetHeight, tip)
+		hashes := make([][32]byte, 0, len(ix.pending)+len(headers))
+		hashes = append(hashes, ix.pending...)
+		for _, h := range headers {
+			hashes = append(hashes, h.CurrentHeaderHash)
+		}
+		err = ix.extend(lvdb, hashes)
 		if err != nil {
-			panic(err)
+			// these blocks get read again next time
+			return ix.height, err
 		}
-	}
+		ix.fileOffset = end
 
-	// If empty string is given, just use the default path
-	// If not, then use the custom one given
-	if cLastOffsetHeightFile == "" {
-		var err error
-		// write the last height of the offsetfile
-		// needed info for the main genproofs processes
-		LastIndexOffsetHeightFile, err := os.OpenFile(
-			cfg.UtreeDir.OffsetDir.lastIndexOffsetHeightFile, os.O_CREATE|os.O_WRONLY, 0600)
+		// bitcoind only writes to the last blk file, so move on if
+		// there's a newer one
+		nextName := filepath.Join(
+			ix.cfg.BlockDir, fmt.Sprintf("blk%05d.dat", ix.fileNum+1))
+		if !util.HasAccess(nextName) {
+			break
+		}
+		ix.fileNum++
+		ix.fileOffset = 0
+		err = ix.saveState()
 		if err != nil {
-			panic(err)
+			return ix.height, err
+		}
+	}
+	err = ix.saveState()
+	if err != nil {
+		return ix.height, err
+	}
+	return ix.height, nil
+}
+
+// extend looks the blocks up in the block index, and moves the tip to the
+// one that has the most work past where it leaves our chain, if that's
+// more than our chain has past there.  The ones bitcoind hasn't connected
+// yet go in pending.
+func (ix *offsetIndexer) extend(lvdb *leveldb.DB, hashes [][32]byte) error {
+	cs := &chainSearch{
+		ix:       ix,
+		lvdb:     lvdb,
+		entries:  make(map[[32]byte]CBlockFileIndex),
+		branches: make(map[[32]byte]*branch),
+		ourWork:  make(map[int32]*big.Int),
+	}
+	ix.pending = nil
+	var bestTip [32]byte
+	bestScore := big.NewInt(0)
+	for _, hash := range hashes {
+		entry, err := cs.entry(hash)
+		if err == leveldb.ErrNotFound {
+			// written but not in the index yet
+			ix.pending = append(ix.pending, hash)
+			continue
 		}
-		defer LastIndexOffsetHeightFile.Close()
-		// write to the file
-		err = binary.Write(
-			LastIndexOffsetHeightFile, binary.BigEndian, lastOffsetHeight)
 		if err != nil {
-			panic(err)
+			return err
 		}
-	} else {
-		var err error
-		// write the last height of the offsetfile
-		// needed info for the main genproofs processes
-		LastIndexOffsetHeightFile, err := os.OpenFile(
-			cLastOffsetHeightFile, os.O_CREATE|os.O_WRONLY, 0600)
+		if entry.Status&BlockFailedMask != 0 {
+			continue
+		}
+		if entry.Status&BlockHaveUndo == 0 {
+			// stale blocks never get connected; give up on them once
+			// they're too far back to reorg to
+			if entry.Height+minPrune > ix.height {
+				ix.pending = append(ix.pending, hash)
+			}
+			continue
+		}
+		b, err := cs.branch(hash)
 		if err != nil {
-			panic(err)
+			return err
 		}
-		defer LastIndexOffsetHeightFile.Close()
-		// write to the file
-		err = binary.Write(
-			LastIndexOffsetHeightFile, binary.BigEndian, lastOffsetHeight)
+		if b == nil {
+			continue
+		}
+		ours, err := cs.workAbove(b.forkHeight)
 		if err != nil {
-			panic(err)
+			return err
+		}
+		score := new(big.Int).Sub(b.work, ours)
+		if score.Cmp(bestScore) > 0 {
+			bestTip, bestScore = hash, score
 		}
 	}
-
-	return lastOffsetHeight, nil
+	if bestScore.Sign() == 0 {
+		return nil
+	}
+	return ix.repoint(cs, bestTip)
 }
 
-// readRawHeadersFromFile reads only the headers from the given .dat file
-func readRawHeadersFromFile(
-	bufReader *bufio.Reader, fileDir string,
-	fileNum uint32, bufMap map[[32]byte]uint32) ([]RawHeaderData, error) {
-	var blockHeaders []RawHeaderData
+// repoint cuts the offset file back to where the branch up to tip leaves
+// our chain, then writes the blocks on the branch after it
+func (ix *offsetIndexer) repoint(cs *chainSearch, tip [32]byte) error {
+	forkHeight := cs.branches[tip].forkHeight
+	tipEntry := cs.entries[tip]
+	path := make([]CBlockFileIndex, tipEntry.Height-forkHeight)
+	hash := tip
+	for i := len(path) - 1; i >= 0; i-- {
+		path[i] = cs.entries[hash]
+		hash = path[i].PrevHash
+	}
+	if forkHeight < ix.height {
+		fmt.Printf("reorg: blocks %d to %d left the chain, new tip %x "+
+			"at height %d\n", forkHeight+1, ix.height, tip, tipEntry.Height)
+		// the proofs past the fork are for the old blocks
+		if ix.served != nil {
+			ix.served.cut(forkHeight)
+		}
+	}
 
-	f, err := os.Open(fileDir)
+	err := ix.offsetFile.Truncate(int64(12 * forkHeight))
 	if err != nil {
-		panic(err)
+		return err
 	}
-	defer f.Close()
+	_, err = ix.offsetFile.Seek(int64(12*forkHeight), 0)
+	if err != nil {
+		return err
+	}
+	wr := bufio.NewWriter(ix.offsetFile)
+	var buf [12]byte
+	for _, entry := range path {
+		// the index points at the block, after the magic bytes and size
+		binary.BigEndian.PutUint32(buf[0:4], uint32(entry.File))
+		binary.BigEndian.PutUint32(buf[4:8], entry.DataPos-8)
+		binary.BigEndian.PutUint32(buf[8:12], entry.UndoPos)
+		wr.Write(buf[:])
+	}
+	err = wr.Flush()
+	if err != nil {
+		return err
+	}
+	ix.tip = tip
+	ix.height = tipEntry.Height
+	return nil
+}
 
-	fStat, err := f.Stat()
+// hashAt gives the hash of the block at height in the offset file
+func (ix *offsetIndexer) hashAt(height int32) ([32]byte, error) {
+	if height == ix.height {
+		return ix.tip, nil
+	}
+	if height == 0 {
+		genesis, err := util.GenHashForNet(ix.cfg.params)
+		if err != nil {
+			return [32]byte{}, err
+		}
+		return *genesis, nil
+	}
+	var entry [8]byte
+	_, err := ix.offsetFile.ReadAt(entry[:], int64(12*(height-1)))
 	if err != nil {
-		panic(err)
+		return [32]byte{}, err
 	}
-	fSize := fStat.Size()
+	f, err := openBlockFile(ix.cfg.BlockDir, fmt.Sprintf("blk%05d.dat",
+		binary.BigEndian.Uint32(entry[0:4])))
+	if err != nil {
+		return [32]byte{}, err
+	}
+	defer f.Close()
+	var header [80]byte
+	_, err = f.ReadAt(
+		header[:], int64(binary.BigEndian.Uint32(entry[4:8]))+8)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return chainhash.DoubleHashH(header[:]), nil
+}
 
-	bufReader.Reset(f)
+// chainSearch works out how blocks connect to the chain in the offset file,
+// going back through their prev hashes in the block index
+type chainSearch struct {
+	ix   *offsetIndexer
+	lvdb *leveldb.DB
+
+	// entries are the block index entries we've read
+	entries map[[32]byte]CBlockFileIndex
+	// branches are the blocks we've been through.  nil means the block
+	// doesn't connect to our chain through connected blocks.
+	branches map[[32]byte]*branch
+	// ourWork is the work of our chain past each height we've looked at
+	ourWork map[int32]*big.Int
+}
 
-	var buf [88]byte    // buffer for magicbytes, size, and 80 byte header
-	offset := uint32(0) // where the block is located from the beginning of the file
+// branch is how a block connects to our chain: the height of the last
+// block in common, and the work of the blocks after that up to this one
+type branch struct {
+	forkHeight int32
+	work       *big.Int
+}
 
-	// until offset is at the end of the file
-	for int64(offset) != fSize {
-		b := new(RawHeaderData)
-		binary.BigEndian.PutUint32(b.FileNum[:], fileNum)
-		binary.BigEndian.PutUint32(b.Offset[:], offset)
+// entry reads a block's entry in the block index
+func (cs *chainSearch) entry(hash [32]byte) (CBlockFileIndex, error) {
+	entry, ok := cs.entries[hash]
+	if ok {
+		return entry, nil
+	}
+	value, err := cs.lvdb.Get(append([]byte{0x62}, hash[:]...), nil)
+	if err != nil {
+		return entry, err
+	}
+	entry = ReadCBlockFileIndex(bytes.NewReader(value))
+	cs.entries[hash] = entry
+	return entry, nil
+}
 
-		_, err := bufReader.Read(buf[:])
+// branch goes back from the block until it gets to our chain, or to a
+// block it's been to before
+func (cs *chainSearch) branch(hash [32]byte) (*branch, error) {
+	var path [][32]byte
+	var base *branch
+	for {
+		b, ok := cs.branches[hash]
+		if ok {
+			base = b
+			break
+		}
+		entry, err := cs.entry(hash)
+		if err == leveldb.ErrNotFound {
+			break
+		}
 		if err != nil {
-			panic(err)
+			return nil, err
 		}
-		// check if Bitcoin magic bytes were read
-		if !util.CheckMagicByte(buf[:4]) {
+		if entry.Height < 1 || entry.Status&BlockHaveUndo == 0 {
 			break
 		}
-
-		// read the 4 byte size of the load of the block
-		size := binary.LittleEndian.Uint32(buf[4:8])
-
-		// add 8bytes for the magic bytes (4bytes) and size (4bytes)
-		offset = offset + size + uint32(8)
-
-		copy(b.Prevhash[:], buf[12:12+32])
-
-		// create block hash
-		// double sha256 needed with Bitcoin
-		first := sha256.Sum256(buf[8 : 8+80])
-		b.CurrentHeaderHash = sha256.Sum256(first[:])
-
-		// offset for the next block from the current position
-		bufReader.Discard(int(size) - 80)
-
-		// grab bitcoin core block index info
-		var ok bool
-		b.UndoPos, ok = bufMap[b.CurrentHeaderHash]
-		if !ok {
-			fmt.Printf(
-				"WARNING: block in blk file with header: %x\nexists without"+
-					" a corresponding rev block. May be wasting disk space\n",
-				b.CurrentHeaderHash)
-			// skip block headers that don't have undo data
-			continue
+		path = append(path, hash)
+		hash = entry.PrevHash
+		if entry.Height-1 <= cs.ix.height {
+			ours, err := cs.ix.hashAt(entry.Height - 1)
+			if err != nil {
+				return nil, err
+			}
+			if ours == hash {
+				base = &branch{
+					forkHeight: entry.Height - 1, work: big.NewInt(0)}
+				break
+			}
 		}
-
-		blockHeaders = append(blockHeaders, *b)
 	}
 
-	return blockHeaders, nil
+	// fill in the blocks on the way, from the fork up
+	for i := len(path) - 1; i >= 0; i-- {
+		if base != nil {
+			work := blockchain.CalcWork(cs.entries[path[i]].Bits)
+			base = &branch{forkHeight: base.forkHeight,
+				work: work.Add(work, base.work)}
+		}
+		cs.branches[path[i]] = base
+	}
+	return base, nil
 }
 
-// Sorts and writes the block offset from the passed in blockHeaders.
-func writeBlockOffset(
-	blockHeaders []RawHeaderData, // All headers from the select .dat file
-	nextMap map[[32]byte]RawHeaderData, // Map to save the current block hash
-	wr *bufio.Writer, // buffered writer
-	offsetFile *os.File, // File to save the sorted blocks and locations to
-	tipnum int32, // Current block it's on
-	tip util.Hash) ( // Current hash of the block it's on
-	util.Hash, int32, error) {
-
-	wr.Reset(offsetFile)
-
-	if len(blockHeaders) == 0 {
-		return tip, tipnum, errBuildProofs(errors.New("no block headers found"))
+// workAbove is the work of the blocks in our chain after height
+func (cs *chainSearch) workAbove(height int32) (*big.Int, error) {
+	work, ok := cs.ourWork[height]
+	if ok {
+		return work, nil
 	}
-
-	for _, b := range blockHeaders {
-		if len(nextMap) > 10000 { //Just a random big number
-			fmt.Println("Dead end tip. Exiting...")
-			break
+	work = big.NewInt(0)
+	for h := cs.ix.height; h > height; h-- {
+		hash, err := cs.ix.hashAt(h)
+		if err != nil {
+			return nil, err
 		}
-
-		// The block's Prevhash doesn't match the
-		// previous block header. Add to map.
-		// Searches until it finds a hash that does.
-		if b.Prevhash != tip {
-			nextMap[b.Prevhash] = b
-			continue
+		entry, err := cs.entry(hash)
+		if err != nil {
+			return nil, fmt.Errorf("block %x at height %d: %s",
+				hash, h, err.Error())
 		}
+		work.Add(work, blockchain.CalcWork(entry.Bits))
+	}
+	cs.ourWork[height] = work
+	return work, nil
+}
 
-		// Write the .dat file name and the
-		// offset the block can be found at
-		wr.Write(b.FileNum[:])
-		wr.Write(b.Offset[:])
+// saveState writes the offset state file, and the last height file.  The
+// state file is written to a temp file and renamed so it's never half
+// written.
+func (ix *offsetIndexer) saveState() error {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, ix.height)
+	buf.Write(ix.tip[:])
+	binary.Write(&buf, binary.BigEndian, ix.fileNum)
+	binary.Write(&buf, binary.BigEndian, ix.fileOffset)
+	binary.Write(&buf, binary.BigEndian, uint32(len(ix.pending)))
+	for _, hash := range ix.pending {
+		buf.Write(hash[:])
+	}
 
-		undoOffset := make([]byte, 4)
-		binary.BigEndian.PutUint32(undoOffset, b.UndoPos)
+	tmpName := ix.cfg.UtreeDir.OffsetDir.stateFile + ".tmp"
+	err := ioutil.WriteFile(tmpName, buf.Bytes(), 0600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmpName, ix.cfg.UtreeDir.OffsetDir.stateFile)
+	if err != nil {
+		return err
+	}
 
-		// write undoblock offset
-		wr.Write(undoOffset)
+	// write the last height of the offsetfile
+	// needed info for the main genproofs processes
+	heightFile, err := os.OpenFile(
+		ix.cfg.UtreeDir.OffsetDir.lastIndexOffsetHeightFile,
+		os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer heightFile.Close()
+	return binary.Write(heightFile, binary.BigEndian, ix.height)
+}
 
-		// set the tip to current block's hash
-		tip = b.CurrentHeaderHash
-		tipnum++
+// loadState reads the offset state file
+func (ix *offsetIndexer) loadState() error {
+	b, err := ioutil.ReadFile(ix.cfg.UtreeDir.OffsetDir.stateFile)
+	if err != nil {
+		return err
+	}
+	r := bytes.NewReader(b)
+	err = binary.Read(r, binary.BigEndian, &ix.height)
+	if err != nil {
+		return err
+	}
+	_, err = io.ReadFull(r, ix.tip[:])
+	if err != nil {
+		return err
+	}
+	err = binary.Read(r, binary.BigEndian, &ix.fileNum)
+	if err != nil {
+		return err
+	}
+	err = binary.Read(r, binary.BigEndian, &ix.fileOffset)
+	if err != nil {
+		return err
+	}
 
-		// check for next blocks in map
-		// same thing but with the stored blocks
-		// that we skipped over
-		stashedBlock, ok := nextMap[tip]
-		for ok {
-			// Write the .dat file name and the
-			// offset the block can be found at
-			wr.Write(stashedBlock.FileNum[:])
-			wr.Write(stashedBlock.Offset[:])
+	var count uint32
+	err = binary.Read(r, binary.BigEndian, &count)
+	if err != nil {
+		return err
+	}
+	if uint64(r.Len()) != 32*uint64(count) {
+		return fmt.Errorf("offset state file has %d bytes for %d pending "+
+			"blocks. Delete %s to pick up from the offset file",
+			r.Len(), count, ix.cfg.UtreeDir.OffsetDir.stateFile)
+	}
+	ix.pending = make([][32]byte, count)
+	for i := range ix.pending {
+		r.Read(ix.pending[i][:])
+	}
 
-			// grab bitcoin core block index info
-			//sCbIndex := GetBlockIndexInfo(stashedBlock.CurrentHeaderHash, lvdb)
+	// the offset file needs to go up to height
+	size, err := ix.offsetFile.Seek(0, 2)
+	if err != nil {
+		return err
+	}
+	if size < int64(12*ix.height) {
+		return fmt.Errorf("offset state at height %d but offset file "+
+			"only has %d blocks. Delete %s to start over", ix.height,
+			size/12, ix.cfg.UtreeDir.OffsetDir.base)
+	}
+	return nil
+}
 
-			sUndoOffset := make([]byte, 4)
-			binary.BigEndian.PutUint32(sUndoOffset, stashedBlock.UndoPos)
+// readNewHeaders reads the headers of the whole blocks in blk file fileNum
+// from start on.  It returns them and where it stopped.  Anything after the
+// last whole block, like the zeros bitcoind preallocates or a block it's
+// still writing, is left for next time.
+func readNewHeaders(blockDir string, fileNum, start uint32) (
+	headers []RawHeaderData, end uint32, err error) {
 
-			// write undoblock offset
-			wr.Write(sUndoOffset)
+	end = start
+	f, err := openBlockFile(blockDir, fmt.Sprintf("blk%05d.dat", fileNum))
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fStat, err := f.Stat()
+	if err != nil {
+		return
+	}
+	fSize := fStat.Size()
 
-			// set the tip to current block's hash
-			tip = stashedBlock.CurrentHeaderHash
-			tipnum++
+	// read the headers through a buffer; most of each block gets skipped
+	_, err = f.Seek(int64(start), 0)
+	if err != nil {
+		return
+	}
+	bufReader := bufio.NewReaderSize(f, 1<<20)
+
+	// magic bytes, size, and 80 byte header
+	var buf [88]byte
+	for {
+		_, err = io.ReadFull(bufReader, buf[:])
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return headers, end, nil
+		}
+		if err != nil {
+			return
+		}
+		// zeros are space bitcoind has allocated but not written yet
+		if bytes.Equal(buf[:4], []byte{0, 0, 0, 0}) ||
+			!util.CheckMagicByte(buf[:4]) {
+			return
+		}
+		size := binary.LittleEndian.Uint32(buf[4:8])
+		if size < 80 || int64(end)+8+int64(size) > fSize {
+			return
+		}
 
-			// remove the written current block
-			delete(nextMap, stashedBlock.Prevhash)
+		var h RawHeaderData
+		binary.BigEndian.PutUint32(h.FileNum[:], fileNum)
+		binary.BigEndian.PutUint32(h.Offset[:], end)
+		copy(h.Prevhash[:], buf[12:12+32])
+		first := sha256.Sum256(buf[8 : 8+80])
+		h.CurrentHeaderHash = sha256.Sum256(first[:])
+		headers = append(headers, h)
 
-			// move to the next block
-			stashedBlock, ok = nextMap[tip]
+		_, err = bufReader.Discard(int(size) - 80)
+		if err != nil {
+			return
 		}
+		end += 8 + size
 	}
-	wr.Flush()
-	return tip, tipnum, nil
 }
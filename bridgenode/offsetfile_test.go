@@ -1,10 +1,21 @@
 package bridgenode
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
 
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/mit-dci/utreexo/compress"
+	"github.com/mit-dci/utreexo/util"
 	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
 )
 
 // GetBlockIndexInfo returns a CBlockFileIndex based on the hash given as a key
@@ -30,3 +41,349 @@ func GetBlockIndexInfo(h [32]byte, lvdb *leveldb.DB) CBlockFileIndex {
 
 	return cbIdx
 }
+
+func TestReadNewHeaders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "followtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a block in a blk file: magic, size, header, then the rest of the
+	// block which is just filler here
+	record := func(prev byte, size uint32) []byte {
+		b := []byte{0x0b, 0x11, 0x09, 0x07}
+		b = append(b, 0, 0, 0, 0)
+		binary.LittleEndian.PutUint32(b[4:8], size)
+		header := make([]byte, size)
+		header[4] = prev
+		return append(b, header...)
+	}
+	var blk bytes.Buffer
+	blk.Write(record(1, 100))
+	blk.Write(record(2, 200))
+	firstTwo := uint32(blk.Len())
+	// a block that's only part written
+	blk.Write(record(3, 300)[:150])
+	fileName := filepath.Join(dir, "blk00000.dat")
+	err = ioutil.WriteFile(fileName, blk.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	headers, end, err := readNewHeaders(dir, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(headers) != 2 || end != firstTwo {
+		t.Fatalf("read %d headers to %d, expect 2 to %d",
+			len(headers), end, firstTwo)
+	}
+	if headers[1].Prevhash[0] != 2 ||
+		binary.BigEndian.Uint32(headers[1].Offset[:]) != 108 {
+		t.Fatalf("second header prev %x offset %x",
+			headers[1].Prevhash, headers[1].Offset)
+	}
+
+	// finish the last block and put zeros after it, like bitcoind does
+	blk.Truncate(int(firstTwo))
+	blk.Write(record(3, 300))
+	blk.Write(make([]byte, 1000))
+	err = ioutil.WriteFile(fileName, blk.Bytes(), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers, end, err = readNewHeaders(dir, 0, end)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(headers) != 1 || end != firstTwo+308 {
+		t.Fatalf("read %d headers to %d, expect 1 to %d",
+			len(headers), end, firstTwo+308)
+	}
+	if headers[0].Prevhash[0] != 3 {
+		t.Fatalf("read header with prev %x", headers[0].Prevhash)
+	}
+}
+
+// fakeChain is a chain of made up blocks in blk files, with a block index
+// like bitcoind's
+type fakeChain struct {
+	t        *testing.T
+	blockDir string
+	headers  [][80]byte
+	hashes   [][32]byte
+	heights  []int32
+	// where each block was written: blk file number and offset
+	files   []uint32
+	offsets []uint32
+}
+
+// fakeBits is the difficulty of the fake blocks, regtest's
+const fakeBits = 0x207fffff
+
+// addBlock makes the next block on top of block prev, or on genesis if
+// prev is -1.  It isn't written anywhere yet.
+func (fc *fakeChain) addBlock(prev int) int {
+	var header [80]byte
+	var height int32 = 1
+	if prev == -1 {
+		genesis, err := util.GenHashForNet(chaincfg.TestNet3Params)
+		if err != nil {
+			fc.t.Fatal(err)
+		}
+		copy(header[4:36], genesis[:])
+	} else {
+		copy(header[4:36], fc.hashes[prev][:])
+		height = fc.heights[prev] + 1
+	}
+	binary.LittleEndian.PutUint32(header[72:76], fakeBits)
+	binary.BigEndian.PutUint32(header[76:80], uint32(len(fc.headers)))
+	first := sha256.Sum256(header[:])
+	fc.headers = append(fc.headers, header)
+	fc.hashes = append(fc.hashes, sha256.Sum256(first[:]))
+	fc.heights = append(fc.heights, height)
+	fc.files = append(fc.files, 0)
+	fc.offsets = append(fc.offsets, 0)
+	return len(fc.headers) - 1
+}
+
+// addBlocks makes n blocks on top of prev and returns the last one
+func (fc *fakeChain) addBlocks(prev, n int) []int {
+	blocks := make([]int, n)
+	for i := range blocks {
+		prev = fc.addBlock(prev)
+		blocks[i] = prev
+	}
+	return blocks
+}
+
+// write appends blocks to a blk file
+func (fc *fakeChain) write(fileNum int, blocks ...int) {
+	name := filepath.Join(fc.blockDir, fmt.Sprintf("blk%05d.dat", fileNum))
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		fc.t.Fatal(err)
+	}
+	defer f.Close()
+	fStat, err := f.Stat()
+	if err != nil {
+		fc.t.Fatal(err)
+	}
+	w := bufio.NewWriter(f)
+	offset := uint32(fStat.Size())
+	for _, i := range blocks {
+		fc.files[i], fc.offsets[i] = uint32(fileNum), offset
+		var record [8]byte
+		copy(record[:4], []byte{0x0b, 0x11, 0x09, 0x07})
+		binary.LittleEndian.PutUint32(record[4:], 100)
+		w.Write(record[:])
+		w.Write(fc.headers[i][:])
+		w.Write(make([]byte, 20))
+		offset += 108
+	}
+	err = w.Flush()
+	if err != nil {
+		fc.t.Fatal(err)
+	}
+}
+
+// index puts blocks in the block index.  Connected blocks have undo data
+// and the others only have the block.
+func (fc *fakeChain) index(connected bool, blocks ...int) {
+	db, err := leveldb.OpenFile(filepath.Join(fc.blockDir, "index"),
+		&opt.Options{Compression: opt.NoCompression})
+	if err != nil {
+		fc.t.Fatal(err)
+	}
+	defer db.Close()
+	var batch leveldb.Batch
+	for _, i := range blocks {
+		// version, height, status, tx count, file, data pos, undo pos,
+		// then the header
+		status := uint64(BlockHaveData)
+		fields := []uint64{1, uint64(fc.heights[i]), 0, 1,
+			uint64(fc.files[i]), uint64(fc.offsets[i] + 8)}
+		if connected {
+			status |= uint64(BlockHaveUndo | BlockValidScripts)
+			fields = append(fields, uint64(fc.undoPos(i)))
+		}
+		fields[2] = status
+		var value []byte
+		for _, n := range fields {
+			b := make([]byte, compress.SerializeSizeVLQ(n))
+			compress.PutVLQ(b, n)
+			value = append(value, b...)
+		}
+		value = append(value, fc.headers[i][:]...)
+		batch.Put(append([]byte{0x62}, fc.hashes[i][:]...), value)
+	}
+	err = db.Write(&batch, nil)
+	if err != nil {
+		fc.t.Fatal(err)
+	}
+}
+
+// undoPos is the made up undo position of a block
+func (fc *fakeChain) undoPos(i int) uint32 {
+	return 1000 + uint32(i)
+}
+
+// checkOffsets checks the offset file has the blocks, from height 1 up
+func (fc *fakeChain) checkOffsets(cfg *Config, blocks ...int) {
+	offsets, err := ioutil.ReadFile(cfg.UtreeDir.OffsetDir.OffsetFile)
+	if err != nil {
+		fc.t.Fatal(err)
+	}
+	if len(offsets) != 12*len(blocks) {
+		fc.t.Fatalf("offset file %d bytes, expect %d",
+			len(offsets), 12*len(blocks))
+	}
+	for h, i := range blocks {
+		expect := [3]uint32{fc.files[i], fc.offsets[i], fc.undoPos(i)}
+		for j := range expect {
+			got := binary.BigEndian.Uint32(offsets[12*h+4*j:])
+			if got != expect[j] {
+				fc.t.Fatalf("block %d entry %d is %d, expect %d",
+					h+1, j, got, expect[j])
+			}
+		}
+	}
+}
+
+// newOffsetTest makes a config with an empty block dir and utreexo dir
+func newOffsetTest(t *testing.T, dir string) (*Config, *fakeChain) {
+	cfg := &Config{
+		params:   chaincfg.TestNet3Params,
+		BlockDir: filepath.Join(dir, "blocks"),
+		UtreeDir: initUtreeDir(filepath.Join(dir, "utree")),
+	}
+	err := makePaths(cfg.UtreeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll(cfg.BlockDir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cfg, &fakeChain{t: t, blockDir: cfg.BlockDir}
+}
+
+// expectHeight builds the offset file and checks the height it gets to
+func expectHeight(t *testing.T, cfg *Config, expect int32) {
+	height, err := buildOffsetFile(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if height != expect {
+		t.Fatalf("offset file at height %d, expect %d", height, expect)
+	}
+}
+
+func TestOffsetIndexerResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "offsettest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg, fc := newOffsetTest(t, dir)
+	b := fc.addBlocks(-1, 5)
+
+	// 3 came in before 2, so it can't be connected yet
+	fc.write(0, b[0], b[2])
+	fc.index(true, b[0])
+	fc.index(false, b[2])
+	expectHeight(t, cfg, 1)
+
+	// blk00000 grows, then there's a new blk file.  5 isn't connected
+	// yet.
+	fc.write(0, b[1])
+	fc.write(1, b[3], b[4])
+	fc.index(true, b[1], b[2], b[3])
+	fc.index(false, b[4])
+	expectHeight(t, cfg, 4)
+
+	fc.index(true, b[4])
+	expectHeight(t, cfg, 5)
+	fc.checkOffsets(cfg, b...)
+}
+
+func TestOffsetIndexerReorg(t *testing.T) {
+	dir, err := ioutil.TempDir("", "offsettest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg, fc := newOffsetTest(t, dir)
+
+	// the stale block 3a comes first and gets connected
+	chain := fc.addBlocks(-1, 2)
+	stale := fc.addBlock(chain[1])
+	fc.write(0, chain[0], chain[1], stale)
+	fc.index(true, chain[0], chain[1], stale)
+	expectHeight(t, cfg, 3)
+
+	// then 3b and 4b come in and bitcoind reorgs to them
+	chain = append(chain, fc.addBlocks(chain[1], 2)...)
+	fc.write(0, chain[2])
+	fc.write(1, chain[3])
+	expectHeight(t, cfg, 3)
+	fc.index(true, chain[2], chain[3])
+	expectHeight(t, cfg, 4)
+	fc.checkOffsets(cfg, chain...)
+
+	// a block with the same work as our tip doesn't replace it
+	tie := fc.addBlock(chain[2])
+	fc.write(1, tie)
+	fc.index(true, tie)
+	expectHeight(t, cfg, 4)
+	fc.checkOffsets(cfg, chain...)
+
+	// and the next block goes on the right one
+	next := fc.addBlock(chain[3])
+	fc.write(1, next)
+	fc.index(true, next)
+	expectHeight(t, cfg, 5)
+	fc.checkOffsets(cfg, append(chain, next)...)
+}
+
+// An offset file from before there was a state file gets picked up from
+// right after its last block, even when the blk file has lots of blocks
+// before it
+func TestOffsetIndexerNoState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "offsettest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg, fc := newOffsetTest(t, dir)
+
+	chain := fc.addBlocks(-1, 10050)
+	fc.write(0, chain...)
+	fc.index(true, chain...)
+	expectHeight(t, cfg, 10050)
+	err = os.Remove(cfg.UtreeDir.OffsetDir.stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ix, err := openOffsetIndexer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tip := chain[len(chain)-1]
+	if ix.height != 10050 || ix.fileNum != 0 ||
+		ix.fileOffset != fc.offsets[tip]+108 {
+		t.Fatalf("resumed at height %d file %d offset %d, expect 10050 "+
+			"0 %d", ix.height, ix.fileNum, ix.fileOffset,
+			fc.offsets[tip]+108)
+	}
+	ix.close()
+
+	more := fc.addBlocks(tip, 3)
+	fc.write(0, more[0])
+	fc.write(1, more[1:]...)
+	fc.index(true, more...)
+	expectHeight(t, cfg, 10053)
+	fc.checkOffsets(cfg, append(chain, more...)...)
+}
@@ -151,8 +151,11 @@ type ttlResult struct {
 	indexWithinBlock uint16 // index in that block where the txo is created
 }
 
-func (bnr *blockAndRev) toAddDel() (
-	blockAdds []accumulator.Leaf, delLeaves []btcacc.LeafData, err error) {
+// toAddDel returns the leaves to add to the accumulator, hashed with h,
+// along with their LeafData, and the LeafData of the leaves to delete
+func (bnr *blockAndRev) toAddDel(h accumulator.Hasher) (
+	blockAdds []accumulator.Leaf, addLeaves, delLeaves []btcacc.LeafData,
+	err error) {
 
 	delLeaves, err = bnr.toDelLeaves()
 	if err != nil {
@@ -160,8 +163,12 @@ func (bnr *blockAndRev) toAddDel() (
 	}
 
 	// this is bridgenode, so don't need to deal with memorable leaves
-	blockAdds = uwire.BlockToAddLeaves(
-		bnr.Blk, nil, bnr.outSkipList, bnr.Height, bnr.outCount)
+	addLeaves = uwire.BlockToAddLeafData(
+		bnr.Blk, bnr.outSkipList, bnr.Height, bnr.outCount)
+	blockAdds = make([]accumulator.Leaf, len(addLeaves))
+	for i, l := range addLeaves {
+		blockAdds[i].Hash = l.LeafHashWith(h)
+	}
 
 	// if bnr.Height == 106 {
 	// fmt.Printf("h %d outskip %v\n", bnr.Height, bnr.outSkipList)
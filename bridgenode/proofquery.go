@@ -0,0 +1,84 @@
+package bridgenode
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/btcacc"
+	uwire "github.com/mit-dci/utreexo/wire"
+)
+
+// leafLookup finds the LeafData for an outpoint that's in the accumulator.
+// found is false if the outpoint isn't unspent.
+type leafLookup interface {
+	getLeafData(op wire.OutPoint) (ld btcacc.LeafData, found bool, err error)
+}
+
+// proofServer answers MsgGetProof requests out of the forest
+type proofServer struct {
+	// mtx is held while reading the forest, as ProveBatch isn't safe to
+	// call from more than one goroutine.  In follow mode BuildProofs holds
+	// it while changing the forest and leaf index.
+	mtx    sync.Mutex
+	forest *accumulator.Forest
+
+	// leaves is for requests by outpoint.  If it's nil only leaf hashes
+	// can be asked for.
+	leaves leafLookup
+}
+
+// prove gets a proof for all the leaves in the request, leaf hashes first
+// and then outpoints
+func (ps *proofServer) prove(req uwire.ProofRequest) (
+	uwire.ProofResponse, error) {
+
+	// the lock covers the lookups too, so the leaf index and forest are at
+	// the same block
+	ps.mtx.Lock()
+	defer ps.mtx.Unlock()
+
+	var resp uwire.ProofResponse
+	if len(req.OutPoints) != 0 && ps.leaves == nil {
+		return resp, fmt.Errorf("can't look up outpoints, only leaf hashes")
+	}
+
+	hashes := make([]accumulator.Hash, 0,
+		len(req.LeafHashes)+len(req.OutPoints))
+	hashes = append(hashes, req.LeafHashes...)
+	resp.LeafDatas = make([]btcacc.LeafData, len(req.OutPoints))
+	for i, op := range req.OutPoints {
+		ld, found, err := ps.leaves.getLeafData(op)
+		if err != nil {
+			return resp, err
+		}
+		if !found {
+			return resp, fmt.Errorf("%s not found", op.String())
+		}
+		resp.LeafDatas[i] = ld
+		hashes = append(hashes, ld.LeafHashWith(ps.forest.Hasher()))
+	}
+
+	// ProveBatch dumps the whole forest if it can't find a leaf, so check
+	// first.  A leaf asked for twice, whether by hash or by outpoint, would
+	// be a repeated target and the proof wouldn't verify.
+	seen := make(map[accumulator.Hash]bool, len(hashes))
+	for _, h := range hashes {
+		if seen[h] {
+			return resp, fmt.Errorf("leaf %x asked for more than once", h)
+		}
+		seen[h] = true
+		if !ps.forest.FindLeaf(h) {
+			return resp, fmt.Errorf("leaf %x not in accumulator", h)
+		}
+	}
+	var err error
+	resp.Proof, err = ps.forest.ProveBatch(hashes)
+	if err != nil {
+		return resp, err
+	}
+	resp.NumLeaves, _ = ps.forest.ReconstructStats()
+	resp.Roots = ps.forest.GetRoots()
+	return resp, nil
+}
@@ -0,0 +1,131 @@
+package bridgenode
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/btcacc"
+	uwire "github.com/mit-dci/utreexo/wire"
+)
+
+// mapLookup is a leafLookup out of a map
+type mapLookup map[wire.OutPoint]btcacc.LeafData
+
+func (m mapLookup) getLeafData(op wire.OutPoint) (
+	btcacc.LeafData, bool, error) {
+	ld, ok := m[op]
+	return ld, ok, nil
+}
+
+func TestProofQuery(t *testing.T) {
+	forest := accumulator.NewForest(accumulator.RamForest, nil, "", 0)
+	lookup := make(mapLookup)
+	var lds []btcacc.LeafData
+	var adds []accumulator.Leaf
+	for i := 0; i < 20; i++ {
+		ld := btcacc.LeafData{
+			Index:    uint32(i),
+			Height:   int32(i),
+			Amt:      int64(i) * 1000,
+			PkScript: []byte{0x51},
+		}
+		ld.TxHash[0] = byte(i)
+		lds = append(lds, ld)
+		op := wire.OutPoint{Hash: chainhash.Hash(ld.TxHash), Index: ld.Index}
+		lookup[op] = ld
+		adds = append(adds, accumulator.Leaf{Hash: ld.LeafHash()})
+	}
+	_, err := forest.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps := &proofServer{forest: forest, leaves: lookup}
+
+	req := uwire.ProofRequest{
+		LeafHashes: []accumulator.Hash{lds[3].LeafHash(), lds[17].LeafHash()},
+		OutPoints: []wire.OutPoint{
+			{Hash: chainhash.Hash(lds[8].TxHash), Index: lds[8].Index}},
+	}
+
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	serverErr := make(chan error, 1)
+	go func() {
+		msgType, payload, err := uwire.ReadMessage(server)
+		if err != nil {
+			serverErr <- err
+			return
+		}
+		if msgType != uwire.MsgGetProof {
+			serverErr <- fmt.Errorf("got message type %d", msgType)
+			return
+		}
+		serverErr <- serveProof(server, ps, payload)
+	}()
+
+	resp, err := uwire.RequestProof(client, req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = <-serverErr; err != nil {
+		t.Fatal(err)
+	}
+
+	if resp.NumLeaves != 20 {
+		t.Fatalf("got %d leaves, expect 20", resp.NumLeaves)
+	}
+	if !reflect.DeepEqual(resp.Roots, forest.GetRoots()) {
+		t.Fatalf("got roots %v, expect %v", resp.Roots, forest.GetRoots())
+	}
+	if !reflect.DeepEqual(resp.LeafDatas[0], lds[8]) {
+		t.Fatalf("got leafdata %s, expect %s",
+			resp.LeafDatas[0].ToString(), lds[8].ToString())
+	}
+	toProve := append(req.LeafHashes, resp.LeafDatas[0].LeafHash())
+	err = forest.VerifyBatchProof(toProve, resp.Proof)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// leaves that aren't there are an error
+	var missing btcacc.LeafData
+	_, err = ps.prove(uwire.ProofRequest{
+		LeafHashes: []accumulator.Hash{missing.LeafHash()}})
+	if err == nil {
+		t.Fatal("proved a leaf that isn't in the forest")
+	}
+	_, err = ps.prove(uwire.ProofRequest{
+		OutPoints: []wire.OutPoint{{Index: 100}}})
+	if err == nil {
+		t.Fatal("proved an outpoint that isn't in the forest")
+	}
+
+	// the same leaf twice is an error, whether it's asked for by hash or
+	// by outpoint
+	op8 := wire.OutPoint{Hash: chainhash.Hash(lds[8].TxHash), Index: lds[8].Index}
+	dupes := []uwire.ProofRequest{
+		{LeafHashes: []accumulator.Hash{lds[3].LeafHash(), lds[3].LeafHash()}},
+		{OutPoints: []wire.OutPoint{op8, op8}},
+		{LeafHashes: []accumulator.Hash{lds[8].LeafHash()},
+			OutPoints: []wire.OutPoint{op8}},
+	}
+	for i, dupe := range dupes {
+		_, err = ps.prove(dupe)
+		if err == nil {
+			t.Fatalf("request %d proved the same leaf twice", i)
+		}
+	}
+
+	// no lookup, no outpoints
+	ps.leaves = nil
+	_, err = ps.prove(req)
+	if err == nil {
+		t.Fatal("proved outpoints without a lookup")
+	}
+}
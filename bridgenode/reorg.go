@@ -0,0 +1,325 @@
+package bridgenode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/btcacc"
+	"github.com/mit-dci/utreexo/util"
+)
+
+/*
+Reorgs:
+
+The undo worker saves the hash of every block it writes an undo block for.
+On startup, the hashes of the blocks we've already built proofs for are
+compared against the blocks in the offset file, which follows the chain
+bitcoind's block index says has the most work (see offsetIndexer).  If they
+differ, the chain has reorged and we roll back to the last block that's on
+both chains:
+
+  1. Read the undo blocks from tip to fork point and Undo() the forest.
+  2. Clear the TTL values that the disconnected blocks wrote into older
+     blocks' TTL areas, since those utxos aren't spent anymore.
+  3. Truncate the proof, undo, ttl, txid, roots and block hash files (and
+     their offset and index files) back to the fork point.
+
+Then BuildProofs carries on from the fork point along the new chain.
+*/
+
+// minPrune is the fewest blocks -prune can keep proofs and undo data for,
+// so that reorgs as deep as the leaf index can take can still be rolled
+// back
+const minPrune = leafIndexUndoDepth
+
+// findForkHeight returns the height of the last block we built proofs for
+// that's still in bitcoind's best chain, as the offset file has it.  If
+// there's no reorg it returns height.
+func findForkHeight(cfg *Config, height, knownTipHeight int32) (int32, error) {
+	hashFile, err := os.OpenFile(
+		cfg.UtreeDir.UndoDir.blockHashFile, os.O_RDONLY, 0600)
+	if err != nil {
+		if os.IsNotExist(err) {
+			// built before block hashes were saved; can't tell
+			return height, nil
+		}
+		return 0, err
+	}
+	defer hashFile.Close()
+
+	// if the offset file doesn't go as high as we've built, start from
+	// the top of the offset file.
+	startHeight := height
+	if knownTipHeight < startHeight {
+		startHeight = knownTipHeight
+	}
+
+	h := startHeight
+	for ; h > 0; h-- {
+		var saved [32]byte
+		_, err = hashFile.ReadAt(saved[:], int64(32*h))
+		if err != nil || saved == [32]byte{} {
+			// no hash saved for this height so assume it's fine
+			break
+		}
+		blockHash, err := blockHashAtHeight(cfg, h)
+		if err != nil {
+			return 0, err
+		}
+		if blockHash == saved {
+			break
+		}
+		fmt.Printf("reorg: block at height %d was %x now %x\n",
+			h, saved, blockHash)
+	}
+
+	if h == startHeight {
+		// the tip matches; the offset file may just be behind
+		return height, nil
+	}
+	return h, nil
+}
+
+// blockHashAtHeight returns the hash of the block at the given height in the
+// offset file
+func blockHashAtHeight(cfg *Config, height int32) ([32]byte, error) {
+	b, err := GetBlockBytesFromFile(
+		height, cfg.UtreeDir.OffsetDir.OffsetFile, cfg.BlockDir)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	if len(b) < 80 {
+		return [32]byte{}, fmt.Errorf("block %d only %d bytes", height, len(b))
+	}
+	return chainhash.DoubleHashH(b[:80]), nil
+}
+
+// rollBack undoes the forest from height back to forkHeight and truncates
+// all the bridge node files so that forkHeight is the last block.
+func rollBack(cfg *Config, forest *accumulator.Forest,
+	height, forkHeight int32) error {
+
+	if cfg.prune != 0 && height-forkHeight > cfg.prune {
+		return fmt.Errorf("can't roll back %d blocks, only the last %d "+
+			"are kept with -prune", height-forkHeight, cfg.prune)
+	}
+
+	ttlFiles, err := openSplitFile(
+		cfg.UtreeDir.TtlDir.ttlFiles, cfg.maxFileSize, false)
+	if err != nil {
+		return err
+	}
+	defer ttlFiles.close()
+	txidFile, err := os.OpenFile(
+		cfg.UtreeDir.TtlDir.txidFile, os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer txidFile.Close()
+	txidOffsetFile, err := os.OpenFile(
+		cfg.UtreeDir.TtlDir.txidOffsetFile, os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer txidOffsetFile.Close()
+
+	leaves, err := openRollBackLeafIndex(cfg, height, forkHeight)
+	if err != nil {
+		return err
+	}
+	if leaves != nil {
+		defer leaves.close()
+	}
+
+	for h := height; h > forkHeight; h-- {
+		ub, err := readUndoBlock(cfg.UtreeDir.UndoDir, h)
+		if err != nil {
+			return fmt.Errorf("rollBack h %d %s", h, err.Error())
+		}
+		err = forest.Undo(ub)
+		if err != nil {
+			return fmt.Errorf("rollBack h %d Undo %s", h, err.Error())
+		}
+
+		udb, err := GetUDataBytesFromFile(cfg.UtreeDir.ProofDir, h)
+		if err != nil {
+			return fmt.Errorf("rollBack h %d %s", h, err.Error())
+		}
+		var ud btcacc.UData
+		err = ud.Deserialize(bytes.NewReader(udb))
+		if err != nil {
+			return fmt.Errorf("rollBack h %d %s", h, err.Error())
+		}
+		err = clearTTLs(ud.Stxos, forkHeight,
+			ttlFiles, txidFile, txidOffsetFile)
+		if err != nil {
+			return fmt.Errorf("rollBack h %d %s", h, err.Error())
+		}
+		if leaves != nil {
+			err = leaves.disconnectBlock(h)
+			if err != nil {
+				return fmt.Errorf("rollBack h %d %s", h, err.Error())
+			}
+		}
+	}
+
+	// txid offsets start at height 1, so the entry at forkHeight is where
+	// block forkHeight+1 starts.  It's in miniTxids, which are 8 bytes.
+	txidEnd, err := readOffset(txidOffsetFile, int64(forkHeight))
+	if err != nil {
+		return err
+	}
+	err = txidFile.Truncate(txidEnd * 8)
+	if err != nil {
+		return err
+	}
+	err = txidOffsetFile.Truncate(int64(forkHeight) * 8)
+	if err != nil {
+		return err
+	}
+
+	err = ttlFiles.truncate(forkHeight)
+	if err != nil {
+		return err
+	}
+	err = truncateSplitFile(cfg.UtreeDir.ProofDir.pFiles, forkHeight)
+	if err != nil {
+		return err
+	}
+	err = truncateSplitFile(cfg.UtreeDir.UndoDir.undoFiles, forkHeight)
+	if err != nil {
+		return err
+	}
+	err = truncateSplitFile(cfg.UtreeDir.ForestDir.rootFiles, forkHeight)
+	if err != nil {
+		return err
+	}
+
+	return os.Truncate(
+		cfg.UtreeDir.UndoDir.blockHashFile, int64(forkHeight+1)*32)
+}
+
+// openRollBackLeafIndex opens the leaf index if it's there and at height,
+// and checks it can go back to forkHeight.  It returns nil if there's no
+// index to roll back.
+func openRollBackLeafIndex(cfg *Config, height, forkHeight int32) (
+	*leafIndex, error) {
+
+	if !util.HasAccess(cfg.UtreeDir.LeafIndexDir) {
+		return nil, nil
+	}
+	leaves, err := openLeafIndex(cfg.UtreeDir.LeafIndexDir)
+	if err != nil {
+		return nil, err
+	}
+	indexHeight, err := leaves.height()
+	if err != nil {
+		leaves.close()
+		return nil, err
+	}
+	if indexHeight != height {
+		// out of step with the forest already; openBuildLeafIndex rolls
+		// it back or catches it up from wherever it is
+		return nil, leaves.close()
+	}
+	ok, err := leaves.canRollBack(forkHeight)
+	if err != nil {
+		leaves.close()
+		return nil, err
+	}
+	if !ok {
+		leaves.close()
+		return nil, fmt.Errorf("leaf index can't roll back to %d. Delete "+
+			"%s and it'll be built again from the blocks",
+			forkHeight, cfg.UtreeDir.LeafIndexDir)
+	}
+	return leaves, nil
+}
+
+// clearTTLs zeros the TTL values of the given stxos that were created at or
+// before forkHeight.  The ones created after are getting truncated anyway.
+func clearTTLs(stxos []btcacc.LeafData, forkHeight int32,
+	ttlFiles *splitFile, txidFile, txidOffsetFile *os.File) error {
+
+	var empty [4]byte
+	for _, stxo := range stxos {
+		if stxo.Height > forkHeight {
+			continue
+		}
+		mi := miniIn{idx: uint16(stxo.Index), createHeight: stxo.Height}
+		copy(mi.hashprefix[:], stxo.TxHash[:6])
+
+		// find where the txo is in the block it was created in
+		start, err := readOffset(txidOffsetFile, int64(stxo.Height-1))
+		if err != nil {
+			return err
+		}
+		end, err := readOffset(txidOffsetFile, int64(stxo.Height))
+		if err != nil {
+			return err
+		}
+		idxInBlock := binSearch(mi, start, end, txidFile)
+
+		blockStart, err := ttlFiles.pos(stxo.Height)
+		if err != nil {
+			return err
+		}
+		err = ttlFiles.writeAt(
+			empty[:], blockStart.add(uint32(idxInBlock)*4))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readUndoBlock reads the undo block for the given height from the undo
+// files
+func readUndoBlock(undoDir undoDir, height int32) (
+	ub accumulator.UndoBlock, err error) {
+
+	undoFiles, err := openSplitFile(undoDir.undoFiles, 0, true)
+	if err != nil {
+		return
+	}
+	defer undoFiles.close()
+
+	buf, err := undoFiles.readRecord(height)
+	if err != nil {
+		err = fmt.Errorf("undo block %d %s", height, err.Error())
+		return
+	}
+	err = ub.Deserialize(bytes.NewReader(buf))
+	ub.Height = height
+	return
+}
+
+// truncateSplitFile truncates proof or undo files so that height is the
+// last block in them
+func truncateSplitFile(paths splitPaths, height int32) error {
+	sf, err := openSplitFile(paths, 0, false)
+	if err != nil {
+		return err
+	}
+	err = sf.truncate(height)
+	if err != nil {
+		sf.close()
+		return err
+	}
+	return sf.close()
+}
+
+// readOffset reads the i'th 8 byte offset in an offset file
+func readOffset(offsetFile *os.File, i int64) (int64, error) {
+	var buf [8]byte
+	_, err := offsetFile.ReadAt(buf[:], i*8)
+	if err != nil {
+		return 0, fmt.Errorf("read offset %d from %s: %s",
+			i, offsetFile.Name(), err.Error())
+	}
+	return int64(binary.BigEndian.Uint64(buf[:])), nil
+}
@@ -0,0 +1,144 @@
+package bridgenode
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/mit-dci/utreexo/accumulator"
+)
+
+func TestUndoBlockRollBack(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reorgtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ud := undoDir{
+		base: dir,
+		undoFiles: splitPaths{dir: dir, prefix: "undo",
+			indexFile: filepath.Join(dir, "undoindex.dat")},
+	}
+
+	var uf flatFileState
+	// small files so the blocks get split up
+	uf.files, err = openSplitFile(ud.undoFiles, 100, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uf.fileWait = new(sync.WaitGroup)
+	err = uf.ffInit()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	forest := accumulator.NewForest(accumulator.RamForest, nil, "", 0)
+	rootsAt := make(map[int32][]accumulator.Hash)
+	var leafNum byte
+	for h := int32(1); h <= 5; h++ {
+		adds := make([]accumulator.Leaf, 4)
+		for i := range adds {
+			leafNum++
+			adds[i].Hash[0] = leafNum
+		}
+		var dels []uint64
+		if h > 1 {
+			dels = []uint64{1, 2}
+		}
+		ub, err := forest.Modify(adds, dels)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ub.Height = h
+		uf.fileWait.Add(1)
+		err = uf.writeUndoBlock(*ub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rootsAt[h] = forest.GetRoots()
+	}
+
+	// roll back to height 2
+	for h := int32(5); h > 2; h-- {
+		ub, err := readUndoBlock(ud, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = forest.Undo(ub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(forest.GetRoots(), rootsAt[h-1]) {
+			t.Fatalf("after undoing %d roots %x expected %x",
+				h, forest.GetRoots(), rootsAt[h-1])
+		}
+	}
+
+	err = uf.files.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = truncateSplitFile(ud.undoFiles, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = readUndoBlock(ud, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = readUndoBlock(ud, 3)
+	if err == nil {
+		t.Fatal("read undo block 3 after truncating to 2")
+	}
+}
+
+// The bridge built on a stale block that came before its replacement in the
+// blk file.  Once bitcoind switches over, the fork is found.
+func TestFindForkHeight(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reorgtest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg, fc := newOffsetTest(t, dir)
+
+	chain := fc.addBlocks(-1, 2)
+	stale := fc.addBlock(chain[1])
+	fc.write(0, chain[0], chain[1], stale)
+	fc.index(true, chain[0], chain[1], stale)
+	expectHeight(t, cfg, 3)
+
+	// proofs got built for 1, 2 and the stale 3
+	var hashes [4 * 32]byte
+	for h, i := range []int{chain[0], chain[1], stale} {
+		copy(hashes[32*(h+1):], fc.hashes[i][:])
+	}
+	err = ioutil.WriteFile(cfg.UtreeDir.UndoDir.blockHashFile, hashes[:], 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forkHeight, err := findForkHeight(cfg, 3, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if forkHeight != 3 {
+		t.Fatalf("fork at %d before the reorg", forkHeight)
+	}
+
+	// the replacement for 3 is written after it, then 4 on top
+	replacement := fc.addBlocks(chain[1], 2)
+	fc.write(0, replacement...)
+	fc.index(true, replacement...)
+	expectHeight(t, cfg, 4)
+	forkHeight, err = findForkHeight(cfg, 3, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if forkHeight != 2 {
+		t.Fatalf("fork at %d, expect 2", forkHeight)
+	}
+}
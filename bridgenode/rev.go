@@ -10,6 +10,7 @@ import (
 	"path/filepath"
 	"sync"
 
+	"github.com/mit-dci/utreexo/compress"
 	"github.com/mit-dci/utreexo/util"
 
 	"github.com/btcsuite/btcd/wire"
@@ -52,9 +53,13 @@ type RawHeaderData struct {
 // the entire blocktxs and height to bchan with TxToWrite type.
 // It also puts in the proofs.  This will run on the archive server, and the
 // data will be sent over the network to the CSN.
+// If follower isn't nil, it waits for new blocks once it gets to the end of
+// the offset file, instead of stopping.  If the chain reorgs under the
+// blocks it's sent, it sends true on reorg and stops.
 func BlockAndRevReader(
-	aChan, bChan chan blockAndRev, haltRequest chan bool, wg *sync.WaitGroup,
-	cfg *Config, finishedHeight int32) {
+	aChan, bChan chan blockAndRev, haltRequest, reorg chan bool,
+	wg *sync.WaitGroup, cfg *Config, finishedHeight int32,
+	follower *offsetIndexer) {
 
 	// finishedHeight is the height we're finsihed reading & sending out.
 
@@ -66,10 +71,33 @@ func BlockAndRevReader(
 	}
 	defer offsetFile.Close() // file always closes
 
-	for finishedHeight < cfg.quitAfter && !stop {
+	// the hash of the last block sent, to tell if it's been reorged out
+	var lastHash [32]byte
+	if follower != nil {
+		lastHash, err = follower.hashAt(finishedHeight)
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	endHeight := cfg.quitAfter
+	for !stop {
+		if finishedHeight >= endHeight {
+			if follower == nil {
+				break
+			}
+			var reorged bool
+			endHeight, reorged, stop = follower.waitForBlocks(
+				finishedHeight, lastHash, haltRequest)
+			if reorged {
+				reorg <- true
+				break
+			}
+			continue
+		}
 		blocksToRead := int32(1000)
-		if finishedHeight+blocksToRead >= cfg.quitAfter {
-			blocksToRead = cfg.quitAfter - finishedHeight
+		if finishedHeight+blocksToRead >= endHeight {
+			blocksToRead = endHeight - finishedHeight
 		}
 		blocks, revs, err :=
 			GetRawBlocksFromDisk(
@@ -92,6 +120,7 @@ func BlockAndRevReader(
 			aChan <- bnr
 			bChan <- bnr
 			finishedHeight++
+			lastHash = *bnr.Blk.Hash()
 			select {
 			case stop = <-haltRequest: // receives true from stopBuildProofs()
 			default:
@@ -158,8 +187,8 @@ func GetRawBlocksFromDisk(startAt int32, count int32, offsetFile *os.File,
 		return
 	}
 
-	blockFile, err := os.Open(filepath.Join(blockDir,
-		fmt.Sprintf("blk%05d.dat", datFileNum)))
+	blockFile, err := openBlockFile(
+		blockDir, fmt.Sprintf("blk%05d.dat", datFileNum))
 	if err != nil {
 		return
 	}
@@ -173,8 +202,8 @@ func GetRawBlocksFromDisk(startAt int32, count int32, offsetFile *os.File,
 		return
 	}
 
-	revFile, err := os.Open(filepath.Join(blockDir,
-		fmt.Sprintf("rev%05d.dat", datFileNum)))
+	revFile, err := openBlockFile(
+		blockDir, fmt.Sprintf("rev%05d.dat", datFileNum))
 	if err != nil {
 		return
 	}
@@ -281,9 +310,8 @@ func GetBlockBytesFromFile(
 	}
 	// fmt.Printf("block %d in file %d offset %d\n", height+1, datFile, offset)
 
-	blockFName := fmt.Sprintf("blk%05d.dat", datFile)
-	bDir := filepath.Join(blockDir, blockFName)
-	blockFile, err := os.Open(bDir)
+	blockFile, err := openBlockFile(
+		blockDir, fmt.Sprintf("blk%05d.dat", datFile))
 	if err != nil {
 		return
 	}
@@ -407,7 +435,7 @@ func (tx *TxUndo) Deserialize(r io.Reader) error {
 // variable
 func readTxInUndo(r io.Reader, ti *TxInUndo) error {
 	// nCode is how height is saved to the rev files
-	nCode, _ := deserializeVLQ(r)
+	nCode, _ := compress.DeserializeVLQ(r)
 	ti.Height = int32(nCode / 2) // Height is saved as actual height * 2
 	ti.Coinbase = nCode&1 == 1   // Coinbase is odd. Saved as height * 2 + 1
 
@@ -426,10 +454,10 @@ func readTxInUndo(r io.Reader, ti *TxInUndo) error {
 	// ti.Varint = varint
 	// }
 
-	amount, _ := deserializeVLQ(r)
-	ti.Amount = decompressTxOutAmount(amount)
+	amount, _ := compress.DeserializeVLQ(r)
+	ti.Amount = compress.DecompressTxOutAmount(amount)
 
-	ti.PKScript = decompressScript(r)
+	ti.PKScript = compress.DecompressScript(r)
 	if ti.PKScript == nil {
 		return fmt.Errorf("nil pkscript on h %d, pks %x", ti.Height, ti.PKScript)
 
@@ -464,6 +492,10 @@ type CBlockFileIndex struct {
 	File    int32  // file num
 	DataPos uint32 // blk*.dat file offset
 	UndoPos uint32 // rev*.dat file offset
+
+	// from the block header stored after the index info
+	PrevHash [32]byte // hash of the block before this one
+	Bits     uint32   // difficulty target, for working out chain work
 }
 
 // Block status bits
@@ -553,34 +585,45 @@ func BufferDBHeight(lvdb *leveldb.DB) map[[32]byte]int32 {
 	return bufDB
 }
 
+// ReadCBlockFileIndex reads a CDiskBlockIndex as bitcoind stores it in the
+// block index.  The file number and positions are only there if the status
+// says there's block or undo data for them.
 func ReadCBlockFileIndex(r io.ReadSeeker) (cbIdx CBlockFileIndex) {
-	// not sure if nVersion is correct...?
-	nVersion, _ := deserializeVLQ(r)
+	// this is the client version that wrote it, not the block version
+	nVersion, _ := compress.DeserializeVLQ(r)
 	cbIdx.Version = int32(nVersion)
 
-	nHeight, _ := deserializeVLQ(r)
+	nHeight, _ := compress.DeserializeVLQ(r)
 	cbIdx.Height = int32(nHeight)
 
-	// nStatus is incorrect but everything else correct. Probably reading this wrong
-	nStatus, _ := deserializeVLQ(r)
+	nStatus, _ := compress.DeserializeVLQ(r)
 	cbIdx.Status = int32(nStatus)
 
-	nTx, _ := deserializeVLQ(r)
+	nTx, _ := compress.DeserializeVLQ(r)
 	cbIdx.TxCount = int32(nTx)
 
-	nFile, _ := deserializeVLQ(r)
-	cbIdx.File = int32(nFile)
-
-	nDataPos, _ := deserializeVLQ(r)
-	cbIdx.DataPos = uint32(nDataPos)
-
-	nUndoPos, _ := deserializeVLQ(r)
-	cbIdx.UndoPos = uint32(nUndoPos)
+	if cbIdx.Status&BlockHaveMask != 0 {
+		nFile, _ := compress.DeserializeVLQ(r)
+		cbIdx.File = int32(nFile)
+	}
+	if cbIdx.Status&BlockHaveData != 0 {
+		nDataPos, _ := compress.DeserializeVLQ(r)
+		cbIdx.DataPos = uint32(nDataPos)
+	}
+	if cbIdx.Status&BlockHaveUndo != 0 {
+		nUndoPos, _ := compress.DeserializeVLQ(r)
+		cbIdx.UndoPos = uint32(nUndoPos)
+	}
 
-	// Need to seek 3 bytes if you're fetching the actual
-	// header information. Not sure why it's needed but there's
-	// no documentation to be found on the Bitcoin Core side
-	// r.Seek(3, 1)
+	// then the 80 byte header: 4 bytes version, 32 bytes prev hash, 32
+	// bytes merkle root, then 4 bytes each of time, bits and nonce
+	var header [80]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return cbIdx
+	}
+	copy(cbIdx.PrevHash[:], header[4:36])
+	cbIdx.Bits = binary.LittleEndian.Uint32(header[72:76])
 
 	return cbIdx
 }
@@ -0,0 +1,100 @@
+package bridgenode
+
+import (
+	"fmt"
+	"net"
+
+	uwire "github.com/mit-dci/utreexo/wire"
+)
+
+/*
+The roots after every block are kept in split files in forestdata:
+roots00000.dat and on, with rootsindex.dat.  Each record is a serialized
+uwire.Roots, with the digest on the end, so the server sends it as it is
+for a MsgGetRoots.
+
+Proofs built before the roots were kept have an empty record for each of
+their blocks, and the server says it doesn't have those.
+*/
+
+// openRootFiles opens the roots files ready to add the blocks after height
+func openRootFiles(cfg *Config, height int32) (*splitFile, error) {
+	rootFiles, err := openSplitFile(
+		cfg.UtreeDir.ForestDir.rootFiles, cfg.maxFileSize, false)
+	if err != nil {
+		return nil, err
+	}
+	rootsHeight, err := rootFiles.height()
+	if err != nil {
+		rootFiles.close()
+		return nil, err
+	}
+	if rootsHeight > height {
+		// written by a run that stopped before saving the forest
+		err = rootFiles.truncate(height)
+		if err != nil {
+			rootFiles.close()
+			return nil, err
+		}
+	}
+	if rootsHeight < height {
+		fmt.Printf("no roots for blocks %d to %d, built before roots were "+
+			"kept\n", rootsHeight+1, height)
+		for h := rootsHeight + 1; h <= height; h++ {
+			err = rootFiles.writeRecord(h, nil)
+			if err != nil {
+				rootFiles.close()
+				return nil, err
+			}
+		}
+	}
+	return rootFiles, nil
+}
+
+// writeRoots adds the forest's roots after block height to the roots files
+func writeRoots(ps *proofServer, rootFiles *splitFile, height int32) error {
+	ps.mtx.Lock()
+	numLeaves, _ := ps.forest.ReconstructStats()
+	roots := uwire.Roots{Height: height, Hasher: ps.forest.Hasher().ID(),
+		NumLeaves: numLeaves, Roots: ps.forest.GetRoots()}
+	ps.mtx.Unlock()
+	return rootFiles.writeRecord(height, roots.Bytes())
+}
+
+// readRoots reads the serialized roots after block height
+func readRoots(rootPaths splitPaths, height int32) ([]byte, error) {
+	rootFiles, err := openSplitFile(rootPaths, 0, true)
+	if err != nil {
+		return nil, err
+	}
+	defer rootFiles.close()
+	b, err := rootFiles.readRecord(height)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, fmt.Errorf("no roots for block %d, built before roots "+
+			"were kept", height)
+	}
+	return b, nil
+}
+
+// serveRoots answers a MsgGetRoots
+func serveRoots(c net.Conn, UtreeDir utreeDir, tip *chainTip,
+	payload []byte) error {
+
+	height, err := uwire.TipFromBytes(payload)
+	if err != nil {
+		return err
+	}
+	endHeight, _ := tip.get()
+	if height < 1 || height > endHeight {
+		return fmt.Errorf("no roots for block %d, tip is %d",
+			height, endHeight)
+	}
+	b, err := readRoots(UtreeDir.ForestDir.rootFiles, height)
+	if err != nil {
+		return err
+	}
+	return uwire.WriteMessage(c, uwire.MsgRoots, b)
+}
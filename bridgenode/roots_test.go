@@ -0,0 +1,124 @@
+package bridgenode
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	uwire "github.com/mit-dci/utreexo/wire"
+)
+
+// serveRootsOnce answers one MsgGetRoots on con like serveBlocksWorker
+func serveRootsOnce(con net.Conn, dir utreeDir, tip *chainTip) error {
+	msgType, payload, err := uwire.ReadMessage(con)
+	if err != nil {
+		return err
+	}
+	if msgType != uwire.MsgGetRoots {
+		return fmt.Errorf("got message type %d", msgType)
+	}
+	err = serveRoots(con, dir, tip, payload)
+	if err != nil {
+		uwire.WriteMessage(con, uwire.MsgReject, []byte(err.Error()))
+	}
+	return err
+}
+
+func TestRoots(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rootstest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := &Config{
+		UtreeDir:    initUtreeDir(filepath.Join(dir, "utreexo")),
+		maxFileSize: 200,
+	}
+	err = makePaths(cfg.UtreeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// blocks 1 and 2 were built before roots were kept
+	rootFiles, err := openRootFiles(cfg, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forest := accumulator.NewForest(accumulator.RamForest, nil, "", 0)
+	ps := &proofServer{forest: forest}
+	expect := make(map[int32][]accumulator.Hash)
+	for h := int32(3); h <= 6; h++ {
+		var adds []accumulator.Leaf
+		for i := int32(0); i < h; i++ {
+			adds = append(adds, accumulator.Leaf{Hash: accumulator.Hash{
+				byte(h), byte(i)}})
+		}
+		_, err = forest.Modify(adds, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = writeRoots(ps, rootFiles, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expect[h] = forest.GetRoots()
+	}
+	err = rootFiles.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the forest was only saved at 5, so 6 goes
+	rootFiles, err = openRootFiles(cfg, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = rootFiles.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tip := newChainTip(6, false)
+
+	for _, tc := range []struct {
+		height int32
+		ok     bool
+	}{{4, true}, {5, true}, {2, false}, {6, false}, {7, false}} {
+		client, server := net.Pipe()
+		serverErr := make(chan error, 1)
+		go func() {
+			serverErr <- serveRootsOnce(server, cfg.UtreeDir, tip)
+		}()
+		r, err := uwire.RequestRoots(client, tc.height)
+		client.Close()
+		server.Close()
+		<-serverErr
+		if !tc.ok {
+			if err == nil {
+				t.Fatalf("got roots for %d", tc.height)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		// 3 + 4 + 5 ... leaves
+		numLeaves := uint64((tc.height+3)*(tc.height-2)) / 2
+		if r.NumLeaves != numLeaves {
+			t.Fatalf("roots %d have %d leaves, expect %d",
+				tc.height, r.NumLeaves, numLeaves)
+		}
+		if r.Hasher != forest.Hasher().ID() {
+			t.Fatalf("roots %d have hasher %d, expect %d",
+				tc.height, r.Hasher, forest.Hasher().ID())
+		}
+		if !reflect.DeepEqual(r.Roots, expect[tc.height]) {
+			t.Fatalf("roots %d are %x, expect %x",
+				tc.height, r.Roots, expect[tc.height])
+		}
+	}
+}
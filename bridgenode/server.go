@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"os"
@@ -11,8 +12,11 @@ import (
 	"runtime/trace"
 	"time"
 
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
 	"github.com/mit-dci/utreexo/btcacc"
 	"github.com/mit-dci/utreexo/util"
+	uwire "github.com/mit-dci/utreexo/wire"
 )
 
 func Start(cfg *Config, sig chan bool) error {
@@ -40,6 +44,16 @@ func Start(cfg *Config, sig chan bool) error {
 		}()
 	}
 
+	// In follow mode BuildProofs serves too, and keeps going until it's
+	// told to stop
+	if cfg.follow {
+		err := BuildProofs(cfg, sig)
+		if err != nil {
+			return errBuildProofs(err)
+		}
+		return nil
+	}
+
 	// If serve option wasn't given
 	if !cfg.serve {
 		err := BuildProofs(cfg, sig)
@@ -78,16 +92,59 @@ func ArchiveServer(cfg *Config, sig chan bool) error {
 		return errNoDataDir(cfg.BlockDir)
 	}
 
+	err := migrateSplitFiles(cfg.UtreeDir, cfg.maxFileSize)
+	if err != nil {
+		return err
+	}
+
 	// Init forest and variables. Resumes if the data directory exists
 	maxHeight, err := restoreHeight(cfg)
 	if err != nil {
 		return err
 	}
 
-	blockServer(maxHeight, cfg, haltRequest, haltAccept)
+	// The forest is only needed to answer proof queries.  Serve without
+	// them if it can't be restored.
+	var proofs *proofServer
+	forest, err := restoreForest(cfg)
+	if err != nil {
+		fmt.Printf("not serving proof queries: %s\n", err.Error())
+	} else {
+		proofs = &proofServer{forest: forest}
+		proofs.leaves, err = openServeLeafIndex(cfg, maxHeight)
+		if err != nil {
+			fmt.Printf("not serving outpoint lookups: %s\n", err.Error())
+		}
+	}
+
+	blockServer(newChainTip(maxHeight, false), cfg, proofs,
+		haltRequest, haltAccept)
 	return nil
 }
 
+// openServeLeafIndex opens the leaf index for lookups, if it's up to
+// height
+func openServeLeafIndex(cfg *Config, height int32) (leafLookup, error) {
+	if !util.HasAccess(cfg.UtreeDir.LeafIndexDir) {
+		return nil, fmt.Errorf("no leaf index at %s", cfg.UtreeDir.LeafIndexDir)
+	}
+	leaves, err := openLeafIndex(cfg.UtreeDir.LeafIndexDir)
+	if err != nil {
+		return nil, err
+	}
+	indexHeight, err := leaves.height()
+	if err != nil {
+		leaves.close()
+		return nil, err
+	}
+	if indexHeight != height {
+		leaves.close()
+		return nil, fmt.Errorf("leaf index at height %d, proofs at %d",
+			indexHeight, height)
+	}
+	return leaves, nil
+}
+
 // stopServer listens for the signal from the OS and initiates an exit sequence
 func stopServer(sig, haltRequest, haltAccept chan bool) {
 	// Listen for SIGINT, SIGQUIT, SIGTERM
@@ -111,8 +168,8 @@ func stopServer(sig, haltRequest, haltAccept chan bool) {
 
 // blockServer listens on a TCP port for incoming connections, then gives
 // ublocks blocks over that connection
-func blockServer(
-	endHeight int32, cfg *Config, haltRequest, haltAccept chan bool) {
+func blockServer(tip *chainTip, cfg *Config, proofs *proofServer,
+	haltRequest, haltAccept chan bool) {
 
 	// before doing anything... this breaks
 	/*
@@ -137,6 +194,7 @@ func blockServer(
 	*/
 	// --------------
 
+	endHeight, _ := tip.get()
 	fmt.Printf("serving up to & including block height %d\n", endHeight)
 	listenAdr, err := net.ResolveTCPAddr("tcp", "0.0.0.0:8338")
 	if err != nil {
@@ -160,7 +218,8 @@ func blockServer(
 			close(cons)
 			return
 		case con := <-cons:
-			go serveBlocksWorker(cfg.UtreeDir, con, endHeight, cfg.BlockDir)
+			go serveBlocksWorker(cfg.UtreeDir, con, tip, cfg.BlockDir,
+				cfg.params.Net, cfg.prune, proofs)
 		}
 	}
 }
@@ -186,24 +245,91 @@ func acceptConnections(listener *net.TCPListener, cons chan net.Conn) {
 	}
 }
 
-// serveBlocksWorker gets height requests from client and sends out the ublock
-// for that height
-func serveBlocksWorker(UtreeDir utreeDir,
-	c net.Conn, endHeight int32, blockDir string) {
+// serveBlocksWorker does the handshake, then answers requests from the
+// client until it hangs up.  If prune isn't 0, only the last prune blocks
+// are served.
+func serveBlocksWorker(UtreeDir utreeDir, c net.Conn, tip *chainTip,
+	blockDir string, network wire.BitcoinNet, prune int32,
+	proofs *proofServer) {
 	defer c.Close()
 	fmt.Printf("start serving %s\n", c.RemoteAddr().String())
-	var fromHeight, toHeight int32
 
-	err := binary.Read(c, binary.BigEndian, &fromHeight)
+	ourFeatures := uwire.FeatureCompact | uwire.FeatureProofOnly
+	if proofs != nil {
+		ourFeatures |= uwire.FeatureProofQuery
+	}
+	if util.HasAccess(UtreeDir.ForestDir.rootFiles.indexFile) {
+		ourFeatures |= uwire.FeatureRoots
+	}
+	endHeight, newBlock := tip.get()
+	if newBlock != nil {
+		ourFeatures |= uwire.FeatureTip
+	}
+	features, err := uwire.ServerHandshake(c, network, ourFeatures, endHeight)
 	if err != nil {
-		fmt.Printf("pushBlocks Read %s\n", err.Error())
+		fmt.Printf("%s handshake %s\n", c.RemoteAddr().String(), err.Error())
 		return
 	}
+	// the client can ask for compact udata, which leaves out what's
+	// already in the block
+	compact := features&uwire.FeatureCompact != 0
+	// and if it can wait, we hold ranges open at the tip
+	waitTip := features&uwire.FeatureTip != 0
 
-	err = binary.Read(c, binary.BigEndian, &toHeight)
+	for {
+		t, payload, err := uwire.ReadMessage(c)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Printf("pushBlocks Read %s\n", err.Error())
+			return
+		}
+
+		switch t {
+		case uwire.MsgGetUBlocks, uwire.MsgGetUData:
+			// clients that already have the blocks just want the udata
+			proofOnly := t == uwire.MsgGetUData
+			err = serveRange(UtreeDir, c, tip, blockDir, payload,
+				prune, compact, proofOnly, waitTip)
+		case uwire.MsgGetProof:
+			if features&uwire.FeatureProofQuery == 0 {
+				err = fmt.Errorf("proof queries not agreed on")
+				break
+			}
+			err = serveProof(c, proofs, payload)
+		case uwire.MsgGetRoots:
+			if features&uwire.FeatureRoots == 0 {
+				err = fmt.Errorf("roots requests not agreed on")
+				break
+			}
+			err = serveRoots(c, UtreeDir, tip, payload)
+		default:
+			err = fmt.Errorf("sent message type %d, expect a request", t)
+		}
+		if err != nil {
+			fmt.Printf("%s %s\n", c.RemoteAddr().String(), err.Error())
+			uwire.WriteMessage(c, uwire.MsgReject, []byte(err.Error()))
+			return
+		}
+	}
+	fmt.Printf("hung up on %s\n", c.RemoteAddr().String())
+}
+
+// serveRange sends the ublocks, or just the udata if proofOnly, for a
+// MsgGetUBlocks or MsgGetUData request.  If waitTip is set and the tip
+// moves, it waits at the tip for the rest of the range instead of stopping.
+func serveRange(UtreeDir utreeDir, c net.Conn, tip *chainTip,
+	blockDir string, payload []byte, prune int32,
+	compact, proofOnly, waitTip bool) error {
+
+	sendType := uwire.MsgUBlock
+	if proofOnly {
+		sendType = uwire.MsgUData
+	}
+	fromHeight, toHeight, err := uwire.GetUBlocksFromBytes(payload)
 	if err != nil {
-		fmt.Printf("pushBlocks Read %s\n", err.Error())
-		return
+		return err
 	}
 
 	var direction int32 = 1
@@ -212,14 +338,11 @@ func serveBlocksWorker(UtreeDir utreeDir,
 		direction = -1
 	}
 
-	if toHeight > endHeight {
-		toHeight = endHeight
-	}
-
-	if fromHeight > endHeight {
+	endHeight, newBlock := tip.get()
+	follow := waitTip && newBlock != nil
+	if fromHeight > endHeight && !follow {
 		fmt.Printf("%s wanted %d but have %d\n",
-			c.LocalAddr().String(), fromHeight, endHeight)
-		return
+			c.RemoteAddr().String(), fromHeight, endHeight)
 	}
 
 	for curHeight := fromHeight; ; curHeight += direction {
@@ -230,131 +353,195 @@ func serveBlocksWorker(UtreeDir utreeDir,
 			// backwards request of height below toHeight
 			break
 		}
-
-		udb, err := GetUDataBytesFromFile(UtreeDir.ProofDir, curHeight)
-		if err != nil {
-			fmt.Printf("pushBlocks GetUDataBytesFromFile %s\n", err.Error())
-			break
+		if curHeight > endHeight {
+			if !follow {
+				break
+			}
+			endHeight, err = waitForTip(c, tip, curHeight)
+			if err != nil {
+				return err
+			}
+		}
+		if prune != 0 && curHeight <= endHeight-prune {
+			return fmt.Errorf("%s: block %d, oldest is %d",
+				uwire.PrunedReason, curHeight, endHeight-prune+1)
 		}
 
-		// if curHeight == 112 {
-		buf := bytes.NewBuffer(udb)
-		// deserialize to find errors
-		var ud btcacc.UData
-		err = ud.Deserialize(buf)
+		ubb, err := getUBlockBytes(
+			UtreeDir, blockDir, curHeight, compact, proofOnly)
 		if err != nil {
-			fmt.Printf("serveBlocksWorker h %d deser error %s\n", curHeight, err.Error())
-			fmt.Printf("ttls: %v targets %s\n", ud.TxoTTLs, ud.AccProof.ToString())
-			fmt.Printf("udb: %x\n", udb)
-			break
-		}
-		if len(ud.AccProof.Targets) != 0 {
-			fmt.Printf("h %d proof %s\n", curHeight, ud.AccProof.ToString())
+			return err
 		}
 
-		blkbytes, err := GetBlockBytesFromFile(
-			curHeight, UtreeDir.OffsetDir.OffsetFile, blockDir)
+		// send
+		err = uwire.WriteMessage(c, sendType, ubb)
 		if err != nil {
-			fmt.Printf("pushBlocks GetRawBlockFromFile %s\n", err.Error())
-			break
+			return fmt.Errorf("blkbytes write %s", err.Error())
 		}
+	}
+	return uwire.WriteMessage(c, uwire.MsgDone, nil)
+}
 
-		// send
-		_, err = c.Write(append(blkbytes, udb...))
+// waitForTip waits for the tip to get to height, sending MsgTips to the
+// client meanwhile.  Returns the new tip.
+func waitForTip(c net.Conn, tip *chainTip, height int32) (int32, error) {
+	for {
+		endHeight, newBlock := tip.get()
+		if height <= endHeight {
+			return endHeight, nil
+		}
+		err := uwire.WriteMessage(c, uwire.MsgTip, uwire.TipBytes(endHeight))
 		if err != nil {
-			fmt.Printf("pushBlocks blkbytes write %s\n", err.Error())
-			break
+			return 0, err
+		}
+		select {
+		case <-newBlock:
+		case <-time.After(tipInterval):
 		}
 	}
-	err = c.Close()
+}
+
+// serveProof answers a MsgGetProof
+func serveProof(c net.Conn, proofs *proofServer, payload []byte) error {
+	req, err := uwire.ProofRequestFromBytes(payload)
 	if err != nil {
-		fmt.Print(err.Error())
+		return err
 	}
-	fmt.Printf("hung up on %s\n", c.RemoteAddr().String())
+	resp, err := proofs.prove(req)
+	if err != nil {
+		return err
+	}
+	b, err := resp.Bytes()
+	if err != nil {
+		return err
+	}
+	return uwire.WriteMessage(c, uwire.MsgProof, b)
 }
 
-// GetUDataBytesFromFile reads the proof data from proof.dat and proofoffset.dat
-// and gives the proof & utxo data back.
-// Don't ask for block 0, there is no proof for that.
-// But there is an offset for block 0, which is 0, so it collides with block 1
-func GetUDataBytesFromFile(proofDir proofDir, height int32) (b []byte, err error) {
-	if height == 0 {
-		err = fmt.Errorf("GetUDataBytesFromFile: Block 0 is not not a thing")
-		return
-	}
+// getUBlockBytes reads the block and udata for a height from disk and
+// gives back the payload of a MsgUBlock, or of a MsgUData if proofOnly
+func getUBlockBytes(UtreeDir utreeDir, blockDir string,
+	curHeight int32, compact, proofOnly bool) ([]byte, error) {
 
-	var offset int64
-	var size uint32
-	var readMagic [4]byte
-	realMagic := [4]byte{0xaa, 0xff, 0xaa, 0xff}
-	offsetFile, err := os.OpenFile(proofDir.pOffsetFile, os.O_RDONLY, 0600)
+	udb, err := GetUDataBytesFromFile(UtreeDir.ProofDir, curHeight)
+	if os.IsNotExist(err) {
+		// pruned by an earlier run with a shorter -prune
+		return nil, fmt.Errorf("%s: block %d", uwire.PrunedReason, curHeight)
+	}
 	if err != nil {
-		return
+		return nil, fmt.Errorf("GetUDataBytesFromFile %s", err.Error())
 	}
 
-	proofFile, err := os.OpenFile(proofDir.pFile, os.O_RDONLY, 0600)
+	buf := bytes.NewBuffer(udb)
+	// deserialize to find errors
+	var ud btcacc.UData
+	err = ud.Deserialize(buf)
 	if err != nil {
-		return
+		fmt.Printf("ttls: %v targets %s\n", ud.TxoTTLs, ud.AccProof.ToString())
+		fmt.Printf("udb: %x\n", udb)
+		return nil, fmt.Errorf("h %d deser error %s", curHeight, err.Error())
+	}
+	if len(ud.AccProof.Targets) != 0 {
+		fmt.Printf("h %d proof %s\n", curHeight, ud.AccProof.ToString())
 	}
 
-	// offset file consists of 8 bytes per block
-	// tipnum * 8 gives us the correct position for that block
-	// Note it's currently a int64, can go down to int32 for split files
-	_, err = offsetFile.Seek(int64(8*height), 0)
-	if err != nil {
-		err = fmt.Errorf("offsetFile.Seek %s", err.Error())
-		return
+	// the block goes out too unless it's just the proof
+	var blkbytes []byte
+	if !proofOnly {
+		blkbytes, err = GetBlockBytesFromFile(
+			curHeight, UtreeDir.OffsetDir.OffsetFile, blockDir)
+		if err != nil {
+			return nil, fmt.Errorf("GetRawBlockFromFile %s", err.Error())
+		}
 	}
-	// read the offset of the block we want from the offset file
-	err = binary.Read(offsetFile, binary.BigEndian, &offset)
+
+	// the TTLs aren't in the proof files, they get filled in as the
+	// outputs are spent
+	ud.TxoTTLs, err = readBlockTTLs(UtreeDir, blockDir, curHeight, blkbytes)
 	if err != nil {
-		err = fmt.Errorf("binary.Read h %d offset %d %s", height, offset, err.Error())
-		return
+		return nil, fmt.Errorf("h %d ttls %s", curHeight, err.Error())
+	}
+	if compact {
+		udb, err = ud.ToCompactBytes()
+	} else {
+		var ubuf bytes.Buffer
+		err = ud.Serialize(&ubuf)
+		udb = ubuf.Bytes()
 	}
-	// seek to that offset
-	_, err = proofFile.Seek(offset, 0)
 	if err != nil {
-		err = fmt.Errorf("proofFile.Seek %s", err.Error())
-		return
+		return nil, fmt.Errorf("h %d serialize error %s",
+			curHeight, err.Error())
 	}
-	// first read 4-byte magic aaffaaff
-	n, err := proofFile.Read(readMagic[:])
+
+	return append(blkbytes, udb...), nil
+}
+
+// readBlockTTLs reads the TTLs of the outputs created in block height.
+// Ones that aren't spent yet are 0.  If the TTL files don't go past the
+// block, nothing later has spent its outputs, and the last block's TTLs
+// might still be being written, so the outputs are just counted from the
+// block.  blkbytes is the block if the caller has already read it; if it's
+// nil the block is only read when it's needed for the count.
+func readBlockTTLs(UtreeDir utreeDir, blockDir string,
+	height int32, blkbytes []byte) ([]int32, error) {
+
+	ttlFiles, err := openSplitFile(UtreeDir.TtlDir.ttlFiles, 0, true)
 	if err != nil {
 		return nil, err
 	}
-	if n != 4 {
-		return nil, fmt.Errorf("only read %d bytes from proof file", n)
+	defer ttlFiles.close()
+	ttlHeight, err := ttlFiles.height()
+	if err != nil {
+		return nil, err
 	}
-	if readMagic != realMagic {
-		return nil, fmt.Errorf("expect magic %x but read %x h %d offset %d",
-			realMagic, readMagic, height, offset)
+	if ttlHeight <= height {
+		if blkbytes == nil {
+			blkbytes, err = GetBlockBytesFromFile(
+				height, UtreeDir.OffsetDir.OffsetFile, blockDir)
+			if err != nil {
+				return nil, err
+			}
+		}
+		var msgBlock wire.MsgBlock
+		err = msgBlock.Deserialize(bytes.NewReader(blkbytes))
+		if err != nil {
+			return nil, err
+		}
+		_, outCount, _, _ := util.DedupeBlock(btcutil.NewBlock(&msgBlock))
+		return make([]int32, outCount), nil
 	}
 
-	err = binary.Read(proofFile, binary.BigEndian, &size)
+	pos, size, err := ttlFiles.blockSize(height)
 	if err != nil {
-		return
-	}
-	// fmt.Printf("height %d offset %d says size %d\n", height, offset, size)
-	if size > 1<<24 {
-		return nil, fmt.Errorf(
-			"size at offest %d says %d which is too big", offset, size)
+		return nil, err
 	}
-	// fmt.Printf("GetUDataBytesFromFile read size %d ", size)
-	b = make([]byte, size)
-
-	_, err = proofFile.Read(b)
+	b := make([]byte, size)
+	err = ttlFiles.readAt(b, pos)
 	if err != nil {
-		err = fmt.Errorf("proofFile.Read(ubytes) %s", err.Error())
-		return
+		return nil, err
 	}
+	ttls := make([]int32, size/4)
+	for i := range ttls {
+		ttls[i] = int32(binary.BigEndian.Uint32(b[4*i:]))
+	}
+	return ttls, nil
+}
 
-	err = offsetFile.Close()
-	if err != nil {
+// GetUDataBytesFromFile reads the proof data from the proof files and
+// gives the proof & utxo data back.  The TTLs in it are all 0; see
+// readBlockTTLs for the real ones.
+// Don't ask for block 0, there is no proof for that.
+func GetUDataBytesFromFile(proofDir proofDir, height int32) (b []byte, err error) {
+	if height == 0 {
+		err = fmt.Errorf("GetUDataBytesFromFile: Block 0 is not not a thing")
 		return
 	}
-	err = proofFile.Close()
+
+	proofFiles, err := openSplitFile(proofDir.pFiles, 0, true)
 	if err != nil {
 		return
 	}
-	return
+	defer proofFiles.close()
+
+	return proofFiles.readRecord(height)
 }
@@ -0,0 +1,620 @@
+package bridgenode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"os"
+	"path/filepath"
+
+	"github.com/mit-dci/utreexo/btcacc"
+	"github.com/mit-dci/utreexo/util"
+)
+
+/*
+Proof, undo and TTL data are split into numbered files like bitcoind's blk
+files: proof00000.dat, proof00001.dat and so on.  A file is only added to
+until the next block wouldn't fit under the max file size, so each block's
+data is all in one file.  Only the last file is written to, except for TTLs
+which get filled in later.
+
+The index has 8 bytes per block: 4 byte file number, 4 byte offset in that
+file where the block's data starts.  There is no block 0 so the first 8
+bytes are zeros.
+*/
+
+// defaultMaxFileSize is how big the files get unless set, same as blk files
+const defaultMaxFileSize = 128 << 20
+
+// recordMagic starts each proof and undo record.  After it is the 4 byte
+// size of the data, then a 4 byte crc32 of the data, then the data.
+var recordMagic = [4]byte{0xaa, 0xff, 0xaa, 0xfe}
+
+// legacyMagic starts records written before there were checksums.  They
+// have the size then the data, and are still read without checking.
+var legacyMagic = [4]byte{0xaa, 0xff, 0xaa, 0xff}
+
+// recordHeaderSize is how much of a record is before the data
+const recordHeaderSize = 12
+
+// splitPaths is where the files for a splitFile are
+type splitPaths struct {
+	dir       string
+	prefix    string
+	indexFile string
+}
+
+// dataFile is the name of data file num
+func (sp splitPaths) dataFile(num uint32) string {
+	return filepath.Join(sp.dir, fmt.Sprintf("%s%05d.dat", sp.prefix, num))
+}
+
+// filePos is where something is in a splitFile
+type filePos struct {
+	fileNum uint32
+	offset  uint32
+}
+
+// add gives the position n bytes after pos, in the same file
+func (pos filePos) add(n uint32) filePos {
+	return filePos{fileNum: pos.fileNum, offset: pos.offset + n}
+}
+
+// splitFile is per block data split over numbered files
+type splitFile struct {
+	paths   splitPaths
+	maxSize uint32
+	flag    int
+	index   *os.File
+	// data files opened so far
+	files map[uint32]*os.File
+	// where the next block's data goes
+	next filePos
+	// there are no data files before this one
+	firstFile uint32
+}
+
+// openSplitFile opens the index and gets ready to read or add blocks.
+// readOnly ones can't be written to.
+func openSplitFile(paths splitPaths, maxSize uint32, readOnly bool) (
+	*splitFile, error) {
+
+	sf := &splitFile{paths: paths, maxSize: maxSize,
+		files: make(map[uint32]*os.File)}
+	sf.flag = os.O_CREATE | os.O_RDWR
+	if readOnly {
+		sf.flag = os.O_RDONLY
+	}
+	var err error
+	sf.index, err = os.OpenFile(paths.indexFile, sf.flag, 0600)
+	if err != nil {
+		return nil, err
+	}
+	size, err := sf.index.Seek(0, 2)
+	if err != nil {
+		sf.close()
+		return nil, err
+	}
+	if size%8 != 0 {
+		sf.close()
+		return nil, fmt.Errorf("index %s not multiple of 8 bytes",
+			paths.indexFile)
+	}
+	if readOnly {
+		return sf, nil
+	}
+	if size == 0 {
+		// there is no block 0 so leave that empty
+		_, err = sf.index.Write(make([]byte, 8))
+		if err != nil {
+			sf.close()
+			return nil, err
+		}
+		size = 8
+	}
+
+	// the next block goes at the end of the last data file, which is
+	// the one the last block went in unless a newer one was started
+	last, err := sf.pos(int32(size/8) - 1)
+	if err != nil {
+		sf.close()
+		return nil, err
+	}
+	sf.next.fileNum = last.fileNum
+	for util.HasAccess(paths.dataFile(sf.next.fileNum + 1)) {
+		sf.next.fileNum++
+	}
+	stat, err := os.Stat(paths.dataFile(sf.next.fileNum))
+	if err == nil {
+		if stat.Size() > math.MaxUint32 {
+			sf.close()
+			return nil, fmt.Errorf("%s is %d bytes, too big",
+				paths.dataFile(sf.next.fileNum), stat.Size())
+		}
+		sf.next.offset = uint32(stat.Size())
+	} else if !os.IsNotExist(err) {
+		sf.close()
+		return nil, err
+	}
+	return sf, nil
+}
+
+// close closes the index and all the data files
+func (sf *splitFile) close() error {
+	err := sf.closeFiles()
+	if err != nil {
+		return err
+	}
+	return sf.index.Close()
+}
+
+// closeFiles closes the data files
+func (sf *splitFile) closeFiles() error {
+	for num, f := range sf.files {
+		err := f.Close()
+		if err != nil {
+			return err
+		}
+		delete(sf.files, num)
+	}
+	return nil
+}
+
+// height is the last block in the index
+func (sf *splitFile) height() (int32, error) {
+	stat, err := sf.index.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return int32(stat.Size()/8) - 1, nil
+}
+
+// pos reads where a block starts from the index
+func (sf *splitFile) pos(height int32) (filePos, error) {
+	var buf [8]byte
+	_, err := sf.index.ReadAt(buf[:], int64(8*height))
+	if err != nil {
+		return filePos{}, fmt.Errorf("read %s height %d: %s",
+			sf.paths.indexFile, height, err.Error())
+	}
+	return filePos{
+		fileNum: binary.BigEndian.Uint32(buf[0:4]),
+		offset:  binary.BigEndian.Uint32(buf[4:8]),
+	}, nil
+}
+
+// file gets data file num, opening it if it isn't already.  It's only
+// created if create is set, so reading pruned blocks doesn't make empty
+// files.
+func (sf *splitFile) file(num uint32, create bool) (*os.File, error) {
+	f, ok := sf.files[num]
+	if ok {
+		return f, nil
+	}
+	flag := sf.flag
+	if !create {
+		flag &^= os.O_CREATE
+	}
+	f, err := os.OpenFile(sf.paths.dataFile(num), flag, 0600)
+	if err != nil {
+		return nil, err
+	}
+	sf.files[num] = f
+	return f, nil
+}
+
+// alloc finds room for size bytes of data for block height, moving on to
+// a new file if it won't fit in this one, and writes where it is to the
+// index.  It doesn't write anything to the data file.
+func (sf *splitFile) alloc(height int32, size uint32) (filePos, error) {
+	if sf.next.offset != 0 &&
+		uint64(sf.next.offset)+uint64(size) > uint64(sf.maxSize) {
+		sf.next = filePos{fileNum: sf.next.fileNum + 1}
+	}
+	if uint64(sf.next.offset)+uint64(size) > math.MaxUint32 {
+		return filePos{}, fmt.Errorf("h %d %d bytes won't fit in %s",
+			height, size, sf.paths.dataFile(sf.next.fileNum))
+	}
+	pos := sf.next
+
+	var buf [8]byte
+	binary.BigEndian.PutUint32(buf[0:4], pos.fileNum)
+	binary.BigEndian.PutUint32(buf[4:8], pos.offset)
+	_, err := sf.index.WriteAt(buf[:], int64(8*height))
+	if err != nil {
+		return filePos{}, err
+	}
+	sf.next.offset += size
+	return pos, nil
+}
+
+// writeAt writes b to a data file at pos
+func (sf *splitFile) writeAt(b []byte, pos filePos) error {
+	f, err := sf.file(pos.fileNum, true)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteAt(b, int64(pos.offset))
+	return err
+}
+
+// readAt reads len(b) bytes from a data file at pos
+func (sf *splitFile) readAt(b []byte, pos filePos) error {
+	f, err := sf.file(pos.fileNum, false)
+	if err != nil {
+		return err
+	}
+	_, err = f.ReadAt(b, int64(pos.offset))
+	return err
+}
+
+// makeRecord puts the record header on b
+func makeRecord(b []byte) []byte {
+	buf := make([]byte, recordHeaderSize, len(b)+recordHeaderSize)
+	copy(buf[0:4], recordMagic[:])
+	binary.BigEndian.PutUint32(buf[4:8], uint32(len(b)))
+	binary.BigEndian.PutUint32(buf[8:12], crc32.ChecksumIEEE(b))
+	return append(buf, b...)
+}
+
+// writeRecord adds a proof or undo record for block height
+func (sf *splitFile) writeRecord(height int32, b []byte) error {
+	pos, err := sf.alloc(height, uint32(len(b))+recordHeaderSize)
+	if err != nil {
+		return err
+	}
+	return sf.writeAt(makeRecord(b), pos)
+}
+
+// rewriteRecord writes b over the record for block height, for fixing
+// ones that got corrupted.  It has to take up exactly the same space as
+// the old record, so the blocks after it don't move.
+func (sf *splitFile) rewriteRecord(height int32, b []byte) error {
+	pos, size, err := sf.blockSize(height)
+	if err != nil {
+		return err
+	}
+	if uint64(len(b))+recordHeaderSize != uint64(size) {
+		return fmt.Errorf("h %d %d byte record won't fit in %d bytes at %d:%d",
+			height, len(b)+recordHeaderSize, size, pos.fileNum, pos.offset)
+	}
+	return sf.writeAt(makeRecord(b), pos)
+}
+
+// blockSize gives where block height starts and how many bytes it takes
+// up, up to where the next block starts or the end of the file if it's the
+// last block there
+func (sf *splitFile) blockSize(height int32) (filePos, uint32, error) {
+	pos, err := sf.pos(height)
+	if err != nil {
+		return filePos{}, 0, err
+	}
+	tip, err := sf.height()
+	if err != nil {
+		return filePos{}, 0, err
+	}
+	if height < tip {
+		next, err := sf.pos(height + 1)
+		if err != nil {
+			return filePos{}, 0, err
+		}
+		if next.fileNum == pos.fileNum {
+			return pos, next.offset - pos.offset, nil
+		}
+	}
+	f, err := sf.file(pos.fileNum, false)
+	if err != nil {
+		return filePos{}, 0, err
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		return filePos{}, 0, err
+	}
+	if stat.Size() < int64(pos.offset) {
+		return filePos{}, 0, fmt.Errorf("h %d starts at %d:%d, past the end",
+			height, pos.fileNum, pos.offset)
+	}
+	return pos, uint32(stat.Size()) - pos.offset, nil
+}
+
+// readRecord reads the proof or undo record for block height, checking
+// the data against the checksum
+func (sf *splitFile) readRecord(height int32) ([]byte, error) {
+	pos, err := sf.pos(height)
+	if err != nil {
+		return nil, err
+	}
+	var header [8]byte
+	err = sf.readAt(header[:], pos)
+	if err != nil {
+		return nil, err
+	}
+	checked := bytes.Equal(header[:4], recordMagic[:])
+	if !checked && !bytes.Equal(header[:4], legacyMagic[:]) {
+		return nil, fmt.Errorf("expect magic %x but read %x h %d at %d:%d",
+			recordMagic, header[:4], height, pos.fileNum, pos.offset)
+	}
+	size := binary.BigEndian.Uint32(header[4:])
+	if size > 1<<24 {
+		return nil, fmt.Errorf("h %d at %d:%d says %d bytes, too big",
+			height, pos.fileNum, pos.offset, size)
+	}
+	if checked {
+		size += 4
+	}
+	b := make([]byte, size)
+	err = sf.readAt(b, pos.add(8))
+	if err != nil {
+		return nil, err
+	}
+	if !checked {
+		return b, nil
+	}
+	sum := binary.BigEndian.Uint32(b[:4])
+	if crc32.ChecksumIEEE(b[4:]) != sum {
+		return nil, fmt.Errorf("h %d at %d:%d checksum %08x, expect %08x",
+			height, pos.fileNum, pos.offset, crc32.ChecksumIEEE(b[4:]), sum)
+	}
+	return b[4:], nil
+}
+
+// truncate cuts off everything after block height, removing data files
+// that only had later blocks in them
+func (sf *splitFile) truncate(height int32) error {
+	tip, err := sf.height()
+	if err != nil {
+		return err
+	}
+	if tip <= height {
+		return nil
+	}
+	end, err := sf.pos(height + 1)
+	if err != nil {
+		return err
+	}
+	err = sf.closeFiles()
+	if err != nil {
+		return err
+	}
+	err = os.Truncate(sf.paths.dataFile(end.fileNum), int64(end.offset))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	num := end.fileNum + 1
+	for ; util.HasAccess(sf.paths.dataFile(num)); num++ {
+		err = os.Remove(sf.paths.dataFile(num))
+		if err != nil {
+			return err
+		}
+	}
+	sf.next = end
+	return sf.index.Truncate(int64(height+1) * 8)
+}
+
+// prune deletes the data files that only have blocks from before keepFrom.
+// It doesn't touch the index; reading those blocks just fails.
+func (sf *splitFile) prune(keepFrom int32) error {
+	if keepFrom < 1 {
+		return nil
+	}
+	keep, err := sf.pos(keepFrom)
+	if err != nil {
+		return err
+	}
+	for ; sf.firstFile < keep.fileNum; sf.firstFile++ {
+		f, ok := sf.files[sf.firstFile]
+		if ok {
+			f.Close()
+			delete(sf.files, sf.firstFile)
+		}
+		err = os.Remove(sf.paths.dataFile(sf.firstFile))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeSplitFile deletes the index and all the data files
+func removeSplitFile(paths splitPaths) error {
+	err := os.Remove(paths.indexFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for num := uint32(0); util.HasAccess(paths.dataFile(num)); num++ {
+		err = os.Remove(paths.dataFile(num))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migrateSplitFiles moves the proof, undo and TTL data from the single
+// files used before into split files.  The old files are only deleted once
+// everything's been copied, so if it's interrupted it starts over next
+// time.
+func migrateSplitFiles(dir utreeDir, maxSize uint32) error {
+	err := migrateRecords(dir.ProofDir.pFile, dir.ProofDir.pOffsetFile,
+		dir.ProofDir.pFiles, maxSize, reencodeProof)
+	if err != nil {
+		return fmt.Errorf("migrate proofs: %s", err.Error())
+	}
+	err = migrateRecords(dir.UndoDir.undoFile, dir.UndoDir.offsetFile,
+		dir.UndoDir.undoFiles, maxSize, nil)
+	if err != nil {
+		return fmt.Errorf("migrate undo blocks: %s", err.Error())
+	}
+	err = migrateTTLs(dir.TtlDir, maxSize)
+	if err != nil {
+		return fmt.Errorf("migrate ttls: %s", err.Error())
+	}
+	return nil
+}
+
+// migrateRecords copies proof or undo records from an old single file,
+// where the offset file has the 8 byte offset each block starts at.  If
+// convert isn't nil each record goes through it on the way.
+func migrateRecords(fileName, offsetFileName string, paths splitPaths,
+	maxSize uint32, convert func([]byte) ([]byte, error)) error {
+
+	if !util.HasAccess(fileName) {
+		return nil
+	}
+	fmt.Printf("moving %s into %s files\n", fileName, paths.prefix)
+
+	// anything there is from a migration that didn't finish
+	err := removeSplitFile(paths)
+	if err != nil {
+		return err
+	}
+	oldFile, err := os.Open(fileName)
+	if err != nil {
+		return err
+	}
+	defer oldFile.Close()
+	offsetFile, err := os.Open(offsetFileName)
+	if err != nil {
+		return err
+	}
+	defer offsetFile.Close()
+	stat, err := offsetFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	sf, err := openSplitFile(paths, maxSize, false)
+	if err != nil {
+		return err
+	}
+	var header [8]byte
+	for h := int32(1); h < int32(stat.Size()/8); h++ {
+		offset, err := readOffset(offsetFile, int64(h))
+		if err != nil {
+			sf.close()
+			return err
+		}
+		_, err = oldFile.ReadAt(header[:], offset)
+		if err != nil {
+			sf.close()
+			return err
+		}
+		if !bytes.Equal(header[:4], legacyMagic[:]) {
+			sf.close()
+			return fmt.Errorf("h %d offset %d bad magic %x",
+				h, offset, header[:4])
+		}
+		b := make([]byte, binary.BigEndian.Uint32(header[4:]))
+		_, err = oldFile.ReadAt(b, offset+8)
+		if err != nil {
+			sf.close()
+			return err
+		}
+		if convert != nil {
+			b, err = convert(b)
+			if err != nil {
+				sf.close()
+				return fmt.Errorf("h %d %s", h, err.Error())
+			}
+		}
+		err = sf.writeRecord(h, b)
+		if err != nil {
+			sf.close()
+			return err
+		}
+	}
+	err = sf.close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(fileName)
+	if err != nil {
+		return err
+	}
+	return os.Remove(offsetFileName)
+}
+
+// reencodeProof rewrites a proof from the old proof file, which has the
+// leafdatas uncompressed, in the current UData encoding
+func reencodeProof(b []byte) ([]byte, error) {
+	var ud btcacc.UData
+	err := ud.Deserialize(bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	buf := bytes.NewBuffer(make([]byte, 0, ud.SerializeSize()))
+	err = ud.Serialize(buf)
+	return buf.Bytes(), err
+}
+
+// migrateTTLs copies TTLs from the old single file, where the offset file
+// has the 8 byte offset each block ends at
+func migrateTTLs(dir ttlDir, maxSize uint32) error {
+	if !util.HasAccess(dir.ttlsetFile) {
+		return nil
+	}
+	fmt.Printf("moving %s into %s files\n",
+		dir.ttlsetFile, dir.ttlFiles.prefix)
+
+	err := removeSplitFile(dir.ttlFiles)
+	if err != nil {
+		return err
+	}
+	oldFile, err := os.Open(dir.ttlsetFile)
+	if err != nil {
+		return err
+	}
+	defer oldFile.Close()
+	offsetFile, err := os.Open(dir.OffsetFile)
+	if err != nil {
+		return err
+	}
+	defer offsetFile.Close()
+	stat, err := offsetFile.Stat()
+	if err != nil {
+		return err
+	}
+
+	sf, err := openSplitFile(dir.ttlFiles, maxSize, false)
+	if err != nil {
+		return err
+	}
+	start := int64(0)
+	for h := int32(1); h < int32(stat.Size()/8); h++ {
+		end, err := readOffset(offsetFile, int64(h))
+		if err != nil {
+			sf.close()
+			return err
+		}
+		b := make([]byte, end-start)
+		_, err = oldFile.ReadAt(b, start)
+		if err != nil {
+			sf.close()
+			return err
+		}
+		pos, err := sf.alloc(h, uint32(len(b)))
+		if err != nil {
+			sf.close()
+			return err
+		}
+		err = sf.writeAt(b, pos)
+		if err != nil {
+			sf.close()
+			return err
+		}
+		start = end
+	}
+	err = sf.close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Remove(dir.ttlsetFile)
+	if err != nil {
+		return err
+	}
+	return os.Remove(dir.OffsetFile)
+}
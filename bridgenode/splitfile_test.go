@@ -0,0 +1,365 @@
+package bridgenode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/btcacc"
+	"github.com/mit-dci/utreexo/util"
+	uwire "github.com/mit-dci/utreexo/wire"
+)
+
+// testRecord is 20 bytes of data for block h
+func testRecord(h int32) []byte {
+	return bytes.Repeat([]byte{byte(h)}, 20)
+}
+
+func TestSplitFileResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "splittest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	paths := splitPaths{dir: dir, prefix: "test",
+		indexFile: filepath.Join(dir, "index.dat")}
+
+	// records are 32 bytes with the header so 2 fit in a file
+	sf, err := openSplitFile(paths, 64, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for h := int32(1); h <= 6; h++ {
+		err = sf.writeRecord(h, testRecord(h))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = sf.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// picks up after the last file, which is full
+	sf, err = openSplitFile(paths, 64, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sf.writeRecord(7, testRecord(7))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []filePos{{}, {0, 0}, {0, 32}, {1, 0}, {1, 32}, {2, 0},
+		{2, 32}, {3, 0}}
+	for h := int32(1); h <= 7; h++ {
+		pos, err := sf.pos(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pos != expect[h] {
+			t.Fatalf("h %d at %v, expect %v", h, pos, expect[h])
+		}
+		b, err := sf.readRecord(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, testRecord(h)) {
+			t.Fatalf("h %d read %x, expect %x", h, b, testRecord(h))
+		}
+	}
+
+	err = sf.truncate(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sf.close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if util.HasAccess(paths.dataFile(2)) {
+		t.Fatalf("%s still there after truncating", paths.dataFile(2))
+	}
+
+	sf, err = openSplitFile(paths, 64, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sf.close()
+	height, err := sf.height()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if height != 3 {
+		t.Fatalf("height %d after truncating, expect 3", height)
+	}
+	err = sf.writeRecord(4, testRecord(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pos, err := sf.pos(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pos != expect[4] {
+		t.Fatalf("h 4 at %v after truncating, expect %v", pos, expect[4])
+	}
+}
+
+func TestPrune(t *testing.T) {
+	dir, err := ioutil.TempDir("", "splittest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	paths := splitPaths{dir: dir, prefix: "test",
+		indexFile: filepath.Join(dir, "index.dat")}
+
+	// 2 blocks per file, so block 5 is in the third file
+	sf, err := openSplitFile(paths, 64, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sf.close()
+	for h := int32(1); h <= 7; h++ {
+		err = sf.writeRecord(h, testRecord(h))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = sf.prune(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for num := uint32(0); num < 4; num++ {
+		if util.HasAccess(paths.dataFile(num)) != (num >= 2) {
+			t.Fatalf("file %d there %v after pruning",
+				num, util.HasAccess(paths.dataFile(num)))
+		}
+	}
+	_, err = sf.readRecord(4)
+	if !os.IsNotExist(err) {
+		t.Fatalf("read pruned block 4, error %v", err)
+	}
+	_, err = sf.readRecord(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the server won't send blocks from before the window
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go uwire.WriteMessage(client, uwire.MsgGetUData,
+		uwire.GetUBlocksBytes(1, 10))
+	_, payload, err := uwire.ReadMessage(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = serveRange(utreeDir{}, server, newChainTip(2000, false), "",
+		payload, 1000, false, true, false)
+	if err == nil || !strings.HasPrefix(err.Error(), uwire.PrunedReason) {
+		t.Fatalf("serving pruned blocks gave error %v", err)
+	}
+}
+
+func TestMigrateSplitFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "splittest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	utreeDir := initUtreeDir(dir)
+	err = makePaths(utreeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the old layout: proof records with where they start, and ttls with
+	// where they end.  Both start with an offset of 0 for block 0.  The
+	// proofs have no version and uncompressed leafdatas.
+	var proofs, proofOffsets, ttls, ttlOffsets bytes.Buffer
+	var offset [8]byte
+	proofOffsets.Write(offset[:])
+	ttlOffsets.Write(offset[:])
+	expect := make(map[int32]btcacc.UData)
+	for h := int32(1); h <= 5; h++ {
+		ud := btcacc.UData{
+			Height: h,
+			AccProof: accumulator.BatchProof{
+				Targets: []uint64{uint64(h)},
+				Proof:   []accumulator.Hash{{byte(h)}},
+			},
+			Stxos: []btcacc.LeafData{{TxHash: btcacc.Hash{byte(h)},
+				Index: 1, Height: h, Amt: 1e8, PkScript: []byte{0x51}}},
+			TxoTTLs: make([]int32, h),
+		}
+		expect[h] = ud
+		var proof bytes.Buffer
+		binary.Write(&proof, binary.BigEndian, ud.Height)
+		binary.Write(&proof, binary.BigEndian, uint32(len(ud.TxoTTLs)))
+		binary.Write(&proof, binary.BigEndian, ud.TxoTTLs)
+		ud.AccProof.Serialize(&proof)
+		ud.Stxos[0].Serialize(&proof)
+
+		binary.BigEndian.PutUint64(offset[:], uint64(proofs.Len()))
+		proofOffsets.Write(offset[:])
+		proofs.Write(legacyMagic[:])
+		binary.Write(&proofs, binary.BigEndian, uint32(proof.Len()))
+		proofs.Write(proof.Bytes())
+
+		// h outputs
+		for i := int32(0); i < h; i++ {
+			binary.Write(&ttls, binary.BigEndian, 100*h+i)
+		}
+		binary.BigEndian.PutUint64(offset[:], uint64(ttls.Len()))
+		ttlOffsets.Write(offset[:])
+	}
+	for name, b := range map[string][]byte{
+		utreeDir.ProofDir.pFile:       proofs.Bytes(),
+		utreeDir.ProofDir.pOffsetFile: proofOffsets.Bytes(),
+		utreeDir.TtlDir.ttlsetFile:    ttls.Bytes(),
+		utreeDir.TtlDir.OffsetFile:    ttlOffsets.Bytes(),
+	} {
+		err = ioutil.WriteFile(name, b, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = migrateSplitFiles(utreeDir, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if util.HasAccess(utreeDir.ProofDir.pFile) ||
+		util.HasAccess(utreeDir.TtlDir.ttlsetFile) {
+		t.Fatal("old files still there after migrating")
+	}
+
+	// the proofs are in the current encoding now
+	for h := int32(1); h <= 5; h++ {
+		b, err := GetUDataBytesFromFile(utreeDir.ProofDir, h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b[0] != btcacc.UDataVersionCompressed {
+			t.Fatalf("proof %d has version %d", h, b[0])
+		}
+		var ud btcacc.UData
+		err = ud.Deserialize(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(ud, expect[h]) {
+			t.Fatalf("proof %d read %v, expect %v", h, ud, expect[h])
+		}
+	}
+
+	ttlFiles, err := openSplitFile(utreeDir.TtlDir.ttlFiles, 64, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ttlFiles.close()
+	for h := int32(1); h <= 5; h++ {
+		pos, err := ttlFiles.pos(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := int32(0); i < h; i++ {
+			var ttl [4]byte
+			err = ttlFiles.readAt(ttl[:], pos.add(uint32(i)*4))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := int32(binary.BigEndian.Uint32(ttl[:]))
+			if got != 100*h+i {
+				t.Fatalf("h %d ttl %d is %d, expect %d", h, i, got, 100*h+i)
+			}
+		}
+	}
+}
+
+func TestRecordChecksum(t *testing.T) {
+	dir, err := ioutil.TempDir("", "splittest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	paths := splitPaths{dir: dir, prefix: "test",
+		indexFile: filepath.Join(dir, "index.dat")}
+
+	sf, err := openSplitFile(paths, 64, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sf.close()
+	for h := int32(1); h <= 3; h++ {
+		err = sf.writeRecord(h, testRecord(h))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a record from before checksums, which is only read
+	legacy := append(append(legacyMagic[:], 0, 0, 0, 20), testRecord(4)...)
+	pos, err := sf.alloc(4, uint32(len(legacy)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sf.writeAt(legacy, pos)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := sf.readRecord(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, testRecord(4)) {
+		t.Fatalf("legacy record read %x, expect %x", b, testRecord(4))
+	}
+
+	// flip a bit in the data of block 2
+	pos, err = sf.pos(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sf.writeAt([]byte{2 ^ 0x10}, pos.add(recordHeaderSize+5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = sf.readRecord(2)
+	if err == nil {
+		t.Fatal("no error reading corrupt record")
+	}
+
+	// block 2 goes to the end of the first file, and block 3 to where
+	// block 4 starts
+	err = sf.rewriteRecord(2, testRecord(1)[:10])
+	if err == nil {
+		t.Fatal("no error rewriting with a smaller record")
+	}
+	err = sf.rewriteRecord(3, testRecord(9))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sf.rewriteRecord(2, testRecord(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for h, expect := range map[int32][]byte{
+		1: testRecord(1), 2: testRecord(2), 3: testRecord(9)} {
+
+		b, err := sf.readRecord(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(b, expect) {
+			t.Fatalf("h %d read %x, expect %x", h, b, expect)
+		}
+	}
+}
@@ -2,11 +2,21 @@ package bridgenode
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
+	"io/ioutil"
 	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
 	"testing"
 
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/mit-dci/utreexo/btcacc"
+	"github.com/mit-dci/utreexo/util"
 )
 
 func TestSearch(t *testing.T) {
@@ -43,3 +53,209 @@ func TestSearch(t *testing.T) {
 	fmt.Printf("result: %d\n", result)
 
 }
+
+func TestServeTTLs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ttltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	utreeDir := initUtreeDir(filepath.Join(dir, "utreexo"))
+	err = makePaths(utreeDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 2 outputs in each block
+	blocks := writeTestChain(t, dir, utreeDir.OffsetDir.OffsetFile, 3)
+
+	proofFiles, err := openSplitFile(utreeDir.ProofDir.pFiles, 1<<20, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proofFiles.close()
+	for h := int32(1); h <= 3; h++ {
+		var buf bytes.Buffer
+		ud := btcacc.UData{Height: h}
+		err = ud.Serialize(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = proofFiles.writeRecord(h, buf.Bytes())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// the TTL worker has only got to block 2, so 2 and 3 are counted from
+	// the blocks
+	ttlFiles, err := openSplitFile(utreeDir.TtlDir.ttlFiles, 1<<20, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ttlFiles.close()
+	expect := [][]int32{nil, {0x7fffffff, 1}, {0, 0}, {0, 0}}
+	for h := int32(1); h <= 2; h++ {
+		pos, err := ttlFiles.alloc(h, 8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var b [8]byte
+		binary.BigEndian.PutUint32(b[0:4], uint32(expect[h][0]))
+		binary.BigEndian.PutUint32(b[4:8], uint32(expect[h][1]))
+		err = ttlFiles.writeAt(b[:], pos)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for h := int32(1); h <= 3; h++ {
+		for _, compact := range []bool{false, true} {
+			for _, proofOnly := range []bool{false, true} {
+				b, err := getUBlockBytes(utreeDir, dir, h, compact, proofOnly)
+				if err != nil {
+					t.Fatal(err)
+				}
+				r := bytes.NewReader(b)
+				if !proofOnly {
+					var blk wire.MsgBlock
+					err = blk.Deserialize(r)
+					if err != nil {
+						t.Fatal(err)
+					}
+					if blk.BlockHash() != blocks[h-1].BlockHash() {
+						t.Fatalf("h %d sent block %s", h, blk.BlockHash())
+					}
+				}
+				var ud btcacc.UData
+				if compact {
+					err = ud.DeserializeCompact(r,
+						btcutil.NewBlock(&blocks[h-1]))
+				} else {
+					err = ud.Deserialize(r)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !reflect.DeepEqual(ud.TxoTTLs, expect[h]) {
+					t.Fatalf("h %d compact %v ttls %v, expect %v",
+						h, compact, ud.TxoTTLs, expect[h])
+				}
+			}
+		}
+	}
+}
+
+// ttlTestBlocks makes 3 blocks.  Block 2 spends an output of block 1, and
+// block 3 spends an output each of blocks 1 and 2.
+func ttlTestBlocks() []blockAndRev {
+	var bnrs []blockAndRev
+	var spend wire.OutPoint
+	for h := int32(1); h <= 3; h++ {
+		coinbase := wire.NewMsgTx(1)
+		coinbase.AddTxIn(wire.NewTxIn(
+			wire.NewOutPoint(&chainhash.Hash{}, 0xffffffff),
+			[]byte{byte(h), 0x51}, nil))
+		coinbase.AddTxOut(wire.NewTxOut(50e8, []byte{0x51}))
+		coinbase.AddTxOut(wire.NewTxOut(1e8, []byte{0x52}))
+		var b wire.MsgBlock
+		b.AddTransaction(coinbase)
+		bnr := blockAndRev{Height: h}
+
+		switch h {
+		case 2:
+			tx := wire.NewMsgTx(1)
+			tx.AddTxIn(wire.NewTxIn(
+				wire.NewOutPoint(bnrs[0].Blk.Transactions()[0].Hash(), 1),
+				nil, nil))
+			tx.AddTxOut(wire.NewTxOut(1e8, []byte{0x53}))
+			spend = wire.OutPoint{Hash: tx.TxHash(), Index: 0}
+			b.AddTransaction(tx)
+			bnr.Rev.Txs = []*TxUndo{{TxIn: []*TxInUndo{{Height: 1}}}}
+		case 3:
+			tx := wire.NewMsgTx(1)
+			tx.AddTxIn(wire.NewTxIn(
+				wire.NewOutPoint(bnrs[0].Blk.Transactions()[0].Hash(), 0),
+				nil, nil))
+			tx.AddTxIn(wire.NewTxIn(&spend, nil, nil))
+			tx.AddTxOut(wire.NewTxOut(1e8, []byte{0x54}))
+			b.AddTransaction(tx)
+			bnr.Rev.Txs = []*TxUndo{
+				{TxIn: []*TxInUndo{{Height: 1}, {Height: 2}}}}
+		}
+		bnr.Blk = btcutil.NewBlock(&b)
+		bnr.inCount, bnr.outCount, bnr.inSkipList, bnr.outSkipList =
+			util.DedupeBlock(bnr.Blk)
+		bnrs = append(bnrs, bnr)
+	}
+	return bnrs
+}
+
+// runTTLWorkers sends bnrs through the TTL workers and gives back what
+// they found
+func runTTLWorkers(utdir utreeDir, inRam bool,
+	bnrs []blockAndRev) []ttlResultBlock {
+
+	bnrChan := make(chan blockAndRev, len(bnrs))
+	ttlResultChan := make(chan ttlResultBlock, len(bnrs))
+	ttlWait := new(sync.WaitGroup)
+	ttlWait.Add(1)
+	go BNRTTLSpliter(bnrChan, ttlResultChan, utdir, inRam, ttlWait)
+	for _, bnr := range bnrs {
+		bnrChan <- bnr
+	}
+	close(bnrChan)
+	ttlWait.Wait()
+	close(ttlResultChan)
+	var results []ttlResultBlock
+	for res := range ttlResultChan {
+		results = append(results, res)
+	}
+	return results
+}
+
+func TestMemTTL(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ttltest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	bnrs := ttlTestBlocks()
+	expect := []ttlResultBlock{
+		{destroyHeight: 1, results: []ttlResult{}},
+		{destroyHeight: 2, results: []ttlResult{{1, 1}}},
+		{destroyHeight: 3, results: []ttlResult{{1, 0}, {2, 2}}},
+	}
+	var utdirs [2]utreeDir
+	for i, inRam := range []bool{false, true} {
+		utdirs[i] = initUtreeDir(filepath.Join(dir, fmt.Sprintf("%d", i)))
+		err = makePaths(utdirs[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		// stop after block 2 and carry on from there
+		results := runTTLWorkers(utdirs[i], inRam, bnrs[:2])
+		results = append(results, runTTLWorkers(utdirs[i], inRam, bnrs[2:])...)
+		if !reflect.DeepEqual(results, expect) {
+			t.Fatalf("inRam %v results %v, expect %v", inRam, results, expect)
+		}
+	}
+
+	for _, name := range []func(utreeDir) string{
+		func(d utreeDir) string { return d.TtlDir.txidFile },
+		func(d utreeDir) string { return d.TtlDir.txidOffsetFile },
+	} {
+		onDisk, err := ioutil.ReadFile(name(utdirs[0]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		inRam, err := ioutil.ReadFile(name(utdirs[1]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(onDisk) == 0 || !bytes.Equal(onDisk, inRam) {
+			t.Fatalf("%s %x with memttl, expect %x",
+				name(utdirs[1]), inRam, onDisk)
+		}
+	}
+}
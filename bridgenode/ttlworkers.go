@@ -4,41 +4,27 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
-	"os"
-	"path/filepath"
 	"sort"
+	"sync"
 )
 
 // BNRTTLSplit gets a block&rev and splits the input and output sides.  it
 // sends the output side to the txid sorter, and the input side to the
-// ttl lookup worker
+// ttl lookup worker.  With inRam the txid files are kept in memory while
+// it runs.  ttlWait is told when it's done and the files are closed.
 func BNRTTLSpliter(
 	bnrChan chan blockAndRev, ttlResultChan chan ttlResultBlock,
-	utdir utreeDir) {
+	utdir utreeDir, inRam bool, ttlWait *sync.WaitGroup) {
 
-	txidFile, err := os.OpenFile(
-		filepath.Join(utdir.TtlDir.base, "txidFile"),
-		os.O_CREATE|os.O_RDWR, 0600)
-	if err != nil {
-		panic(err)
-	}
-
-	txidOffsetFile, err := os.OpenFile(
-		filepath.Join(utdir.TtlDir.base, "txidOffsetFile"),
-		os.O_CREATE|os.O_RDWR, 0600)
-	if err != nil {
-		panic(err)
-	}
-
-	startOffset, err := txidFile.Seek(0, 2)
+	txidFile, startOffset, err := openTTLStore(utdir.TtlDir.txidFile, inRam)
 	if err != nil {
 		panic(err)
 	}
 	startOffset >>= 3 // divide by 8 to get the offset in miniTxids
 
-	// seek to the end of the offset file as TxidSortWriterWorker will start
-	// appending to it
-	_, err = txidOffsetFile.Seek(0, 2)
+	// TxidSortWriterWorker appends to the offset file
+	txidOffsetFile, _, err := openTTLStore(
+		utdir.TtlDir.txidOffsetFile, inRam)
 	if err != nil {
 		panic(err)
 	}
@@ -50,8 +36,8 @@ func BNRTTLSpliter(
 		writeBlockChan, goChan, startOffset, txidFile, txidOffsetFile)
 
 	// TTLLookupWorker needs to send the final data to the flatFileWorker
-	go TTLLookupWorker(
-		lookupChan, ttlResultChan, goChan, txidFile, txidOffsetFile)
+	go TTLLookupWorker(lookupChan, ttlResultChan, goChan,
+		txidFile, txidOffsetFile, ttlWait)
 
 	for {
 		bnr, open := <-bnrChan
@@ -151,6 +137,8 @@ func TxidSortWriterWorker(
 		}
 		goChan <- true // tell the TTLLookupWorker to start on the block just done
 	}
+	// so the TTLLookupWorker sees there are no more blocks
+	close(goChan)
 }
 
 // TODO: if the utxo is coinbase, don't have to look up position in block
@@ -164,7 +152,7 @@ func TxidSortWriterWorker(
 // TTL lookup worker after its done writing to its files
 func TTLLookupWorker(
 	lChan chan ttlLookupBlock, ttlResultChan chan ttlResultBlock, goChan chan bool,
-	txidFile, txidOffsetFile *os.File) {
+	txidFile, txidOffsetFile ttlStore, ttlWait *sync.WaitGroup) {
 	var seekHeight int32
 	var heightOffset, nextOffset int64
 	var startOffsetBytes, nextOffsetBytes [8]byte
@@ -251,6 +239,7 @@ func TTLLookupWorker(
 	if err != nil {
 		panic(err)
 	}
+	ttlWait.Done()
 }
 
 // actually start with a binary search, easier
@@ -323,7 +312,6 @@ func interpolationSearch(mi miniIn,
 	_, _ = mtx.Seek(guessPos*8, 0)
 	mtx.Read(guessMi.hashprefix[:])
 
-	for {
-	}
+	// TODO not finished; the search loop goes here
 	return
 }
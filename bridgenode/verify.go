@@ -0,0 +1,204 @@
+package bridgenode
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"reflect"
+
+	"github.com/btcsuite/btcutil"
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/btcacc"
+	"github.com/mit-dci/utreexo/util"
+	uwire "github.com/mit-dci/utreexo/wire"
+)
+
+/*
+ReplayProofs checks the proofs the way a CSN would.  It starts a pollard
+with nothing in it and goes through every block: the proof has to prove
+what the block spends against the pollard's roots, then the block is put in
+the pollard.  At the end the pollard's roots have to match the forest's.
+
+Every checkpointInterval blocks the pollard is saved along with the height
+it's at, so next time it can carry on from there.  Delete the checkpoint
+file to start over.
+*/
+
+// checkpointInterval is how many blocks go between saving the pollard
+const checkpointInterval = 10000
+
+// ReplayProofs replays all the proofs through a pollard, starting from the
+// checkpoint if there is one, and gives the first height that's wrong
+func ReplayProofs(cfg *Config) error {
+	err := migrateSplitFiles(cfg.UtreeDir, cfg.maxFileSize)
+	if err != nil {
+		return err
+	}
+	height, err := restoreHeight(cfg)
+	if err != nil {
+		return err
+	}
+
+	var p accumulator.Pollard
+	err = p.SetHasher(cfg.hasher)
+	if err != nil {
+		return err
+	}
+	start, err := restoreCheckpoint(cfg.UtreeDir.ForestDir, height, &p)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("replaying proofs from %d to %d\n", start+1, height)
+
+	proofFiles, err := openSplitFile(cfg.UtreeDir.ProofDir.pFiles, 0, true)
+	if err != nil {
+		return err
+	}
+	defer proofFiles.close()
+	offsetFile, err := os.Open(cfg.UtreeDir.OffsetDir.OffsetFile)
+	if err != nil {
+		return err
+	}
+	defer offsetFile.Close()
+
+	for h := start + 1; h <= height; {
+		blocks, _, err := GetRawBlocksFromDisk(
+			h, height-h+1, offsetFile, cfg.BlockDir)
+		if err != nil {
+			return err
+		}
+		if len(blocks) == 0 {
+			return fmt.Errorf("no block %d in %s", h, cfg.BlockDir)
+		}
+		for i := range blocks {
+			err = replayBlock(&p, proofFiles, btcutil.NewBlock(&blocks[i]), h)
+			if err != nil {
+				return fmt.Errorf("replay h %d: %s", h, err.Error())
+			}
+			if h%checkpointInterval == 0 {
+				fmt.Printf("replayed to h %d\n", h)
+				err = saveCheckpoint(cfg.UtreeDir.ForestDir, h, &p)
+				if err != nil {
+					return err
+				}
+			}
+			h++
+		}
+	}
+
+	forest, err := restoreForest(cfg)
+	if err != nil {
+		return err
+	}
+	if !reflect.DeepEqual(p.GetRoots(), forest.GetRoots()) {
+		return fmt.Errorf("replay h %d: roots %x but forest has %x",
+			height, p.GetRoots(), forest.GetRoots())
+	}
+	fmt.Printf("proofs %d to %d all verify\n", start+1, height)
+	return nil
+}
+
+// replayBlock checks the proof for block height against the pollard, then
+// puts the block in it
+func replayBlock(p *accumulator.Pollard, proofFiles *splitFile,
+	blk *btcutil.Block, height int32) error {
+
+	udb, err := proofFiles.readRecord(height)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("proof pruned, need a checkpoint after it")
+	}
+	if err != nil {
+		return err
+	}
+	var ud btcacc.UData
+	err = ud.Deserialize(bytes.NewReader(udb))
+	if err != nil {
+		return err
+	}
+	if ud.Height != height {
+		return fmt.Errorf("proof is for block %d", ud.Height)
+	}
+
+	// the proof has to be for what the block spends
+	ub := uwire.UBlock{UtreexoData: ud, Block: blk}
+	nl, rows := p.ReconstructStats()
+	err = ub.ProofSanity(nl, rows)
+	if err != nil {
+		return err
+	}
+	delHashes := make([]accumulator.Hash, len(ud.Stxos))
+	for i, stxo := range ud.Stxos {
+		delHashes[i] = stxo.LeafHashWith(p.Hasher())
+	}
+	err = p.IngestBatchProof(delHashes, ud.AccProof)
+	if err != nil {
+		return fmt.Errorf("proof doesn't verify: %s", err.Error())
+	}
+
+	_, outCount, _, outSkip := util.DedupeBlock(blk)
+	adds := uwire.BlockToAddLeaves(
+		blk, nil, outSkip, height, outCount, p.Hasher())
+	return p.Modify(adds, ud.AccProof.Targets)
+}
+
+// restoreCheckpoint reads the pollard and its height from the checkpoint
+// file into p.  If there isn't one, or it's past height, it starts from 0.
+func restoreCheckpoint(dir forestDir, height int32,
+	p *accumulator.Pollard) (int32, error) {
+
+	if !util.HasAccess(dir.checkpointFile) {
+		return 0, nil
+	}
+	f, err := os.Open(dir.checkpointFile)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	var start int32
+	err = binary.Read(f, binary.BigEndian, &start)
+	if err != nil {
+		return 0, err
+	}
+	if start > height {
+		// the proofs got rolled back past it
+		fmt.Printf("checkpoint at %d past the proofs at %d, starting over\n",
+			start, height)
+		return 0, nil
+	}
+	err = p.RestorePollard(f)
+	if err != nil {
+		return 0, fmt.Errorf("checkpoint %s: %s",
+			dir.checkpointFile, err.Error())
+	}
+	return start, nil
+}
+
+// saveCheckpoint writes the height and pollard to the checkpoint file.  It's
+// written to a new file first, so stopping half way doesn't leave a bad one.
+func saveCheckpoint(dir forestDir, height int32, p *accumulator.Pollard) error {
+	var buf bytes.Buffer
+	err := binary.Write(&buf, binary.BigEndian, height)
+	if err != nil {
+		return err
+	}
+	err = p.WritePollard(&buf)
+	if err != nil {
+		return err
+	}
+	tmpName := dir.checkpointFile + ".tmp"
+	f, err := os.Create(tmpName)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(buf.Bytes())
+	if err != nil {
+		f.Close()
+		return err
+	}
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpName, dir.checkpointFile)
+}
@@ -0,0 +1,67 @@
+package bridgenode
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/btcsuite/btcutil"
+	"github.com/mit-dci/utreexo/accumulator"
+)
+
+func TestReplayProofs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verifytest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cfg := buildTestProofs(t, dir, 6, ramForest)
+
+	err = ReplayProofs(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a checkpoint of an empty pollard at 3 ends up with the wrong roots
+	var p accumulator.Pollard
+	err = saveCheckpoint(cfg.UtreeDir.ForestDir, 3, &p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ReplayProofs(cfg)
+	if err == nil {
+		t.Fatal("no error replaying from a bad checkpoint")
+	}
+
+	// a real one at 3 carries on fine
+	proofFiles, err := openSplitFile(cfg.UtreeDir.ProofDir.pFiles, 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proofFiles.close()
+	offsetFile, err := os.Open(cfg.UtreeDir.OffsetDir.OffsetFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer offsetFile.Close()
+	blocks, _, err := GetRawBlocksFromDisk(1, 3, offsetFile, cfg.BlockDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range blocks {
+		err = replayBlock(&p, proofFiles,
+			btcutil.NewBlock(&blocks[i]), int32(i+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = saveCheckpoint(cfg.UtreeDir.ForestDir, 3, &p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ReplayProofs(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+}
@@ -8,6 +8,9 @@ import (
 	"fmt"
 	"io"
 	"strconv"
+
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/compress"
 )
 
 const HashSize = 32
@@ -119,9 +122,117 @@ func (l *LeafData) Deserialize(r io.Reader) (err error) {
 // can use tags for PkScript
 // so it's just height, coinbaseness, amt, pkscript tag
 
-// LeafHash turns a LeafData into a LeafHash
+/*
+Compressed and compact serialization
+
+The compressed serialization is what goes in the proof file and over the
+wire.  It's the outpoint, then the height and coinbase bit as a VLQ, then
+the amount and PkScript compressed the same way Bitcoin Core does in its
+rev files.  The compact serialization is the same without the outpoint.
+
+Neither has the BlockHash, which is always empty for now.  The leaf hash is
+always over the uncompressed Serialize, so the commitment doesn't depend on
+how the leaf was sent.
+*/
+
+// SerializeCompressed puts the compressed LeafData onto a writer
+func (l *LeafData) SerializeCompressed(w io.Writer) (err error) {
+	_, err = w.Write(l.TxHash[:])
+	if err != nil {
+		return
+	}
+	err = compress.WriteVLQ(w, uint64(l.Index))
+	if err != nil {
+		return
+	}
+	return l.SerializeCompact(w)
+}
+
+// SerializeCompressedSize says how big a compressed leafdata is
+func (l *LeafData) SerializeCompressedSize() int {
+	return HashSize + compress.SerializeSizeVLQ(uint64(l.Index)) +
+		l.SerializeCompactSize()
+}
+
+// DeserializeCompressed reads a compressed LeafData
+func (l *LeafData) DeserializeCompressed(r io.Reader) (err error) {
+	_, err = io.ReadFull(r, l.TxHash[:])
+	if err != nil {
+		return
+	}
+	idx, err := compress.ReadVLQ(r)
+	if err != nil {
+		return
+	}
+	if idx > 1<<32-1 {
+		return fmt.Errorf("txout index %d too big", idx)
+	}
+	l.Index = uint32(idx)
+	return l.DeserializeCompact(r)
+}
+
+// SerializeCompact puts LeafData onto a writer without the outpoint, which
+// is already in the block spending it.
+func (l *LeafData) SerializeCompact(w io.Writer) (err error) {
+	if l.BlockHash != [32]byte{} {
+		return fmt.Errorf("%s has a BlockHash, can't serialize compressed",
+			l.OPString())
+	}
+	if len(l.PkScript) > 10000 {
+		return fmt.Errorf("pksize too long")
+	}
+	err = compress.WriteVLQ(w, l.heightCode())
+	if err != nil {
+		return
+	}
+	return compress.WriteCompressedTxOut(w, l.Amt, l.PkScript)
+}
+
+// SerializeCompactSize says how big a compact leafdata is
+func (l *LeafData) SerializeCompactSize() int {
+	return compress.SerializeSizeVLQ(l.heightCode()) +
+		compress.CompressedTxOutSize(uint64(l.Amt), l.PkScript)
+}
+
+// DeserializeCompact reads a compact LeafData.  The outpoint isn't in the
+// compact serialization so TxHash and Index need to be filled in by the
+// caller.
+func (l *LeafData) DeserializeCompact(r io.Reader) (err error) {
+	hcb, err := compress.ReadVLQ(r)
+	if err != nil {
+		return
+	}
+	if hcb>>1 > 1<<31-1 {
+		return fmt.Errorf("height %d too high", hcb>>1)
+	}
+	l.Height = int32(hcb >> 1)
+	l.Coinbase = hcb&1 == 1
+
+	l.Amt, l.PkScript, err = compress.ReadCompressedTxOut(r)
+	return
+}
+
+// heightCode is the height and coinbase bit together, like in rev files
+func (l *LeafData) heightCode() uint64 {
+	hcb := uint64(l.Height) << 1
+	if l.Coinbase {
+		hcb |= 1
+	}
+	return hcb
+}
+
+// LeafHash turns a LeafData into a LeafHash with the DefaultHasher.  Leaves
+// going into a Forest or Pollard need LeafHashWith its hasher.
 func (l *LeafData) LeafHash() [32]byte {
 	var buf bytes.Buffer
 	l.Serialize(&buf)
 	return sha512.Sum512_256(buf.Bytes())
 }
+
+// LeafHashWith is LeafHash but with the given accumulator hasher.  Use the
+// same hasher as the Forest or Pollard the leaf goes into.
+func (l *LeafData) LeafHashWith(h accumulator.Hasher) [32]byte {
+	var buf bytes.Buffer
+	l.Serialize(&buf)
+	return h.Sum(buf.Bytes())
+}
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"fmt"
 	"testing"
+
+	"github.com/mit-dci/utreexo/accumulator"
 )
 
 func TestLeafDataSerialize(t *testing.T) {
@@ -36,3 +38,68 @@ func TestLeafDataSerialize(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestLeafHashWith(t *testing.T) {
+	ld := LeafData{
+		TxHash:   Hash{1, 2, 3, 4},
+		Height:   2,
+		Amt:      3000,
+		PkScript: []byte{1, 2, 3, 4, 5, 6},
+	}
+
+	if ld.LeafHashWith(accumulator.DefaultHasher) != ld.LeafHash() {
+		t.Fatal("LeafHashWith default hasher differs from LeafHash")
+	}
+	if ld.LeafHashWith(accumulator.Sha256Hasher) == ld.LeafHash() {
+		t.Fatal("LeafHashWith sha256 hasher same as LeafHash")
+	}
+}
+
+func TestLeafDataSerializeCompact(t *testing.T) {
+	scripts := [][]byte{
+		// p2pkh
+		append(append([]byte{0x76, 0xa9, 0x14}, make([]byte, 20)...),
+			0x88, 0xac),
+		// p2sh
+		append(append([]byte{0xa9, 0x14}, make([]byte, 20)...), 0x87),
+		// p2wpkh
+		append([]byte{0x00, 0x14}, make([]byte, 20)...),
+		// p2wsh
+		append([]byte{0x00, 0x20}, make([]byte, 32)...),
+		// something else
+		{0x51},
+		{},
+	}
+	for i, pks := range scripts {
+		ld := LeafData{
+			Height:   int32(i) * 100000,
+			Coinbase: i%2 == 0,
+			Amt:      int64(i) * 1e8,
+			PkScript: pks,
+		}
+		var buf bytes.Buffer
+		err := ld.SerializeCompact(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.Len() != ld.SerializeCompactSize() {
+			t.Fatalf("script %d wrote %d bytes but size says %d",
+				i, buf.Len(), ld.SerializeCompactSize())
+		}
+		var check LeafData
+		err = check.DeserializeCompact(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if check.LeafHash() != ld.LeafHash() {
+			t.Fatalf("script %d got back %s expect %s",
+				i, check.ToString(), ld.ToString())
+		}
+	}
+
+	ld := LeafData{BlockHash: [32]byte{1}}
+	err := ld.SerializeCompact(&bytes.Buffer{})
+	if err == nil {
+		t.Fatal("compact serialization dropped the BlockHash")
+	}
+}
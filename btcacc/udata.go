@@ -6,7 +6,10 @@ import (
 	"fmt"
 	"io"
 
+	"github.com/btcsuite/btcutil"
 	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/compress"
+	"github.com/mit-dci/utreexo/util"
 )
 
 type UData struct {
@@ -29,18 +32,35 @@ func (ud *UData) ProofSanity(nl uint64, h uint8) bool {
 	return true
 }
 
+// UData serialization versions.  Serialize starts with the version byte.
+// UDatas from before there was a version start with the 4 byte height, so
+// their first byte is the top byte of the height, which is 0 below 2^24;
+// those get read as UDataVersionRaw.
+const (
+	// UDataVersionRaw has the leafdatas uncompressed, and no version byte
+	UDataVersionRaw = 0
+	// UDataVersionCompressed has compressed leafdatas
+	UDataVersionCompressed = 1
+)
+
 // on disk
 // aaff aaff 0000 0014 0000 0001 0000 0001 0000 0000 0000 0000 0000 0000
 //  magic   |   size  |  height | numttls |   ttl0  | numTgts | (proof)
+// (that's UDataVersionRaw; the others have the version before the height)
 
 // ToBytes serializes UData into bytes.
-// First, height, 4 bytes.
+// First, the version, 1 byte.
+// Then height, 4 bytes.
 // Then, number of TTL values (4 bytes, even though we only need 2)
 // Then a bunch of TTL values, (4B each) one for each txo in the associated block
 // batch proof
-// Bunch of LeafDatas
+// Bunch of compressed LeafDatas
 
 func (ud *UData) Serialize(w io.Writer) (err error) {
+	_, err = w.Write([]byte{UDataVersionCompressed})
+	if err != nil { // ^ 1B version
+		return
+	}
 	err = binary.Write(w, binary.BigEndian, ud.Height)
 	if err != nil { // ^ 4B block height
 		return
@@ -66,7 +86,7 @@ func (ud *UData) Serialize(w io.Writer) (err error) {
 	// write all the leafdatas
 	for _, ld := range ud.Stxos {
 		// fmt.Printf("writing ld %d %s\n", i, ld.ToString())
-		err = ld.Serialize(w)
+		err = ld.SerializeCompressed(w)
 		if err != nil {
 			return
 		}
@@ -84,7 +104,7 @@ func (ud *UData) SerializeSize() int {
 
 	// Grab the size of all the stxos
 	for _, l := range ud.Stxos {
-		ldsize += l.SerializeSize()
+		ldsize += l.SerializeCompressedSize()
 	}
 
 	ud.AccProof.Serialize(&b)
@@ -93,19 +113,36 @@ func (ud *UData) SerializeSize() int {
 			b.Len(), ud.AccProof.SerializeSize())
 	}
 
-	guess := 8 + (4 * len(ud.TxoTTLs)) + ud.AccProof.SerializeSize() + ldsize
+	guess := 9 + (4 * len(ud.TxoTTLs)) + ud.AccProof.SerializeSize() + ldsize
 
-	// 8B height & numTTLs, 4B per TTL, accProof size, leaf sizes
+	// 1B version, 8B height & numTTLs, 4B per TTL, accProof size, leaf sizes
 	return guess
 }
 
+// Deserialize reads a UData written by Serialize, or one from before the
+// version byte with the leafdatas uncompressed.
 func (ud *UData) Deserialize(r io.Reader) (err error) {
-
-	err = binary.Read(r, binary.BigEndian, &ud.Height)
+	// the version, or for UDataVersionRaw the first byte of the height
+	var first [4]byte
+	_, err = io.ReadFull(r, first[:1])
+	if err != nil {
+		fmt.Printf("ud deser version err %s\n", err.Error())
+		return
+	}
+	version := first[0]
+	switch version {
+	case UDataVersionRaw:
+		_, err = io.ReadFull(r, first[1:])
+	case UDataVersionCompressed:
+		_, err = io.ReadFull(r, first[:])
+	default:
+		return fmt.Errorf("ud deser unknown version %d", version)
+	}
 	if err != nil { // ^ 4B block height
 		fmt.Printf("ud deser Height err %s\n", err.Error())
 		return
 	}
+	ud.Height = int32(binary.BigEndian.Uint32(first[:]))
 	// fmt.Printf("read height %d\n", ud.Height)
 
 	var numTTLs uint32
@@ -138,7 +175,11 @@ func (ud *UData) Deserialize(r io.Reader) (err error) {
 	// we've already gotten targets.  1 leafdata per target
 	ud.Stxos = make([]LeafData, len(ud.AccProof.Targets))
 	for i, _ := range ud.Stxos {
-		err = ud.Stxos[i].Deserialize(r)
+		if version == UDataVersionRaw {
+			err = ud.Stxos[i].Deserialize(r)
+		} else {
+			err = ud.Stxos[i].DeserializeCompressed(r)
+		}
 		if err != nil {
 			err = fmt.Errorf(
 				"ud deser h %d nttl %d targets %d UtxoData[%d] err %s\n",
@@ -153,21 +194,187 @@ func (ud *UData) Deserialize(r io.Reader) (err error) {
 	return
 }
 
-// TODO use compact leafDatas in the block proofs -- probably 50%+ space savings
-// Also should be default / the only serialization.  Whenever you've got the
-// block proof, you've also got the block, so should always be OK to omit the
-// data that's already in the block.
+/*
+Compact UData serialization
 
-func UDataFromCompactBytes(b []byte) (UData, error) {
-	var ud UData
+Whenever you've got the block proof, you've also got the block, so the
+outpoints being spent don't need to be sent again.  The compact form is:
+
+  4B height
+  VLQ number of TTLs, then a VLQ for each TTL
+  VLQ number of targets, VLQ number of proof hashes
+  a VLQ for each target, then the 32 byte proof hashes
+  compact leafdatas, one per target, with no outpoints
+
+The outpoints come back from the block in DeserializeCompact.
+*/
+
+// SerializeCompact writes the compact form of the UData
+func (ud *UData) SerializeCompact(w io.Writer) (err error) {
+	err = binary.Write(w, binary.BigEndian, ud.Height)
+	if err != nil {
+		return
+	}
+	err = compress.WriteVLQ(w, uint64(len(ud.TxoTTLs)))
+	if err != nil {
+		return
+	}
+	for _, ttlval := range ud.TxoTTLs {
+		err = compress.WriteVLQ(w, uint64(uint32(ttlval)))
+		if err != nil {
+			return
+		}
+	}
+
+	err = compress.WriteVLQ(w, uint64(len(ud.AccProof.Targets)))
+	if err != nil {
+		return
+	}
+	err = compress.WriteVLQ(w, uint64(len(ud.AccProof.Proof)))
+	if err != nil {
+		return
+	}
+	for _, t := range ud.AccProof.Targets {
+		err = compress.WriteVLQ(w, t)
+		if err != nil {
+			return
+		}
+	}
+	for _, h := range ud.AccProof.Proof {
+		_, err = w.Write(h[:])
+		if err != nil {
+			return
+		}
+	}
+
+	if len(ud.Stxos) != len(ud.AccProof.Targets) {
+		return fmt.Errorf("ud ser h %d %d targets but %d leafdatas",
+			ud.Height, len(ud.AccProof.Targets), len(ud.Stxos))
+	}
+	for _, ld := range ud.Stxos {
+		err = ld.SerializeCompact(w)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
 
-	return ud, nil
+// SerializeCompactSize outputs the size of the compact udata
+func (ud *UData) SerializeCompactSize() int {
+	size := 4 + compress.SerializeSizeVLQ(uint64(len(ud.TxoTTLs)))
+	for _, ttlval := range ud.TxoTTLs {
+		size += compress.SerializeSizeVLQ(uint64(uint32(ttlval)))
+	}
+	size += compress.SerializeSizeVLQ(uint64(len(ud.AccProof.Targets))) +
+		compress.SerializeSizeVLQ(uint64(len(ud.AccProof.Proof)))
+	for _, t := range ud.AccProof.Targets {
+		size += compress.SerializeSizeVLQ(t)
+	}
+	size += 32 * len(ud.AccProof.Proof)
+	for _, ld := range ud.Stxos {
+		size += ld.SerializeCompactSize()
+	}
+	return size
 }
 
-func (ud *UData) ToCompactBytes() (b []byte) {
+// DeserializeCompact reads a compact UData.  blk is the block the UData is
+// for, which the outpoints of the leafdatas are taken from.
+func (ud *UData) DeserializeCompact(
+	r io.Reader, blk *btcutil.Block) (err error) {
+
+	err = binary.Read(r, binary.BigEndian, &ud.Height)
+	if err != nil {
+		return
+	}
+
+	numTTLs, err := compress.ReadVLQ(r)
+	if err != nil {
+		return
+	}
+	// can't have more outputs than bytes in the block
+	if numTTLs > 1<<22 {
+		return fmt.Errorf("ud deser h %d %d ttls - too many",
+			ud.Height, numTTLs)
+	}
+	ud.TxoTTLs = make([]int32, numTTLs)
+	for i := range ud.TxoTTLs {
+		var ttlval uint64
+		ttlval, err = compress.ReadVLQ(r)
+		if err != nil {
+			return
+		}
+		if ttlval > 1<<32-1 {
+			return fmt.Errorf("ud deser h %d ttl %d too big", ud.Height, ttlval)
+		}
+		ud.TxoTTLs[i] = int32(uint32(ttlval))
+	}
+
+	numTargets, err := compress.ReadVLQ(r)
+	if err != nil {
+		return
+	}
+	numHashes, err := compress.ReadVLQ(r)
+	if err != nil {
+		return
+	}
+	if numTargets > 1<<16 || numHashes > 1<<16 {
+		return fmt.Errorf("ud deser h %d %d targets %d hashes - too many",
+			ud.Height, numTargets, numHashes)
+	}
+
+	delOPs := util.BlockToDelOPs(blk)
+	if uint64(len(delOPs)) != numTargets {
+		return fmt.Errorf("ud deser h %d block spends %d but %d targets",
+			ud.Height, len(delOPs), numTargets)
+	}
+
+	ud.AccProof.Targets = make([]uint64, numTargets)
+	for i := range ud.AccProof.Targets {
+		ud.AccProof.Targets[i], err = compress.ReadVLQ(r)
+		if err != nil {
+			return
+		}
+	}
+	ud.AccProof.Proof = make([]accumulator.Hash, numHashes)
+	for i := range ud.AccProof.Proof {
+		_, err = io.ReadFull(r, ud.AccProof.Proof[i][:])
+		if err != nil {
+			return
+		}
+	}
+
+	ud.Stxos = make([]LeafData, numTargets)
+	for i := range ud.Stxos {
+		err = ud.Stxos[i].DeserializeCompact(r)
+		if err != nil {
+			return fmt.Errorf("ud deser h %d UtxoData[%d] err %s",
+				ud.Height, i, err.Error())
+		}
+		ud.Stxos[i].TxHash = Hash(delOPs[i].Hash)
+		ud.Stxos[i].Index = delOPs[i].Index
+	}
 	return
 }
 
+// UDataFromCompactBytes deserializes compact UData bytes for the given block
+func UDataFromCompactBytes(b []byte, blk *btcutil.Block) (UData, error) {
+	var ud UData
+	err := ud.DeserializeCompact(bytes.NewReader(b), blk)
+	return ud, err
+}
+
+// ToCompactBytes serializes the UData in the compact form
+func (ud *UData) ToCompactBytes() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.Grow(ud.SerializeCompactSize())
+	err := ud.SerializeCompact(&buf)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
 // GenUData creates a block proof, calling forest.ProveBatch with the leaf indexes
 // to get a batched inclusion proof from the accumulator. It then adds on the leaf data,
 // to create a block proof which both proves inclusion and gives all utxo data
@@ -180,7 +387,7 @@ func GenUData(delLeaves []LeafData, forest *accumulator.Forest, height int32) (
 	// make slice of hashes from leafdata
 	delHashes := make([]accumulator.Hash, len(ud.Stxos))
 	for i, _ := range ud.Stxos {
-		delHashes[i] = ud.Stxos[i].LeafHash()
+		delHashes[i] = ud.Stxos[i].LeafHashWith(forest.Hasher())
 	}
 	// generate block proof. Errors if the tx cannot be proven
 	// Should never error out with genproofs as it takes
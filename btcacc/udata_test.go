@@ -0,0 +1,178 @@
+package btcacc
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/mit-dci/utreexo/accumulator"
+)
+
+func TestUDataSerialize(t *testing.T) {
+	p2wpkh := append([]byte{0x00, 0x14}, make([]byte, 20)...)
+
+	coinbase := wire.NewMsgTx(1)
+	coinbase.AddTxIn(wire.NewTxIn(
+		wire.NewOutPoint(&chainhash.Hash{}, 0xffffffff), nil, nil))
+	coinbase.AddTxOut(wire.NewTxOut(5e9, p2wpkh))
+
+	spend := wire.NewMsgTx(1)
+	spend.AddTxIn(wire.NewTxIn(
+		wire.NewOutPoint(&chainhash.Hash{1}, 3), nil, nil))
+	spend.AddTxIn(wire.NewTxIn(
+		wire.NewOutPoint(&chainhash.Hash{2}, 0), nil, nil))
+	spend.AddTxOut(wire.NewTxOut(1000, p2wpkh))
+	spend.AddTxOut(wire.NewTxOut(2000, []byte{0x51}))
+
+	var msgBlock wire.MsgBlock
+	msgBlock.AddTransaction(coinbase)
+	msgBlock.AddTransaction(spend)
+	blk := btcutil.NewBlock(&msgBlock)
+
+	ud := UData{
+		Height: 700000,
+		AccProof: accumulator.BatchProof{
+			Targets: []uint64{5, 1 << 40},
+			Proof:   []accumulator.Hash{{7}, {8}, {9}},
+		},
+		Stxos: []LeafData{
+			{TxHash: Hash{1}, Index: 3, Height: 12, Amt: 1500,
+				PkScript: p2wpkh},
+			{TxHash: Hash{2}, Index: 0, Height: 600000, Coinbase: true,
+				Amt: 1500, PkScript: []byte{0x51, 0x52}},
+		},
+		TxoTTLs: []int32{0, 70000, 1},
+	}
+
+	var buf bytes.Buffer
+	err := ud.Serialize(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.Len() != ud.SerializeSize() {
+		t.Fatalf("wrote %d bytes but size says %d",
+			buf.Len(), ud.SerializeSize())
+	}
+	var fromDisk UData
+	err = fromDisk.Deserialize(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(fromDisk, ud) {
+		t.Fatalf("got back %v expect %v", fromDisk, ud)
+	}
+
+	b, err := ud.ToCompactBytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(b) != ud.SerializeCompactSize() {
+		t.Fatalf("wrote %d bytes but size says %d",
+			len(b), ud.SerializeCompactSize())
+	}
+	if len(b) >= ud.SerializeSize() {
+		t.Fatalf("compact %d bytes but regular %d", len(b), ud.SerializeSize())
+	}
+
+	check, err := UDataFromCompactBytes(b, blk)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(check, ud) {
+		t.Fatalf("got back %v expect %v", check, ud)
+	}
+
+	// a block that spends something else gets the wrong number of targets
+	spend.TxIn = spend.TxIn[:1]
+	_, err = UDataFromCompactBytes(b, btcutil.NewBlock(&msgBlock))
+	if err == nil {
+		t.Fatal("compact udata accepted for the wrong block")
+	}
+}
+
+// UDatas written before the version byte, with uncompressed leafdatas, still
+// read back, and unknown versions don't.
+func TestUDataDeserializeVersions(t *testing.T) {
+	ud := UData{
+		Height: 1234,
+		AccProof: accumulator.BatchProof{
+			Targets: []uint64{3},
+			Proof:   []accumulator.Hash{{5}, {6}},
+		},
+		Stxos: []LeafData{{TxHash: Hash{1}, Index: 2, Height: 1000,
+			Amt: 1e8, PkScript: []byte{0x51}}},
+		TxoTTLs: []int32{0, 9},
+	}
+
+	// what Serialize used to write
+	var raw bytes.Buffer
+	binary.Write(&raw, binary.BigEndian, ud.Height)
+	binary.Write(&raw, binary.BigEndian, uint32(len(ud.TxoTTLs)))
+	binary.Write(&raw, binary.BigEndian, ud.TxoTTLs)
+	ud.AccProof.Serialize(&raw)
+	ud.Stxos[0].Serialize(&raw)
+	rawBytes := raw.Bytes()
+
+	var old UData
+	err := old.Deserialize(&raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(old, ud) {
+		t.Fatalf("got back %v expect %v", old, ud)
+	}
+
+	var buf bytes.Buffer
+	err = ud.Serialize(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buf.Bytes()[0] != UDataVersionCompressed {
+		t.Fatalf("serialized with version %d", buf.Bytes()[0])
+	}
+	if buf.Len() >= len(rawBytes) {
+		t.Fatalf("compressed %d bytes but raw %d", buf.Len(), len(rawBytes))
+	}
+
+	b := buf.Bytes()
+	b[0] = 0x7f
+	var unknown UData
+	err = unknown.Deserialize(bytes.NewReader(b))
+	if err == nil {
+		t.Fatal("read a UData with an unknown version")
+	}
+}
+
+// GenUData proves the leaves hashed with the forest's hasher
+func TestGenUDataHasher(t *testing.T) {
+	f := accumulator.NewForest(accumulator.RamForest, nil, "", 0)
+	err := f.SetHasher(accumulator.TaggedSha256Hasher)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lds := make([]LeafData, 5)
+	adds := make([]accumulator.Leaf, len(lds))
+	for i := range lds {
+		lds[i] = LeafData{TxHash: Hash{byte(i)}, Height: 1, Amt: 1e8,
+			PkScript: []byte{0x51}}
+		adds[i].Hash = lds[i].LeafHashWith(accumulator.TaggedSha256Hasher)
+	}
+	_, err = f.Modify(adds, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ud, err := GenUData(lds[1:3], f, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.VerifyBatchProof(
+		[]accumulator.Hash{adds[1].Hash, adds[2].Hash}, ud.AccProof)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
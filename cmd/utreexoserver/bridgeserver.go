@@ -20,14 +20,39 @@ func main() {
 	// by collecting garbage early.
 	debug.SetGCPercent(20)
 
+	// fsck, repair and verify check the proof data instead of running the
+	// server
+	args := os.Args[1:]
+	var subCmd string
+	if len(args) > 0 {
+		switch args[0] {
+		case "fsck", "repair", "verify":
+			subCmd, args = args[0], args[1:]
+		}
+	}
+
 	// parse the config
-	cfg, err := bridge.Parse(os.Args[1:])
+	cfg, err := bridge.Parse(args)
 	if err != nil {
 		fmt.Println(err)
 		fmt.Println(bridge.HelpMsg)
 		os.Exit(1)
 	}
 
+	if subCmd != "" {
+		switch subCmd {
+		case "verify":
+			err = bridge.ReplayProofs(cfg)
+		default:
+			err = bridge.Fsck(cfg, subCmd == "repair")
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	// listen for SIGINT, SIGTERM, or SIGQUIT from the os
 	sig := make(chan bool, 1)
 	handleIntSig(sig, cfg)
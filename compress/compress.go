@@ -1,4 +1,7 @@
-package bridgenode
+// Package compress has the Bitcoin Core style VLQ, amount and script
+// compression used in rev*.dat files, along with io.Reader / io.Writer
+// versions of them for utreexo's own data.
+package compress
 
 /*
  * Taken from github.com/btcsuite/btcd/blockchain/compress.go with
@@ -56,10 +59,10 @@ import (
 //   http://www.codecodex.com/wiki/Variable-Length_Integers
 // -----------------------------------------------------------------------------
 
-// serializeSizeVLQ returns the number of bytes it would take to serialize the
+// SerializeSizeVLQ returns the number of bytes it would take to serialize the
 // passed number as a variable-length quantity according to the format described
 // above.
-func serializeSizeVLQ(n uint64) int {
+func SerializeSizeVLQ(n uint64) int {
 	size := 1
 	for ; n > 0x7f; n = (n >> 7) - 1 {
 		size++
@@ -68,12 +71,12 @@ func serializeSizeVLQ(n uint64) int {
 	return size
 }
 
-// putVLQ serializes the provided number to a variable-length quantity according
+// PutVLQ serializes the provided number to a variable-length quantity according
 // to the format described above and returns the number of bytes of the encoded
 // value.  The result is placed directly into the passed byte slice which must
 // be at least large enough to handle the number of bytes returned by the
-// serializeSizeVLQ function or it will panic.
-func putVLQ(target []byte, n uint64) int {
+// SerializeSizeVLQ function or it will panic.
+func PutVLQ(target []byte, n uint64) int {
 	offset := 0
 	for ; ; offset++ {
 		// The high bit is set when another byte follows.
@@ -97,12 +100,12 @@ func putVLQ(target []byte, n uint64) int {
 	return offset + 1
 }
 
-// deserializeVLQ deserializes the provided variable-length quantity according
+// DeserializeVLQ deserializes the provided variable-length quantity according
 // to the format described above.  It also returns the number of bytes
 // deserialized.
 // NOTE: This func is modified from btcd to take in io.Reader as an argument instead
 // of a byte slice
-func deserializeVLQ(r io.Reader) (int64, int) {
+func DeserializeVLQ(r io.Reader) (int64, int) {
 	var n int64
 	var size int
 	for {
@@ -253,9 +256,9 @@ func isPubKey(script []byte) (bool, []byte) {
 	return false, nil
 }
 
-// compressedScriptSize returns the number of bytes the passed script would take
+// CompressedScriptSize returns the number of bytes the passed script would take
 // when encoded with the domain specific compression algorithm described above.
-func compressedScriptSize(pkScript []byte) int {
+func CompressedScriptSize(pkScript []byte) int {
 	// Pay-to-pubkey-hash script.
 	if valid, _ := isPubKeyHash(pkScript); valid {
 		return 21
@@ -274,18 +277,18 @@ func compressedScriptSize(pkScript []byte) int {
 	// When none of the above special cases apply, encode the script as is
 	// preceded by the sum of its size and the number of special cases
 	// encoded as a variable length quantity.
-	return serializeSizeVLQ(uint64(len(pkScript)+numSpecialScripts)) +
+	return SerializeSizeVLQ(uint64(len(pkScript)+numSpecialScripts)) +
 		len(pkScript)
 }
 
-// decodeCompressedScriptSize treats the passed serialized bytes as a compressed
+// DecodeCompressedScriptSize treats the passed serialized bytes as a compressed
 // script, possibly followed by other data, and returns the number of bytes it
 // occupies taking into account the special encoding of the script size by the
 // domain specific compression algorithm described above.
 // NOTE: This func is modified from btcd to take in io.Reader as an argument instead
 // of a byte slice
-func decodeCompressedScriptSize(r io.Reader) int {
-	scriptSize, bytesRead := deserializeVLQ(r)
+func DecodeCompressedScriptSize(r io.Reader) int {
+	scriptSize, bytesRead := DeserializeVLQ(r)
 	if bytesRead == 0 {
 		return 0
 	}
@@ -307,12 +310,12 @@ func decodeCompressedScriptSize(r io.Reader) int {
 	return int(scriptSize)
 }
 
-// putCompressedScript compresses the passed script according to the domain
+// PutCompressedScript compresses the passed script according to the domain
 // specific compression algorithm described above directly into the passed
 // target byte slice.  The target byte slice must be at least large enough to
-// handle the number of bytes returned by the compressedScriptSize function or
+// handle the number of bytes returned by the CompressedScriptSize function or
 // it will panic.
-func putCompressedScript(target, pkScript []byte) int {
+func PutCompressedScript(target, pkScript []byte) int {
 	// Pay-to-pubkey-hash script.
 	if valid, hash := isPubKeyHash(pkScript); valid {
 		target[0] = cstPayToPubKeyHash
@@ -348,23 +351,23 @@ func putCompressedScript(target, pkScript []byte) int {
 	// script preceded by the sum of its size and the number of special
 	// cases encoded as a variable length quantity.
 	encodedSize := uint64(len(pkScript) + numSpecialScripts)
-	vlqSizeLen := putVLQ(target, encodedSize)
+	vlqSizeLen := PutVLQ(target, encodedSize)
 	copy(target[vlqSizeLen:], pkScript)
 	return vlqSizeLen + len(pkScript)
 }
 
-// decompressScript returns the original script obtained by decompressing the
+// DecompressScript returns the original script obtained by decompressing the
 // passed compressed script according to the domain specific compression
 // algorithm described above.
 //
 // NOTE: The script parameter must already have been proven to be long enough
-// to contain the number of bytes returned by decodeCompressedScriptSize or it
-// will panic.  This is acceptable since it is only an internal function.
+// to contain the number of bytes returned by DecodeCompressedScriptSize or it
+// will panic.  Use ReadCompressedScript for data that isn't trusted.
 // NOTE(kcalvinalvin): This func is modified from btcd to take in io.Reader as
 // an argument instead of a byte slice
-func decompressScript(compressedPkScript io.Reader) []byte {
+func DecompressScript(compressedPkScript io.Reader) []byte {
 	// Decode the script size and examine it for the special cases.
-	encodedScriptSize, _ := deserializeVLQ(compressedPkScript)
+	encodedScriptSize, _ := DeserializeVLQ(compressedPkScript)
 	switch encodedScriptSize {
 	// Pay-to-pubkey-hash script.  The resulting script is:
 	// <OP_DUP><OP_HASH160><20 byte hash><OP_EQUALVERIFY><OP_CHECKSIG>
@@ -494,9 +497,9 @@ func decompressScript(compressedPkScript io.Reader) []byte {
 //   1000000000 (5) -> 10       (1)           * 10.00000000 BTC
 // -----------------------------------------------------------------------------
 
-// compressTxOutAmount compresses the passed amount according to the domain
+// CompressTxOutAmount compresses the passed amount according to the domain
 // specific compression algorithm described above.
-func compressTxOutAmount(amount uint64) uint64 {
+func CompressTxOutAmount(amount uint64) uint64 {
 	// No need to do any work if it's zero.
 	if amount == 0 {
 		return 0
@@ -523,10 +526,10 @@ func compressTxOutAmount(amount uint64) uint64 {
 	return 10 + 10*(amount-1)
 }
 
-// decompressTxOutAmount returns the original amount the passed compressed
+// DecompressTxOutAmount returns the original amount the passed compressed
 // amount represents according to the domain specific compression algorithm
 // described above.
-func decompressTxOutAmount(amount int64) int64 {
+func DecompressTxOutAmount(amount int64) int64 {
 	// No need to do any work if it's zero.
 	if amount == 0 {
 		return 0
@@ -577,20 +580,20 @@ func decompressTxOutAmount(amount int64) int64 {
 //     compressed script   []byte   variable
 // -----------------------------------------------------------------------------
 
-// compressedTxOutSize returns the number of bytes the passed transaction output
+// CompressedTxOutSize returns the number of bytes the passed transaction output
 // fields would take when encoded with the format described above.
-func compressedTxOutSize(amount uint64, pkScript []byte) int {
-	return serializeSizeVLQ(compressTxOutAmount(amount)) +
-		compressedScriptSize(pkScript)
+func CompressedTxOutSize(amount uint64, pkScript []byte) int {
+	return SerializeSizeVLQ(CompressTxOutAmount(amount)) +
+		CompressedScriptSize(pkScript)
 }
 
-// putCompressedTxOut compresses the passed amount and script according to their
+// PutCompressedTxOut compresses the passed amount and script according to their
 // domain specific compression algorithms and encodes them directly into the
 // passed target byte slice with the format described above.  The target byte
 // slice must be at least large enough to handle the number of bytes returned by
-// the compressedTxOutSize function or it will panic.
-func putCompressedTxOut(target []byte, amount uint64, pkScript []byte) int {
-	offset := putVLQ(target, compressTxOutAmount(amount))
-	offset += putCompressedScript(target[offset:], pkScript)
+// the CompressedTxOutSize function or it will panic.
+func PutCompressedTxOut(target []byte, amount uint64, pkScript []byte) int {
+	offset := PutVLQ(target, CompressTxOutAmount(amount))
+	offset += PutCompressedScript(target[offset:], pkScript)
 	return offset
 }
@@ -0,0 +1,95 @@
+package compress
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/btcsuite/btcd/btcec"
+)
+
+func TestVLQ(t *testing.T) {
+	tests := []struct {
+		n   uint64
+		ser []byte
+	}{
+		{0, []byte{0x00}},
+		{127, []byte{0x7f}},
+		{128, []byte{0x80, 0x00}},
+		{16511, []byte{0xff, 0x7f}},
+		{2113663, []byte{0xff, 0xff, 0x7f}},
+		{1<<64 - 1, []byte{0x80, 0xfe, 0xfe, 0xfe, 0xfe, 0xfe, 0xfe, 0xfe,
+			0xfe, 0x7f}},
+	}
+	for _, test := range tests {
+		var buf bytes.Buffer
+		err := WriteVLQ(&buf, test.n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), test.ser) {
+			t.Fatalf("%d wrote %x expect %x", test.n, buf.Bytes(), test.ser)
+		}
+		n, err := ReadVLQ(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != test.n {
+			t.Fatalf("read %d expect %d", n, test.n)
+		}
+	}
+
+	_, err := ReadVLQ(bytes.NewReader([]byte{0x80, 0x80}))
+	if err == nil {
+		t.Fatal("read a VLQ that ran out")
+	}
+	_, err = ReadVLQ(bytes.NewReader(bytes.Repeat([]byte{0xff}, 11)))
+	if err == nil {
+		t.Fatal("read a VLQ that overflows")
+	}
+}
+
+func TestCompressedTxOut(t *testing.T) {
+	_, pub := btcec.PrivKeyFromBytes(btcec.S256(), []byte{1})
+
+	scripts := [][]byte{
+		// p2pkh
+		append(append([]byte{0x76, 0xa9, 0x14}, make([]byte, 20)...),
+			0x88, 0xac),
+		// p2sh
+		append(append([]byte{0xa9, 0x14}, make([]byte, 20)...), 0x87),
+		// p2pk, compressed and not
+		append(append([]byte{0x21}, pub.SerializeCompressed()...), 0xac),
+		append(append([]byte{0x41}, pub.SerializeUncompressed()...), 0xac),
+		// p2wpkh
+		append([]byte{0x00, 0x14}, make([]byte, 20)...),
+		{},
+	}
+	for i, pks := range scripts {
+		amt := int64(i) * 123456789
+		var buf bytes.Buffer
+		err := WriteCompressedTxOut(&buf, amt, pks)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if buf.Len() != CompressedTxOutSize(uint64(amt), pks) {
+			t.Fatalf("script %d wrote %d bytes expect %d", i, buf.Len(),
+				CompressedTxOutSize(uint64(amt), pks))
+		}
+		ser := buf.Bytes()
+
+		checkAmt, checkPks, err := ReadCompressedTxOut(bytes.NewReader(ser))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if checkAmt != amt || !bytes.Equal(checkPks, pks) {
+			t.Fatalf("script %d got back %d %x expect %d %x",
+				i, checkAmt, checkPks, amt, pks)
+		}
+
+		// cut short it should error, not panic
+		_, _, err = ReadCompressedTxOut(bytes.NewReader(ser[:len(ser)-1]))
+		if err == nil {
+			t.Fatalf("script %d read when cut short", i)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package compress
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+)
+
+// The functions in compress.go work on byte slices that are already known
+// to be long enough, and don't report read errors.  These wrap them for
+// reading and writing streams where the data might be short or garbage.
+
+// maxScriptSize is the largest script ReadCompressedScript will read.
+// Same as the limit for LeafData PkScripts.
+const maxScriptSize = 10000
+
+// WriteVLQ writes n as a VLQ
+func WriteVLQ(w io.Writer, n uint64) error {
+	var buf [10]byte
+	_, err := w.Write(buf[:PutVLQ(buf[:], n)])
+	return err
+}
+
+// ReadVLQ reads a VLQ.  Unlike DeserializeVLQ, it returns an error if the
+// reader runs out or the number doesn't fit in 64 bits.
+func ReadVLQ(r io.Reader) (uint64, error) {
+	var n uint64
+	var b [1]byte
+	for {
+		_, err := io.ReadFull(r, b[:])
+		if err != nil {
+			return 0, err
+		}
+		if n > (1<<64-1)>>7 {
+			return 0, fmt.Errorf("VLQ too long")
+		}
+		n = (n << 7) | uint64(b[0]&0x7f)
+		if b[0]&0x80 != 0x80 {
+			return n, nil
+		}
+		n++
+	}
+}
+
+// WriteCompressedTxOut writes the compressed amount and script
+func WriteCompressedTxOut(w io.Writer, amount int64, pkScript []byte) error {
+	buf := make([]byte, CompressedTxOutSize(uint64(amount), pkScript))
+	PutCompressedTxOut(buf, uint64(amount), pkScript)
+	_, err := w.Write(buf)
+	return err
+}
+
+// ReadCompressedTxOut reads an amount and script written by
+// WriteCompressedTxOut
+func ReadCompressedTxOut(r io.Reader) (
+	amount int64, pkScript []byte, err error) {
+
+	camt, err := ReadVLQ(r)
+	if err != nil {
+		return
+	}
+	if camt > 1<<63-1 {
+		err = fmt.Errorf("compressed amount %d too big", camt)
+		return
+	}
+	amount = DecompressTxOutAmount(int64(camt))
+	pkScript, err = ReadCompressedScript(r)
+	return
+}
+
+// ReadCompressedScript reads a compressed script, checking that it's all
+// there before decompressing it
+func ReadCompressedScript(r io.Reader) ([]byte, error) {
+	encodedSize, err := ReadVLQ(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var dataLen uint64
+	switch encodedSize {
+	case cstPayToPubKeyHash, cstPayToScriptHash:
+		dataLen = 20
+	case cstPayToPubKeyComp2, cstPayToPubKeyComp3, cstPayToPubKeyUncomp4,
+		cstPayToPubKeyUncomp5:
+		dataLen = 32
+	default:
+		dataLen = encodedSize - numSpecialScripts
+		if dataLen > maxScriptSize {
+			return nil, fmt.Errorf("script size %d too long", dataLen)
+		}
+	}
+
+	// put the size back in front of the data so DecompressScript can
+	// read it all from memory
+	buf := make([]byte, SerializeSizeVLQ(encodedSize)+int(dataLen))
+	n := PutVLQ(buf, encodedSize)
+	_, err = io.ReadFull(r, buf[n:])
+	if err != nil {
+		return nil, err
+	}
+
+	pkScript := DecompressScript(bytes.NewReader(buf))
+	if pkScript == nil {
+		return nil, fmt.Errorf("invalid compressed pubkey %x", buf[n:])
+	}
+	return pkScript, nil
+}
@@ -0,0 +1,24 @@
+package csn
+
+import (
+	"github.com/btcsuite/btcutil"
+	"github.com/mit-dci/utreexo/bridgenode"
+)
+
+// blkDirSource reads blocks out of a bitcoind blocks directory, using an
+// offset file made by a bridge node for the same blocks.  It lets the CSN
+// get only proofs from the bridge server.
+type blkDirSource struct {
+	blockDir   string
+	offsetFile string
+}
+
+// GetBlock reads the block at height from the blk files
+func (s blkDirSource) GetBlock(height int32) (*btcutil.Block, error) {
+	b, err := bridgenode.GetBlockBytesFromFile(
+		height, s.offsetFile, s.blockDir)
+	if err != nil {
+		return nil, err
+	}
+	return btcutil.NewBlockFromBytes(b)
+}
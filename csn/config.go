@@ -5,10 +5,15 @@ import (
 	"strings"
 
 	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/mit-dci/utreexo/accumulator"
+	uwire "github.com/mit-dci/utreexo/wire"
 )
 
 var PollardFilePath string = "pollardFile"
 
+// maxReorgDepth is how many blocks the pollard keeps undo history for
+const maxReorgDepth = 100
+
 var HelpMsg = `
 Usage: client [OPTION]
 A dynamic hash based accumulator designed for the Bitcoin UTXO set.
@@ -23,8 +28,24 @@ OPTIONS:
   -cpuprof                     configure whether to use use cpu profiling
   -memprof                     configure whether to use use heap profiling
 
-  -host                        server to connect to.  Default to localhost
-                               if you need a public server, try 35.188.186.244
+  -host                        servers to connect to, separated by commas.
+                               If one fails the next is tried.  Default to
+                               localhost.  If you need a public server, try
+                               35.188.186.244
+  -hashmode                    parent hash mode (legacy, rowcommit). Must match
+                               the server's. Defaults to legacy.
+  -compact                     ask the server for compact proofs, which leave
+                               out what's already in the block.
+  -blockdir                    read blocks from this bitcoind blocks directory
+                               and only get proofs from the server.  Needs
+                               -offsetfile.
+  -offsetfile                  a bridge node offsetfile.dat for -blockdir
+  -assumeutreexo               start from these roots instead of from the
+                               first block, if there's no pollardFile yet.
+                               Given as height:hasher:numleaves:roots:digest,
+                               like the client prints when it stops.  The
+                               hasher has to match -hashmode.  Outputs
+                               before the height aren't seen by -watchaddr.
 `
 
 // bit of a hack. Standard flag lib doesn't allow flag.Parse(os.Args[2]).
@@ -42,12 +63,23 @@ var (
 	watchAddr = argCmd.String("watchaddr", "",
 		`Address to watch & report transactions. Only bech32 p2wpkh supported`)
 	remoteHost = argCmd.String("host", "127.0.0.1",
-		`remote server to connect to`)
+		`remote servers to connect to, separated by commas`)
 
 	checkSig = argCmd.Bool("checksig", true,
 		`check signatures (slower)`)
 	lookahead = argCmd.Int("lookahead", 1000,
 		`size of the look-ahead cache in blocks`)
+	hashModeCmd = argCmd.String("hashmode", "legacy",
+		`parent hash mode the server uses (legacy, rowcommit)`)
+	compactCmd = argCmd.Bool("compact", false,
+		`ask for compact proofs (server needs to support them)`)
+	blockDirCmd = argCmd.String("blockdir", "",
+		`get blocks from this directory and only proofs from the server`)
+	offsetFileCmd = argCmd.String("offsetfile", "",
+		`bridge node offset file for the blocks in blockdir`)
+	assumeUtreexoCmd = argCmd.String("assumeutreexo", "",
+		`start from the roots after a block, `+
+			`height:hasher:numleaves:roots:digest`)
 	quitafter = argCmd.Int("quitafter", -1,
 		`quit ibd after n blocks. (for testing)`)
 	profServerCmd = argCmd.String("profserver", "",
@@ -57,8 +89,8 @@ var (
 type Config struct {
 	params chaincfg.Params
 
-	// host server
-	remoteHost string
+	// host servers, tried in order
+	remoteHosts []string
 
 	// address to watch for txs
 	watchAddr string
@@ -72,6 +104,20 @@ type Config struct {
 	// Check Bitcoin tx signatures
 	checkSig bool
 
+	// hasher for the pollard. Needs to match the server's.
+	hasher accumulator.Hasher
+
+	// ask for compact udata
+	compact bool
+
+	// if set, blocks come from here and only udata from the server
+	blockDir   string
+	offsetFile string
+
+	// if set, a new pollard starts from these roots instead of from
+	// the first block
+	assumeUtreexo *uwire.Roots
+
 	// enable tracing
 	TraceProf string
 
@@ -102,19 +148,46 @@ func Parse(args []string) (*Config, error) {
 		return nil, errInvalidNetwork(*netCmd)
 	}
 
-	cfg.remoteHost = *remoteHost
 	cfg.watchAddr = *watchAddr
 	cfg.lookAhead = *lookahead
 	cfg.quitafter = *quitafter
 	cfg.checkSig = *checkSig
+	cfg.compact = *compactCmd
+	cfg.blockDir = *blockDirCmd
+	cfg.offsetFile = *offsetFileCmd
+	if cfg.blockDir != "" && cfg.offsetFile == "" {
+		return nil, ErrNoOffsetFile
+	}
+	if *assumeUtreexoCmd != "" {
+		roots, err := uwire.RootsFromString(*assumeUtreexoCmd)
+		if err != nil {
+			return nil, errBadAssumeUtreexo(err)
+		}
+		cfg.assumeUtreexo = &roots
+	}
+
+	switch *hashModeCmd {
+	case "legacy":
+		cfg.hasher = accumulator.DefaultHasher
+	case "rowcommit":
+		cfg.hasher = accumulator.RowCommitting(accumulator.DefaultHasher)
+	default:
+		return nil, errWrongHashMode(*hashModeCmd)
+	}
 
 	// if no host was given, default to localhost
 	if *remoteHost == "" {
-		cfg.remoteHost = "127.0.0.1:8338"
+		cfg.remoteHosts = []string{"127.0.0.1:8338"}
 	} else {
-		if !strings.ContainsRune(*remoteHost, ':') {
-			str := *remoteHost + ":8338"
-			cfg.remoteHost = str
+		for _, host := range strings.Split(*remoteHost, ",") {
+			host = strings.TrimSpace(host)
+			if host == "" {
+				continue
+			}
+			if !strings.ContainsRune(host, ':') {
+				host += ":8338"
+			}
+			cfg.remoteHosts = append(cfg.remoteHosts, host)
 		}
 	}
 
@@ -7,8 +7,19 @@ import (
 
 var (
 	ErrInvalidNetwork = errors.New("Invalid/not supported net flag given")
+	ErrWrongHashMode  = errors.New("Invalid hash mode of")
+	ErrNoOffsetFile   = errors.New("-blockdir needs an -offsetfile too")
+	ErrAssumeUtreexo  = errors.New("Invalid -assumeutreexo")
 )
 
 func errInvalidNetwork(nType string) error {
 	return fmt.Errorf("%s: %s", ErrInvalidNetwork, nType)
 }
+
+func errWrongHashMode(mode string) error {
+	return fmt.Errorf("%s: %s", ErrWrongHashMode, mode)
+}
+
+func errBadAssumeUtreexo(err error) error {
+	return fmt.Errorf("%s: %s", ErrAssumeUtreexo, err.Error())
+}
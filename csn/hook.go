@@ -4,6 +4,7 @@ import (
 	"fmt"
 
 	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/wire"
 	"github.com/mit-dci/utreexo/accumulator"
 	"github.com/mit-dci/utreexo/btcacc"
@@ -50,9 +51,25 @@ type Csn struct {
 	CheckSignatures bool
 	Params          chaincfg.Params
 
-	remoteHost string
-	utxoStore  map[wire.OutPoint]btcacc.LeafData
-	totalScore int64
+	remoteHosts []string
+	utxoStore   map[wire.OutPoint]btcacc.LeafData
+	totalScore  int64
+
+	// tip is the hash of the last block put in the pollard, so we can tell
+	// when the next one doesn't build on it.  All zeros if we don't know.
+	tip chainhash.Hash
+
+	// recentBlocks are the last few blocks put in the pollard, as many as
+	// the pollard can undo, with what they changed in the wallet.
+	recentBlocks []recentBlock
+}
+
+// recentBlock is what undoing a block needs besides the pollard: the block
+// before it, and the watched utxos it gained and lost
+type recentBlock struct {
+	prev   chainhash.Hash
+	gained []btcacc.LeafData
+	lost   []btcacc.LeafData
 }
 
 func (ch *Csn) RegisterOutPoint(op wire.OutPoint) {
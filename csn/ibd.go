@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"time"
 
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/wire"
 	"github.com/btcsuite/btcutil"
 	"github.com/mit-dci/utreexo/accumulator"
@@ -38,8 +39,17 @@ func (c *Csn) IBDThread(cfg Config, sig chan bool) {
 
 	// Reads blocks asynchronously from blk*.dat files, and the proof.dat, and DB
 	// this will be a network reader, with the server sending the same stuff over
+	// if there's a blockdir, only get the proofs from the server
+	var blocks uwire.BlockSource
+	if cfg.blockDir != "" {
+		blocks = blkDirSource{
+			blockDir: cfg.blockDir, offsetFile: cfg.offsetFile}
+	}
+
+	readerQuit := make(chan bool)
 	go uwire.UblockNetworkReader(
-		ublockQueue, c.remoteHost, c.CurrentHeight, lookahead)
+		ublockQueue, c.remoteHosts, c.Params.Net, c.CurrentHeight,
+		lookahead, cfg.compact, blocks, readerQuit)
 
 	var plustime time.Duration
 	starttime := time.Now()
@@ -47,7 +57,7 @@ func (c *Csn) IBDThread(cfg Config, sig chan bool) {
 	// bool for stopping the below for loop
 	var stop bool
 	var blockCount int
-	for ; !stop; c.CurrentHeight++ {
+	for !stop {
 
 		blocknproof, open := <-ublockQueue
 		if !open {
@@ -56,11 +66,28 @@ func (c *Csn) IBDThread(cfg Config, sig chan bool) {
 			break
 		}
 
+		if !c.buildsOnTip(blocknproof.Block) {
+			// the bridge has reorged.  Undo our tip and ask for blocks
+			// again from there, until the blocks we get connect.
+			err := c.undoTip()
+			if err != nil {
+				panic(err)
+			}
+			close(readerQuit)
+			readerQuit = make(chan bool)
+			ublockQueue = make(chan uwire.UBlock, 10)
+			go uwire.UblockNetworkReader(ublockQueue, c.remoteHosts,
+				c.Params.Net, c.CurrentHeight, lookahead, cfg.compact,
+				blocks, readerQuit)
+			continue
+		}
+
 		err := c.putBlockInPollard(blocknproof, &totalTXOAdded, &totalDels, plustime)
 		if err != nil {
 			// crash if there's a bad proof or signature, OK for testing
 			panic(err)
 		}
+		c.pushBlock(*blocknproof.Block.Hash())
 
 		c.HeightChan <- c.CurrentHeight
 
@@ -86,6 +113,7 @@ func (c *Csn) IBDThread(cfg Config, sig chan bool) {
 		case stop = <-haltRequest:
 		default:
 		}
+		c.CurrentHeight++
 	}
 	fmt.Printf("Block %d add %d del %d %s plus %.2f total %.2f \n",
 		c.CurrentHeight, totalTXOAdded, totalDels, c.pollard.Stats(),
@@ -93,6 +121,13 @@ func (c *Csn) IBDThread(cfg Config, sig chan bool) {
 
 	saveIBDsimData(c)
 
+	// another client can start from here with -assumeutreexo
+	numLeaves, _ := c.pollard.ReconstructStats()
+	roots := uwire.Roots{Height: c.CurrentHeight - 1,
+		Hasher: c.pollard.Hasher().ID(), NumLeaves: numLeaves,
+		Roots: c.pollard.GetRoots()}
+	fmt.Printf("roots after block %d: %s\n", roots.Height, roots.String())
+
 	fmt.Printf("Found %d satoshis in %d utxos\n", c.totalScore, len(c.utxoStore))
 
 	fmt.Println("Done Writing")
@@ -100,9 +135,70 @@ func (c *Csn) IBDThread(cfg Config, sig chan bool) {
 	haltAccept <- true
 }
 
+// buildsOnTip returns false if the block doesn't build on the last block we
+// put in the pollard.  If we don't know the last block, like when starting
+// from assumed roots, there's nothing to check against so it returns true.
+func (c *Csn) buildsOnTip(b *btcutil.Block) bool {
+	if c.tip == (chainhash.Hash{}) {
+		return true
+	}
+	return b.MsgBlock().Header.PrevBlock == c.tip
+}
+
+// pushBlock makes the block just put in the pollard the tip.  Only as many
+// recent blocks are kept as the pollard can undo.
+func (c *Csn) pushBlock(h chainhash.Hash) {
+	c.recentBlocks = append(c.recentBlocks, recentBlock{prev: c.tip})
+	if int32(len(c.recentBlocks)) > c.pollard.UndoDepth {
+		c.recentBlocks =
+			c.recentBlocks[int32(len(c.recentBlocks))-c.pollard.UndoDepth:]
+	}
+	c.tip = h
+}
+
+// undoTip takes the last block back out of the pollard, and puts back the
+// utxos it gained or lost for the watched addresses.
+func (c *Csn) undoTip() error {
+	if len(c.recentBlocks) == 0 {
+		return fmt.Errorf("reorg at height %d deeper than we can undo",
+			c.CurrentHeight)
+	}
+	err := c.pollard.Undo()
+	if err != nil {
+		return fmt.Errorf("undo at height %d %s",
+			c.CurrentHeight, err.Error())
+	}
+	rb := c.recentBlocks[len(c.recentBlocks)-1]
+	c.recentBlocks = c.recentBlocks[:len(c.recentBlocks)-1]
+
+	// put back what was lost first, as a utxo can be both gained and lost
+	// in the same block
+	for _, utxo := range rb.lost {
+		op := wire.OutPoint{Hash: chainhash.Hash(utxo.TxHash), Index: utxo.Index}
+		c.utxoStore[op] = utxo
+		c.totalScore += utxo.Amt
+	}
+	for _, utxo := range rb.gained {
+		op := wire.OutPoint{Hash: chainhash.Hash(utxo.TxHash), Index: utxo.Index}
+		delete(c.utxoStore, op)
+		c.UnegisterOutPoint(op)
+		c.totalScore -= utxo.Amt
+	}
+	c.tip = rb.prev
+	c.CurrentHeight--
+	fmt.Printf("reorg: undid block %d, have %d in %d utxos\n",
+		c.CurrentHeight, c.totalScore, len(c.utxoStore))
+	return nil
+}
+
 // ScanBlock looks through a block using the CSN's maps and sends matches
-// into the tx channel.
+// into the tx channel.  If the block is the tip, what it changed is kept
+// so undoTip can put it back.
 func (c *Csn) ScanBlock(b *btcutil.Block) {
+	var change *recentBlock
+	if len(c.recentBlocks) != 0 && c.tip == *b.Hash() {
+		change = &c.recentBlocks[len(c.recentBlocks)-1]
+	}
 	var curAdr [20]byte
 	for _, tx := range b.Transactions() {
 		// first check utxo loss
@@ -113,6 +209,9 @@ func (c *Csn) ScanBlock(b *btcutil.Block) {
 			}
 			delete(c.utxoStore, in.PreviousOutPoint)
 			c.totalScore -= lostTxo.Amt
+			if change != nil {
+				change.lost = append(change.lost, lostTxo)
+			}
 			fmt.Printf("tx %s lost %d satoshis :( But still have %d in %d utxos\n",
 				tx.Hash().String(), lostTxo.Amt, c.totalScore, len(c.utxoStore))
 			c.TxChan <- *tx.MsgTx()
@@ -130,6 +229,9 @@ func (c *Csn) ScanBlock(b *btcutil.Block) {
 				c.utxoStore[newOut] =
 					btcacc.LeafData{TxHash: btcacc.Hash(newOut.Hash), Index: newOut.Index, Amt: out.Value}
 				c.totalScore += out.Value
+				if change != nil {
+					change.gained = append(change.gained, c.utxoStore[newOut])
+				}
 				fmt.Printf("got utxo %s with %d satoshis! Now have %d in %d utxos\n",
 					newOut.String(), out.Value, c.totalScore, len(c.utxoStore))
 				c.TxChan <- *tx.MsgTx()
@@ -162,7 +264,8 @@ func (c *Csn) putBlockInPollard(
 	// to be proven.
 	delHashes := make([]accumulator.Hash, len(ub.UtreexoData.Stxos))
 	for i, _ := range ub.UtreexoData.Stxos {
-		delHashes[i] = ub.UtreexoData.Stxos[i].LeafHash()
+		delHashes[i] = ub.UtreexoData.Stxos[i].LeafHashWith(
+			c.pollard.Hasher())
 	}
 
 	*totalDels += len(ub.UtreexoData.AccProof.Targets) // for benchmarking
@@ -203,8 +306,8 @@ func (c *Csn) putBlockInPollard(
 	}
 
 	// get hashes to add into the accumulator
-	blockAdds := uwire.BlockToAddLeaves(
-		ub.Block, remember, outskip, ub.UtreexoData.Height, outCount)
+	blockAdds := uwire.BlockToAddLeaves(ub.Block, remember, outskip,
+		ub.UtreexoData.Height, outCount, c.pollard.Hasher())
 	*totalTXOAdded += len(blockAdds) // for benchmarking
 
 	// Utreexo tree modification. blockAdds are the added txos and
@@ -12,10 +12,12 @@ import (
 
 	"github.com/adiabat/bech32"
 
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
 	"github.com/btcsuite/btcd/wire"
 	"github.com/mit-dci/utreexo/accumulator"
 	"github.com/mit-dci/utreexo/btcacc"
 	"github.com/mit-dci/utreexo/util"
+	uwire "github.com/mit-dci/utreexo/wire"
 )
 
 // RunIBD calls everything to run IBD
@@ -46,18 +48,20 @@ func RunIBD(cfg *Config, sig chan bool) error {
 	}
 
 	// check on disk for pre-existing state and load it
-	pol, height, utxos, err := initCSNState()
+	pol, height, utxos, tip, err := initCSNState(cfg.hasher, cfg.assumeUtreexo)
 	if err != nil {
 		return fmt.Errorf("initCSNState error: %s", err.Error())
 	}
 
 	pol.Lookahead = int32(cfg.lookAhead)
+	pol.UndoDepth = maxReorgDepth
 
 	// make a new CSN struct and load the pollard into it
 	c := Csn{
 		pollard:         pol,
 		CheckSignatures: cfg.checkSig,
 		utxoStore:       utxos,
+		tip:             tip,
 	}
 
 	txChan, heightChan, err := c.Start(cfg, height, "compactstate", "", sig)
@@ -112,7 +116,11 @@ func (c *Csn) Start(cfg *Config, height int32, path, proxyURL string, haltSig ch
 
 	c.CurrentHeight = height
 	c.Params = cfg.params
-	c.remoteHost = cfg.remoteHost
+	// starting from scratch, the first block has to build on genesis
+	if height == 1 && c.tip == (chainhash.Hash{}) {
+		c.tip = *c.Params.GenesisHash
+	}
+	c.remoteHosts = cfg.remoteHosts
 
 	// start client & connect
 	go c.IBDThread(*cfg, haltSig)
@@ -121,16 +129,24 @@ func (c *Csn) Start(cfg *Config, height int32, path, proxyURL string, haltSig ch
 }
 
 // initCSNState attempts to load and initialize the CSN state from the disk.
-// If a CSN state is not present, chain is initialized to the genesis
-func initCSNState() (
-	p accumulator.Pollard, height int32, utxos map[wire.OutPoint]btcacc.LeafData, err error) {
+// If a CSN state is not present, chain is initialized to the genesis, or to
+// the assumed roots if there are some.  tip is the hash of the block the
+// state is at, if it's known.
+func initCSNState(hasher accumulator.Hasher, assume *uwire.Roots) (
+	p accumulator.Pollard, height int32, utxos map[wire.OutPoint]btcacc.LeafData,
+	tip chainhash.Hash, err error) {
+
+	err = p.SetHasher(hasher)
+	if err != nil {
+		return
+	}
 
 	// bool to check if the pollarddata is present
 	pollardInitialized := util.HasAccess(PollardFilePath)
 
 	if pollardInitialized {
 		fmt.Println("Has access to forestdata, resuming")
-		height, p, utxos, err = restorePollard()
+		height, utxos, tip, err = restorePollard(&p)
 		if err != nil {
 			err = fmt.Errorf("restorePollard error: %s", err.Error())
 			return
@@ -139,6 +155,21 @@ func initCSNState() (
 		fmt.Println("Creating new pollarddata")
 		// start at height 1
 		height = 1
+		if assume != nil {
+			// the roots are trusted, not checked.  They're for the block
+			// at assume.Height so carry on from the one after.
+			fmt.Printf("starting from roots at height %d\n", assume.Height)
+			if assume.Hasher != p.Hasher().ID() {
+				err = fmt.Errorf("assumed roots are for hasher %d, but "+
+					"-hashmode gives hasher %d", assume.Hasher, p.Hasher().ID())
+				return
+			}
+			err = p.SetRoots(assume.NumLeaves, assume.Roots)
+			if err != nil {
+				return
+			}
+			height = assume.Height + 1
+		}
 		utxos = make(map[wire.OutPoint]btcacc.LeafData)
 		// Create file needed for pollard
 		_, err = os.OpenFile(PollardFilePath, os.O_CREATE, 0600)
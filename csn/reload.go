@@ -3,6 +3,7 @@ package csn
 import (
 	"encoding/binary"
 	"fmt"
+	"io"
 	"os"
 
 	"github.com/btcsuite/btcd/chaincfg/chainhash"
@@ -11,10 +12,12 @@ import (
 	"github.com/mit-dci/utreexo/btcacc"
 )
 
-// restorePollard restores the pollard from disk to memory.
-// If starting anew, it just returns a empty pollard.
-func restorePollard() (height int32, p accumulator.Pollard,
-	utxos map[wire.OutPoint]btcacc.LeafData, err error) {
+// restorePollard restores the pollard from disk into p.  p should already have
+// its hasher set, and restoring fails if the pollard on disk used another one.
+// tip is the hash of the last block in the pollard, or all zeros if it was
+// saved before tips were.
+func restorePollard(p *accumulator.Pollard) (height int32,
+	utxos map[wire.OutPoint]btcacc.LeafData, tip chainhash.Hash, err error) {
 	// Restore Pollard
 	pollardFile, err := os.OpenFile(PollardFilePath, os.O_RDWR, 0600)
 	if err != nil {
@@ -55,14 +58,18 @@ func restorePollard() (height int32, p accumulator.Pollard,
 		return
 	}
 
+	_, err = io.ReadFull(pollardFile, tip[:])
+	if err == io.EOF {
+		err = nil
+	}
 	return
 }
 
 // saveIBDsimData saves the state of ibdsim so that when the
 // user restarts, they'll be able to resume.
-// Saves height for ibdsim and pollard itself
+// Saves height for ibdsim, the pollard itself, and the tip hash
 func saveIBDsimData(csn *Csn) error {
-	polFile, err := os.OpenFile(PollardFilePath, os.O_WRONLY, 0600)
+	polFile, err := os.OpenFile(PollardFilePath, os.O_WRONLY|os.O_TRUNC, 0600)
 	if err != nil {
 		return err
 	}
@@ -89,5 +96,9 @@ func saveIBDsimData(csn *Csn) error {
 	if err != nil {
 		return err
 	}
+	_, err = polFile.Write(csn.tip[:])
+	if err != nil {
+		return err
+	}
 	return polFile.Close()
 }
@@ -0,0 +1,355 @@
+package wire
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net"
+	"runtime"
+	"sync"
+	"time"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+)
+
+const (
+	// dialTimeout is how long to wait to connect to a server
+	dialTimeout = 5 * time.Second
+
+	// stallTimeout is how long we'll wait on a server for one message
+	// before giving up on it.  Long enough for a full block on a slow link.
+	stallTimeout = 2 * time.Minute
+
+	// minBackoff and maxBackoff bound the wait before trying again after a
+	// server fails.  It doubles each time all the servers have failed in a
+	// row.
+	minBackoff = time.Second
+	maxBackoff = time.Minute
+)
+
+// BlockSource gives blocks by height.  It's for clients that already get
+// blocks some other way, such as from a local blk directory or a peer, and
+// only need the udata from the bridge server.  GetBlock gets called from
+// more than one goroutine at a time.
+type BlockSource interface {
+	GetBlock(height int32) (*btcutil.Block, error)
+}
+
+// UblockNetworkReader gets Ublocks from the remote servers and puts em in
+// the channel, starting at curHeight.  It'll try to fill the channel buffer.
+// If compact is set it asks for compact UData.  If blocks isn't nil, it only
+// asks the servers for the udata and gets the blocks from there.
+//
+// If a server errors out or stalls, it moves on to the next one in the list
+// and picks up from the last block it got.  Servers that are on another
+// network or protocol version are dropped.  It only closes the channel
+// when a server says it has no more blocks, or there are no servers left.
+//
+// Closing quit makes it hang up and return; quit can be nil if it never
+// needs to stop early.
+func UblockNetworkReader(
+	blockChan chan UBlock, remoteServers []string, network wire.BitcoinNet,
+	curHeight, lookahead int32, compact bool, blocks BlockSource,
+	quit chan bool) {
+
+	defer close(blockChan)
+
+	servers := make([]string, len(remoteServers))
+	copy(servers, remoteServers)
+
+	backoff := minBackoff
+	var failsInRow int
+	for i := 0; len(servers) > 0; i++ {
+		server := servers[i%len(servers)]
+		startHeight := curHeight
+
+		var done bool
+		var err error
+		curHeight, done, err = readUBlocks(blockChan, server, network,
+			curHeight, compact, blocks, quit)
+		if done {
+			return
+		}
+
+		if _, ok := err.(IncompatibleError); ok {
+			fmt.Printf("dropping server %s: %s\n", server, err.Error())
+			servers = append(servers[:i%len(servers)],
+				servers[i%len(servers)+1:]...)
+			i--
+			continue
+		}
+		fmt.Printf("server %s at height %d: %s\n",
+			server, curHeight, err.Error())
+
+		// got something, so it's worth trying again right away
+		if curHeight > startHeight {
+			backoff = minBackoff
+			failsInRow = 0
+			continue
+		}
+
+		failsInRow++
+		if failsInRow < len(servers) {
+			continue
+		}
+		fmt.Printf("no servers working, waiting %s\n", backoff)
+		select {
+		case <-time.After(backoff):
+		case <-quit:
+			return
+		}
+		failsInRow = 0
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+	fmt.Printf("no servers left to download from\n")
+}
+
+// readUBlocks connects to a server and reads ublocks from curHeight into
+// blockChan until something goes wrong.  It returns the height of the next
+// block to get, and done if the server is out of blocks or we were told to
+// quit.
+func readUBlocks(blockChan chan UBlock, server string,
+	network wire.BitcoinNet, curHeight int32, compact bool,
+	blocks BlockSource, quit chan bool) (int32, bool, error) {
+
+	d := net.Dialer{Timeout: dialTimeout}
+	con, err := d.Dial("tcp", server)
+	if err != nil {
+		return curHeight, false, err
+	}
+	defer con.Close()
+
+	// we can always wait on a server for new blocks
+	features := FeatureTip
+	if compact {
+		features |= FeatureCompact
+	}
+	request := MsgGetUBlocks
+	if blocks != nil {
+		features |= FeatureProofOnly
+		request = MsgGetUData
+	}
+	con.SetDeadline(time.Now().Add(stallTimeout))
+	version, err := ClientHandshake(con, network, features)
+	if err != nil {
+		return curHeight, false, err
+	}
+	if blocks != nil && version.Features&FeatureProofOnly == 0 {
+		return curHeight, false, IncompatibleError{
+			Reason: "server doesn't serve proofs on their own"}
+	}
+	compact = version.Features&FeatureCompact != 0
+	fmt.Printf("connected to %s, protocol %d, tip %d\n",
+		server, version.Version, version.Height)
+
+	// request range from curHeight to latest block
+	err = WriteMessage(con, request,
+		GetUBlocksBytes(curHeight, math.MaxInt32))
+	if err != nil {
+		return curHeight, false, err
+	}
+
+	return pipeUBlocks(con, blockChan, server, curHeight, compact,
+		blocks, quit)
+}
+
+/*
+Reading ublocks goes through a pipeline so big blocks can be deserialized
+in parallel:
+
+  reader:  reads messages off the connection and hands out the raw bytes,
+           numbered by height
+  workers: deserialize the ublocks, as many as there are CPUs.  In proof
+           only mode they get the block from the BlockSource too.
+  pipeUBlocks itself: puts the ublocks back in height order and sends them
+           on to blockChan
+
+At most maxInFlight blocks can be read but not yet sent on, so one slow block
+doesn't let the rest pile up in memory.
+*/
+
+// maxInFlight is how many ublocks can be between the connection and
+// blockChan at once
+const maxInFlight = 64
+
+// rawUBlock is a MsgUBlock payload that hasn't been deserialized yet
+type rawUBlock struct {
+	height  int32
+	payload []byte
+}
+
+// decodedUBlock is the result of deserializing a rawUBlock
+type decodedUBlock struct {
+	height int32
+	ub     UBlock
+	err    error
+}
+
+// pipeUBlocks reads ublocks from an open connection and puts them in
+// blockChan in order, starting at curHeight.  Returns the same as
+// readUBlocks.
+func pipeUBlocks(con net.Conn, blockChan chan UBlock, server string,
+	curHeight int32, compact bool, blocks BlockSource,
+	quit chan bool) (int32, bool, error) {
+
+	expect := MsgUBlock
+	if blocks != nil {
+		expect = MsgUData
+	}
+
+	jobs := make(chan rawUBlock, maxInFlight)
+	results := make(chan decodedUBlock, maxInFlight)
+	// a token is taken for each block read and given back once it's sent
+	// on to blockChan
+	inFlight := make(chan bool, maxInFlight)
+	// closed when we stop early, so the reader and workers don't block
+	stop := make(chan bool)
+	defer close(stop)
+
+	// set by the reader before it closes jobs
+	var readDone bool
+	var readErr error
+	go func() {
+		defer close(jobs)
+		serverTip := int32(-1)
+		for h := curHeight; ; h++ {
+			select {
+			case inFlight <- true:
+			case <-stop:
+				return
+			}
+			con.SetDeadline(time.Now().Add(stallTimeout))
+			t, payload, err := ReadMessage(con)
+			for err == nil && t == MsgTip {
+				var tip int32
+				tip, err = TipFromBytes(payload)
+				if err != nil {
+					break
+				}
+				if tip != serverTip {
+					fmt.Printf("%s at tip %d, waiting for blocks\n",
+						server, tip)
+					serverTip = tip
+				}
+				con.SetDeadline(time.Now().Add(stallTimeout))
+				t, payload, err = ReadMessage(con)
+			}
+			if err != nil {
+				readErr = err
+				return
+			}
+			switch t {
+			case expect:
+			case MsgDone:
+				readDone = true
+				return
+			case MsgReject:
+				if bytes.HasPrefix(payload, []byte(PrunedReason)) {
+					readErr = IncompatibleError{
+						Reason: fmt.Sprintf("rejected: %s", payload)}
+					return
+				}
+				readErr = fmt.Errorf("rejected: %s", payload)
+				return
+			default:
+				readErr = fmt.Errorf("unexpected message type %d", t)
+				return
+			}
+			select {
+			case jobs <- rawUBlock{height: h, payload: payload}:
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobs {
+				ub, err := decodeUBlock(job, compact, blocks)
+				select {
+				case results <- decodedUBlock{
+					height: job.height, ub: ub, err: err}:
+				case <-stop:
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// blocks that came out of the workers ahead of curHeight
+	pending := make(map[int32]decodedUBlock)
+	for result := range results {
+		pending[result.height] = result
+		for {
+			next, ok := pending[curHeight]
+			if !ok {
+				break
+			}
+			delete(pending, curHeight)
+			if next.err != nil {
+				return curHeight, false, fmt.Errorf(
+					"Deserialize error %s", next.err.Error())
+			}
+			if next.ub.UtreexoData.Height != curHeight {
+				return curHeight, false, fmt.Errorf("sent block %d, expect %d",
+					next.ub.UtreexoData.Height, curHeight)
+			}
+
+			select {
+			case blockChan <- next.ub:
+			case <-quit:
+				return curHeight, true, nil
+			}
+			<-inFlight
+			curHeight++
+		}
+	}
+
+	// the reader's finished and everything it read has been sent on
+	if readDone {
+		fmt.Printf("%s has no blocks past %d\n", server, curHeight-1)
+		return curHeight, true, nil
+	}
+	return curHeight, false, readErr
+}
+
+// decodeUBlock deserializes a MsgUBlock payload, or a MsgUData payload along
+// with the block from blocks
+func decodeUBlock(job rawUBlock, compact bool,
+	blocks BlockSource) (ub UBlock, err error) {
+
+	r := bytes.NewReader(job.payload)
+	if blocks == nil {
+		if compact {
+			err = ub.DeserializeCompact(r)
+		} else {
+			err = ub.Deserialize(r)
+		}
+		return
+	}
+
+	ub.Block, err = blocks.GetBlock(job.height)
+	if err != nil {
+		err = fmt.Errorf("block %d from block source: %s",
+			job.height, err.Error())
+		return
+	}
+	if compact {
+		err = ub.UtreexoData.DeserializeCompact(r, ub.Block)
+	} else {
+		err = ub.UtreexoData.Deserialize(r)
+	}
+	return
+}
@@ -0,0 +1,185 @@
+package wire
+
+import (
+	"bytes"
+	"net"
+	"testing"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/btcsuite/btcutil"
+	"github.com/mit-dci/utreexo/btcacc"
+)
+
+// fakeServer serves empty ublocks up to tipHeight on network, but hangs up
+// after sending hangUpAfter blocks on a connection.  Returns its address.
+func fakeServer(t *testing.T, network wire.BitcoinNet,
+	tipHeight int32, hangUpAfter int) string {
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			con, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go fakeServe(con, network, tipHeight, hangUpAfter)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func fakeServe(con net.Conn, network wire.BitcoinNet,
+	tipHeight int32, hangUpAfter int) {
+
+	defer con.Close()
+	_, err := ServerHandshake(con, network, FeatureProofOnly, tipHeight)
+	if err != nil {
+		return
+	}
+	request, payload, err := ReadMessage(con)
+	if err != nil {
+		return
+	}
+	from, _, err := GetUBlocksFromBytes(payload)
+	if err != nil {
+		return
+	}
+	for h := from; h <= tipHeight; h++ {
+		if int(h-from) == hangUpAfter {
+			return
+		}
+		ub := UBlock{
+			Block:       fakeBlock(h),
+			UtreexoData: btcacc.UData{Height: h},
+		}
+		var buf bytes.Buffer
+		msgType := MsgUBlock
+		if request == MsgGetUData {
+			msgType = MsgUData
+			err = ub.UtreexoData.Serialize(&buf)
+		} else {
+			err = ub.Serialize(&buf)
+		}
+		if err != nil {
+			return
+		}
+		err = WriteMessage(con, msgType, buf.Bytes())
+		if err != nil {
+			return
+		}
+	}
+	// like a following server waiting at its tip for a while
+	WriteMessage(con, MsgTip, TipBytes(tipHeight))
+	WriteMessage(con, MsgDone, nil)
+}
+
+// prunedServer says it's pruned whatever's asked for
+func prunedServer(t *testing.T, network wire.BitcoinNet) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			con, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			_, err = ServerHandshake(con, network, 0, 1000)
+			if err == nil {
+				ReadMessage(con)
+				WriteMessage(con, MsgReject,
+					[]byte(PrunedReason+": block 1, oldest is 500"))
+			}
+			con.Close()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// fakeBlock is a block with just a coinbase, different for each height
+func fakeBlock(height int32) *btcutil.Block {
+	coinbase := wire.NewMsgTx(1)
+	coinbase.AddTxIn(wire.NewTxIn(
+		wire.NewOutPoint(&chainhash.Hash{}, 0xffffffff),
+		[]byte{byte(height), byte(height >> 8)}, nil))
+	var msgBlock wire.MsgBlock
+	msgBlock.AddTransaction(coinbase)
+	return btcutil.NewBlock(&msgBlock)
+}
+
+// fakeBlockSource stands in for a peer giving us blocks
+type fakeBlockSource struct{}
+
+func (fakeBlockSource) GetBlock(height int32) (*btcutil.Block, error) {
+	return fakeBlock(height), nil
+}
+
+func TestUblockNetworkReaderFailover(t *testing.T) {
+	servers := []string{
+		// gives a couple blocks then drops
+		fakeServer(t, wire.TestNet3, 300, 2),
+		// wrong network
+		fakeServer(t, wire.MainNet, 10, 100),
+		// nothing there
+		"127.0.0.1:1",
+		// works.  Enough blocks that they go through the pipeline out of
+		// order.
+		fakeServer(t, wire.TestNet3, 300, 1000),
+	}
+
+	blockChan := make(chan UBlock, 1)
+	go UblockNetworkReader(
+		blockChan, servers, wire.TestNet3, 1, 0, false, nil, nil)
+
+	expect := int32(1)
+	for ub := range blockChan {
+		if ub.UtreexoData.Height != expect {
+			t.Fatalf("got block %d expect %d", ub.UtreexoData.Height, expect)
+		}
+		expect++
+	}
+	if expect != 301 {
+		t.Fatalf("channel closed at height %d, expect 301", expect)
+	}
+}
+
+func TestUblockNetworkReaderProofOnly(t *testing.T) {
+	servers := []string{fakeServer(t, wire.TestNet3, 20, 1000)}
+
+	blockChan := make(chan UBlock, 1)
+	go UblockNetworkReader(blockChan, servers, wire.TestNet3, 5, 0, false,
+		fakeBlockSource{}, nil)
+
+	expect := int32(5)
+	for ub := range blockChan {
+		if ub.UtreexoData.Height != expect {
+			t.Fatalf("got udata %d expect %d", ub.UtreexoData.Height, expect)
+		}
+		if *ub.Block.Hash() != *fakeBlock(expect).Hash() {
+			t.Fatalf("height %d joined with the wrong block", expect)
+		}
+		expect++
+	}
+	if expect != 21 {
+		t.Fatalf("channel closed at height %d, expect 21", expect)
+	}
+}
+
+func TestUblockNetworkReaderPruned(t *testing.T) {
+	servers := []string{prunedServer(t, wire.TestNet3)}
+
+	// the server gets dropped, so the channel's closed without waiting
+	// to try it again
+	blockChan := make(chan UBlock, 1)
+	go UblockNetworkReader(
+		blockChan, servers, wire.TestNet3, 1, 0, false, nil, nil)
+	for ub := range blockChan {
+		t.Fatalf("got block %d from a pruned server",
+			ub.UtreexoData.Height)
+	}
+}
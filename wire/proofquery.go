@@ -0,0 +1,207 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/btcsuite/btcd/chaincfg/chainhash"
+	"github.com/btcsuite/btcd/wire"
+	"github.com/mit-dci/utreexo/accumulator"
+	"github.com/mit-dci/utreexo/btcacc"
+)
+
+// maxProofQuery is the most leaves that can be asked for at once
+const maxProofQuery = 1 << 12
+
+// ProofRequest asks the server to prove some leaves at its tip.  Leaves can
+// be given as leaf hashes, or as outpoints if the server can look up their
+// LeafData.  Each leaf can only be asked for once.
+type ProofRequest struct {
+	LeafHashes []accumulator.Hash
+	OutPoints  []wire.OutPoint
+}
+
+// ProofResponse proves the leaves in a ProofRequest.  The targets in the
+// proof are the leaf hashes first, then the outpoints, in the order they
+// were asked for.  LeafDatas has the LeafData for each of the outpoints.
+type ProofResponse struct {
+	NumLeaves uint64
+	Roots     []accumulator.Hash
+	Proof     accumulator.BatchProof
+	LeafDatas []btcacc.LeafData
+}
+
+// Bytes serializes a ProofRequest:
+// 4B number of leaf hashes, the 32B leaf hashes,
+// 4B number of outpoints, the outpoints as 32B txid and 4B index
+func (pr *ProofRequest) Bytes() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, uint32(len(pr.LeafHashes)))
+	for _, h := range pr.LeafHashes {
+		buf.Write(h[:])
+	}
+	binary.Write(&buf, binary.BigEndian, uint32(len(pr.OutPoints)))
+	for _, op := range pr.OutPoints {
+		buf.Write(op.Hash[:])
+		binary.Write(&buf, binary.BigEndian, op.Index)
+	}
+	return buf.Bytes()
+}
+
+// ProofRequestFromBytes deserializes a ProofRequest
+func ProofRequestFromBytes(b []byte) (pr ProofRequest, err error) {
+	r := bytes.NewReader(b)
+	var num uint32
+	err = binary.Read(r, binary.BigEndian, &num)
+	if err != nil {
+		return
+	}
+	if num > maxProofQuery {
+		err = fmt.Errorf("%d leaf hashes, max %d", num, maxProofQuery)
+		return
+	}
+	pr.LeafHashes = make([]accumulator.Hash, num)
+	for i := range pr.LeafHashes {
+		_, err = io.ReadFull(r, pr.LeafHashes[i][:])
+		if err != nil {
+			return
+		}
+	}
+
+	err = binary.Read(r, binary.BigEndian, &num)
+	if err != nil {
+		return
+	}
+	if num > maxProofQuery {
+		err = fmt.Errorf("%d outpoints, max %d", num, maxProofQuery)
+		return
+	}
+	pr.OutPoints = make([]wire.OutPoint, num)
+	for i := range pr.OutPoints {
+		_, err = io.ReadFull(r, pr.OutPoints[i].Hash[:])
+		if err != nil {
+			return
+		}
+		err = binary.Read(r, binary.BigEndian, &pr.OutPoints[i].Index)
+		if err != nil {
+			return
+		}
+	}
+	if r.Len() != 0 {
+		err = fmt.Errorf("%d extra bytes after proof request", r.Len())
+	}
+	return
+}
+
+// Bytes serializes a ProofResponse:
+// 8B numLeaves, 4B number of roots, the 32B roots, the batch proof,
+// 4B number of leafdatas, the compressed leafdatas
+func (pr *ProofResponse) Bytes() ([]byte, error) {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, pr.NumLeaves)
+	binary.Write(&buf, binary.BigEndian, uint32(len(pr.Roots)))
+	for _, root := range pr.Roots {
+		buf.Write(root[:])
+	}
+	err := pr.Proof.Serialize(&buf)
+	if err != nil {
+		return nil, err
+	}
+	binary.Write(&buf, binary.BigEndian, uint32(len(pr.LeafDatas)))
+	for _, ld := range pr.LeafDatas {
+		err = ld.SerializeCompressed(&buf)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// ProofResponseFromBytes deserializes a ProofResponse
+func ProofResponseFromBytes(b []byte) (pr ProofResponse, err error) {
+	r := bytes.NewReader(b)
+	err = binary.Read(r, binary.BigEndian, &pr.NumLeaves)
+	if err != nil {
+		return
+	}
+	var num uint32
+	err = binary.Read(r, binary.BigEndian, &num)
+	if err != nil {
+		return
+	}
+	// one root per bit of numLeaves
+	if num > 64 {
+		err = fmt.Errorf("%d roots, too many", num)
+		return
+	}
+	pr.Roots = make([]accumulator.Hash, num)
+	for i := range pr.Roots {
+		_, err = io.ReadFull(r, pr.Roots[i][:])
+		if err != nil {
+			return
+		}
+	}
+	err = pr.Proof.Deserialize(r)
+	if err != nil {
+		return
+	}
+
+	err = binary.Read(r, binary.BigEndian, &num)
+	if err != nil {
+		return
+	}
+	if num > maxProofQuery {
+		err = fmt.Errorf("%d leafdatas, max %d", num, maxProofQuery)
+		return
+	}
+	pr.LeafDatas = make([]btcacc.LeafData, num)
+	for i := range pr.LeafDatas {
+		err = pr.LeafDatas[i].DeserializeCompressed(r)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// RequestProof asks a server we've done the handshake with to prove some
+// leaves.
+func RequestProof(con io.ReadWriter, req ProofRequest) (
+	ProofResponse, error) {
+
+	err := WriteMessage(con, MsgGetProof, req.Bytes())
+	if err != nil {
+		return ProofResponse{}, err
+	}
+	t, payload, err := ReadMessage(con)
+	if err != nil {
+		return ProofResponse{}, err
+	}
+	switch t {
+	case MsgProof:
+	case MsgReject:
+		return ProofResponse{}, fmt.Errorf("server rejected proof request: %s",
+			payload)
+	default:
+		return ProofResponse{}, fmt.Errorf(
+			"got message type %d, expect proof", t)
+	}
+	resp, err := ProofResponseFromBytes(payload)
+	if err != nil {
+		return ProofResponse{}, err
+	}
+	if len(resp.LeafDatas) != len(req.OutPoints) {
+		return ProofResponse{}, fmt.Errorf("asked for %d outpoints, got %d",
+			len(req.OutPoints), len(resp.LeafDatas))
+	}
+	for i, ld := range resp.LeafDatas {
+		if chainhash.Hash(ld.TxHash) != req.OutPoints[i].Hash ||
+			ld.Index != req.OutPoints[i].Index {
+			return ProofResponse{}, fmt.Errorf("asked for %s, got %s",
+				req.OutPoints[i].String(), ld.OPString())
+		}
+	}
+	return resp, nil
+}
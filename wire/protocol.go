@@ -0,0 +1,316 @@
+package wire
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	"github.com/btcsuite/btcd/wire"
+)
+
+/*
+Bridge server / CSN protocol
+
+Everything sent either way is a message:
+
+  4B magic | 1B type | 4B payload length | payload
+
+The client starts by sending a MsgVersion and the server answers with its
+own MsgVersion, or a MsgReject saying why it won't talk.  Either side hangs
+up if the other is on a different network or a protocol version it doesn't
+speak.  The features both sides have are the ones used for the rest of
+the connection.
+
+After that the client sends MsgGetUBlocks and the server sends a MsgUBlock
+for each height, then a MsgDone when it gets to the end of the range.
+
+If the server is following the chain and FeatureTip was agreed on, it
+doesn't send MsgDone when it gets to its tip.  It waits for new blocks and
+sends them on as they're built.  While it's waiting it sends a MsgTip every
+so often, so the client knows the server's still there.
+
+A MsgUBlock is a serialized block followed by the udata, which is compact
+if FeatureCompact was agreed on.
+
+Clients that get blocks from somewhere else can send MsgGetUData instead,
+if the server has FeatureProofOnly.  Then the server sends a MsgUData with
+just the udata for each height, again compact if agreed on.
+
+If the server has FeatureProofQuery, clients can send a MsgGetProof for
+some leaves, and get back a MsgProof proving them at the server's tip.
+See ProofRequest and ProofResponse.
+
+If the server has FeatureRoots, clients can send a MsgGetRoots for a
+height, and get back a MsgRoots with the accumulator roots after that
+block.  A CSN can check its own roots against them.  See Roots.
+
+A server that prunes old proofs sends a MsgReject starting with
+PrunedReason when asked for a block it doesn't have anymore.
+
+The server keeps reading requests until the client hangs up.
+
+All integers are big endian.
+*/
+
+// ProtocolVersion is the version of the protocol this code speaks
+const ProtocolVersion uint32 = 1
+
+// protocolMagic starts every message.  "utrx"
+const protocolMagic uint32 = 0x75747278
+
+// maxMessageSize is the biggest payload we'll read.  Blocks are at most 4MB
+// and the proofs are a lot smaller than that.
+const maxMessageSize = 1 << 25
+
+// MsgType says what's in a message
+type MsgType uint8
+
+const (
+	// MsgVersion is the handshake, see VersionMsg
+	MsgVersion MsgType = iota
+	// MsgReject is a reason string, sent before hanging up
+	MsgReject
+	// MsgGetUBlocks is a request for ublocks from one height to another,
+	// as two 4B heights.  If the second is lower, they're sent backwards.
+	MsgGetUBlocks
+	// MsgUBlock is a block and its udata
+	MsgUBlock
+	// MsgDone means the requested range has all been sent
+	MsgDone
+	// MsgGetUData is like MsgGetUBlocks but for just the udata
+	MsgGetUData
+	// MsgUData is the udata for a block, without the block
+	MsgUData
+	// MsgGetProof asks for a proof of some leaves, see ProofRequest
+	MsgGetProof
+	// MsgProof is the answer to MsgGetProof, see ProofResponse
+	MsgProof
+	// MsgTip is the 4B height of the server's tip, sent while it waits
+	// for new blocks
+	MsgTip
+	// MsgGetRoots asks for the roots after a block, as a 4B height
+	MsgGetRoots
+	// MsgRoots is the answer to MsgGetRoots, see Roots
+	MsgRoots
+)
+
+// PrunedReason starts the MsgReject a server sends for blocks it's pruned.
+// It won't ever have them again, so ask another server.
+const PrunedReason = "pruned"
+
+// Features are bits set in VersionMsg for optional parts of the protocol
+const (
+	// FeatureCompact is for compact udata in MsgUBlock and MsgUData
+	FeatureCompact uint64 = 1 << iota
+	// FeatureProofOnly is for serving MsgGetUData
+	FeatureProofOnly
+	// FeatureProofQuery is for serving MsgGetProof
+	FeatureProofQuery
+	// FeatureTip is for holding ranges open past the tip, with MsgTip
+	FeatureTip
+	// FeatureRoots is for serving MsgGetRoots
+	FeatureRoots
+)
+
+// VersionMsg is what both sides send in the handshake
+type VersionMsg struct {
+	Version  uint32
+	Net      wire.BitcoinNet
+	Features uint64
+	// Height is the server's tip.  Clients send 0.
+	Height int32
+}
+
+// Bytes serializes a VersionMsg
+func (v *VersionMsg) Bytes() []byte {
+	b := make([]byte, 20)
+	binary.BigEndian.PutUint32(b[0:4], v.Version)
+	binary.BigEndian.PutUint32(b[4:8], uint32(v.Net))
+	binary.BigEndian.PutUint64(b[8:16], v.Features)
+	binary.BigEndian.PutUint32(b[16:20], uint32(v.Height))
+	return b
+}
+
+// VersionMsgFromBytes deserializes a VersionMsg.  Anything after the first
+// 20 bytes is ignored, so later versions can add on to it.
+func VersionMsgFromBytes(b []byte) (v VersionMsg, err error) {
+	if len(b) < 20 {
+		err = fmt.Errorf("version message %d bytes, expect 20", len(b))
+		return
+	}
+	v.Version = binary.BigEndian.Uint32(b[0:4])
+	v.Net = wire.BitcoinNet(binary.BigEndian.Uint32(b[4:8]))
+	v.Features = binary.BigEndian.Uint64(b[8:16])
+	v.Height = int32(binary.BigEndian.Uint32(b[16:20]))
+	return
+}
+
+// WriteMessage writes a framed message
+func WriteMessage(w io.Writer, t MsgType, payload []byte) error {
+	if len(payload) > maxMessageSize {
+		return fmt.Errorf("message type %d %d bytes too big",
+			t, len(payload))
+	}
+	var header [9]byte
+	binary.BigEndian.PutUint32(header[0:4], protocolMagic)
+	header[4] = byte(t)
+	binary.BigEndian.PutUint32(header[5:9], uint32(len(payload)))
+	// one write so it goes out in one packet if it's small
+	_, err := w.Write(append(header[:], payload...))
+	return err
+}
+
+// ReadMessage reads a framed message
+func ReadMessage(r io.Reader) (t MsgType, payload []byte, err error) {
+	var header [9]byte
+	_, err = io.ReadFull(r, header[:])
+	if err != nil {
+		return
+	}
+	magic := binary.BigEndian.Uint32(header[0:4])
+	if magic != protocolMagic {
+		err = fmt.Errorf("bad magic %x, expect %x", magic, protocolMagic)
+		return
+	}
+	t = MsgType(header[4])
+	size := binary.BigEndian.Uint32(header[5:9])
+	if size > maxMessageSize {
+		err = fmt.Errorf("message type %d says %d bytes, too big", t, size)
+		return
+	}
+	payload = make([]byte, size)
+	_, err = io.ReadFull(r, payload)
+	return
+}
+
+// IncompatibleError is returned by ClientHandshake when the server is on
+// another network or protocol version, or rejected us.  Trying again won't
+// help.
+type IncompatibleError struct {
+	Reason string
+}
+
+func (e IncompatibleError) Error() string {
+	return e.Reason
+}
+
+// ClientHandshake sends our version to the server and reads back the
+// server's.  It returns the server's version, with Features set to the
+// features we both have.
+func ClientHandshake(con io.ReadWriter, network wire.BitcoinNet,
+	features uint64) (VersionMsg, error) {
+
+	ours := VersionMsg{
+		Version: ProtocolVersion, Net: network, Features: features}
+	err := WriteMessage(con, MsgVersion, ours.Bytes())
+	if err != nil {
+		return VersionMsg{}, err
+	}
+
+	t, payload, err := ReadMessage(con)
+	if err != nil {
+		return VersionMsg{}, fmt.Errorf("handshake: %s", err.Error())
+	}
+	if t == MsgReject {
+		return VersionMsg{}, IncompatibleError{
+			Reason: fmt.Sprintf("server rejected us: %s", payload)}
+	}
+	if t != MsgVersion {
+		return VersionMsg{}, fmt.Errorf(
+			"handshake: got message type %d, expect version", t)
+	}
+	theirs, err := VersionMsgFromBytes(payload)
+	if err != nil {
+		return VersionMsg{}, err
+	}
+	err = checkVersion(ours, theirs)
+	if err != nil {
+		return VersionMsg{}, IncompatibleError{Reason: err.Error()}
+	}
+	theirs.Features &= features
+	return theirs, nil
+}
+
+// ServerHandshake reads the client's version and answers with ours, or
+// sends a MsgReject if we can't serve the client.  It returns the features
+// we both have.
+func ServerHandshake(con io.ReadWriter, network wire.BitcoinNet,
+	features uint64, height int32) (uint64, error) {
+
+	t, payload, err := ReadMessage(con)
+	if err != nil {
+		return 0, fmt.Errorf("handshake: %s", err.Error())
+	}
+	if t != MsgVersion {
+		err = fmt.Errorf("handshake: got message type %d, expect version", t)
+		WriteMessage(con, MsgReject, []byte(err.Error()))
+		return 0, err
+	}
+	theirs, err := VersionMsgFromBytes(payload)
+	if err != nil {
+		WriteMessage(con, MsgReject, []byte(err.Error()))
+		return 0, err
+	}
+
+	ours := VersionMsg{Version: ProtocolVersion, Net: network,
+		Features: features, Height: height}
+	err = checkVersion(ours, theirs)
+	if err != nil {
+		WriteMessage(con, MsgReject, []byte(err.Error()))
+		return 0, err
+	}
+
+	err = WriteMessage(con, MsgVersion, ours.Bytes())
+	if err != nil {
+		return 0, err
+	}
+	return theirs.Features & features, nil
+}
+
+// checkVersion returns an error if the other side can't talk to us
+func checkVersion(ours, theirs VersionMsg) error {
+	if theirs.Net != ours.Net {
+		return fmt.Errorf("other side is on network %s, we're on %s",
+			theirs.Net, ours.Net)
+	}
+	if theirs.Version != ours.Version {
+		return fmt.Errorf("other side speaks protocol version %d, we speak %d",
+			theirs.Version, ours.Version)
+	}
+	return nil
+}
+
+// GetUBlocksBytes serializes a MsgGetUBlocks or MsgGetUData payload
+func GetUBlocksBytes(from, to int32) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, from)
+	binary.Write(&buf, binary.BigEndian, to)
+	return buf.Bytes()
+}
+
+// GetUBlocksFromBytes deserializes a MsgGetUBlocks or MsgGetUData payload
+func GetUBlocksFromBytes(b []byte) (from, to int32, err error) {
+	if len(b) != 8 {
+		err = fmt.Errorf("getublocks message %d bytes, expect 8", len(b))
+		return
+	}
+	from = int32(binary.BigEndian.Uint32(b[0:4]))
+	to = int32(binary.BigEndian.Uint32(b[4:8]))
+	return
+}
+
+// TipBytes serializes a MsgTip payload
+func TipBytes(height int32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, uint32(height))
+	return b
+}
+
+// TipFromBytes deserializes a MsgTip payload
+func TipFromBytes(b []byte) (int32, error) {
+	if len(b) != 4 {
+		return 0, fmt.Errorf("tip message %d bytes, expect 4", len(b))
+	}
+	return int32(binary.BigEndian.Uint32(b)), nil
+}
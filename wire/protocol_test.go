@@ -0,0 +1,141 @@
+package wire
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/btcsuite/btcd/wire"
+	"github.com/mit-dci/utreexo/accumulator"
+)
+
+func TestHandshake(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	serverErr := make(chan error, 1)
+	serverFeatures := make(chan uint64, 1)
+	go func() {
+		f, err := ServerHandshake(server, wire.TestNet3, FeatureCompact, 100)
+		serverFeatures <- f
+		serverErr <- err
+	}()
+
+	v, err := ClientHandshake(client, wire.TestNet3, FeatureCompact|1<<10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = <-serverErr; err != nil {
+		t.Fatal(err)
+	}
+	if v.Height != 100 || v.Features != FeatureCompact {
+		t.Fatalf("got server height %d features %x", v.Height, v.Features)
+	}
+	if f := <-serverFeatures; f != FeatureCompact {
+		t.Fatalf("server agreed to features %x", f)
+	}
+}
+
+func TestHandshakeWrongNet(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	serverErr := make(chan error, 1)
+	go func() {
+		_, err := ServerHandshake(server, wire.MainNet, 0, 100)
+		serverErr <- err
+	}()
+
+	_, err := ClientHandshake(client, wire.TestNet3, 0)
+	if err == nil {
+		t.Fatal("client on the wrong network didn't get rejected")
+	}
+	if err = <-serverErr; err == nil {
+		t.Fatal("server accepted a client on the wrong network")
+	}
+}
+
+func TestReadMessage(t *testing.T) {
+	var buf bytes.Buffer
+	err := WriteMessage(&buf, MsgGetUBlocks, GetUBlocksBytes(5, 9))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msgType, payload, err := ReadMessage(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	from, to, err := GetUBlocksFromBytes(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msgType != MsgGetUBlocks || from != 5 || to != 9 {
+		t.Fatalf("read type %d from %d to %d", msgType, from, to)
+	}
+
+	// what an old client sends: just two heights
+	_, _, err = ReadMessage(bytes.NewReader(
+		[]byte{0, 0, 0, 1, 0x7f, 0xff, 0xff, 0xff, 0}))
+	if err == nil {
+		t.Fatal("read a message with no magic")
+	}
+}
+
+func TestRootsBytes(t *testing.T) {
+	r := Roots{Height: 7, Hasher: accumulator.HasherSha256, NumLeaves: 5,
+		Roots: []accumulator.Hash{{1}, {2}}}
+	b := r.Bytes()
+	got, err := RootsFromBytes(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, r) {
+		t.Fatalf("got roots %v, expect %v", got, r)
+	}
+
+	got, err = RootsFromString(r.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, r) {
+		t.Fatalf("got roots %v from %s", got, r.String())
+	}
+	_, err = RootsFromString(strings.Replace(r.String(), "01", "03", 1))
+	if err == nil {
+		t.Fatal("read roots string that doesn't match the digest")
+	}
+
+	// the same roots with another hasher are another accumulator
+	other := r
+	other.Hasher = accumulator.HasherSha512_256
+	if other.Digest() == r.Digest() {
+		t.Fatal("digest doesn't commit to the hasher")
+	}
+	_, err = RootsFromString(strings.Replace(r.String(), "7:1:", "7:0:", 1))
+	if err == nil {
+		t.Fatal("read roots string with the wrong hasher")
+	}
+	b[4] = byte(accumulator.HasherSha512_256)
+	_, err = RootsFromBytes(b)
+	if err == nil {
+		t.Fatal("read roots with the wrong hasher")
+	}
+	b[4] = byte(r.Hasher)
+
+	// a root that doesn't match the digest
+	b[13] ^= 1
+	_, err = RootsFromBytes(b)
+	if err == nil {
+		t.Fatal("read roots that don't match the digest")
+	}
+	// 5 leaves is 2 roots, not 1
+	r.Roots = r.Roots[:1]
+	_, err = RootsFromBytes(r.Bytes())
+	if err == nil {
+		t.Fatal("read 1 root for 5 leaves")
+	}
+}
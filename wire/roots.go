@@ -0,0 +1,192 @@
+package wire
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"math/bits"
+	"strconv"
+	"strings"
+
+	"github.com/mit-dci/utreexo/accumulator"
+)
+
+// Roots is the accumulator after a block: the hasher it was built with, how
+// many leaves there are and the roots, biggest first like GetRoots gives
+// them.  It's the payload of MsgRoots, and what the bridge keeps for every
+// height.
+type Roots struct {
+	Height    int32
+	Hasher    accumulator.HasherID
+	NumLeaves uint64
+	Roots     []accumulator.Hash
+}
+
+// Digest is the sha256 of the 1B hasher id, the 8B numLeaves, then the
+// roots.  It's one hash for the whole accumulator, for comparing with or
+// writing down as a checkpoint.  The same roots with another hasher would
+// be a different accumulator, so they get a different digest.
+func (r *Roots) Digest() accumulator.Hash {
+	h := sha256.New()
+	h.Write([]byte{byte(r.Hasher)})
+	binary.Write(h, binary.BigEndian, r.NumLeaves)
+	for _, root := range r.Roots {
+		h.Write(root[:])
+	}
+	var digest accumulator.Hash
+	copy(digest[:], h.Sum(nil))
+	return digest
+}
+
+// Bytes serializes Roots:
+// 4B height, 1B hasher id, 8B numLeaves, the 32B roots, 32B digest.
+// There's a root for each bit set in numLeaves.
+func (r *Roots) Bytes() []byte {
+	b := make([]byte, 13, 13+32*len(r.Roots)+32)
+	binary.BigEndian.PutUint32(b[0:4], uint32(r.Height))
+	b[4] = byte(r.Hasher)
+	binary.BigEndian.PutUint64(b[5:13], r.NumLeaves)
+	for _, root := range r.Roots {
+		b = append(b, root[:]...)
+	}
+	digest := r.Digest()
+	return append(b, digest[:]...)
+}
+
+// RootsFromBytes deserializes Roots, and checks the digest matches
+func RootsFromBytes(b []byte) (r Roots, err error) {
+	if len(b) < 45 {
+		err = fmt.Errorf("roots message %d bytes, too short", len(b))
+		return
+	}
+	r.Height = int32(binary.BigEndian.Uint32(b[0:4]))
+	r.Hasher = accumulator.HasherID(b[4])
+	r.NumLeaves = binary.BigEndian.Uint64(b[5:13])
+	num := bits.OnesCount64(r.NumLeaves)
+	if len(b) != 13+32*num+32 {
+		err = fmt.Errorf("roots message %d bytes, expect %d for %d leaves",
+			len(b), 13+32*num+32, r.NumLeaves)
+		return
+	}
+	r.Roots = make([]accumulator.Hash, num)
+	for i := range r.Roots {
+		copy(r.Roots[i][:], b[13+32*i:])
+	}
+	var digest accumulator.Hash
+	copy(digest[:], b[13+32*num:])
+	if r.Digest() != digest {
+		err = fmt.Errorf("roots for %d digest %x, expect %x",
+			r.Height, digest, r.Digest())
+	}
+	return
+}
+
+// String gives the roots as text, to be written down and read back with
+// RootsFromString:
+// height:hasher:numLeaves:root,root,...:digest
+// with the hasher id in decimal and the roots and digest in hex.
+func (r *Roots) String() string {
+	hexRoots := make([]string, len(r.Roots))
+	for i, root := range r.Roots {
+		hexRoots[i] = hex.EncodeToString(root[:])
+	}
+	digest := r.Digest()
+	return fmt.Sprintf("%d:%d:%d:%s:%x", r.Height, r.Hasher, r.NumLeaves,
+		strings.Join(hexRoots, ","), digest[:])
+}
+
+// RootsFromString reads roots written by String, and checks the digest
+// matches
+func RootsFromString(s string) (r Roots, err error) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 5 {
+		err = fmt.Errorf("roots %q has %d parts, expect "+
+			"height:hasher:numleaves:roots:digest", s, len(parts))
+		return
+	}
+	height, err := strconv.ParseInt(parts[0], 10, 32)
+	if err != nil {
+		return
+	}
+	r.Height = int32(height)
+	hasher, err := strconv.ParseUint(parts[1], 10, 8)
+	if err != nil {
+		return
+	}
+	r.Hasher = accumulator.HasherID(hasher)
+	r.NumLeaves, err = strconv.ParseUint(parts[2], 10, 64)
+	if err != nil {
+		return
+	}
+	var hexRoots []string
+	if parts[3] != "" {
+		hexRoots = strings.Split(parts[3], ",")
+	}
+	if len(hexRoots) != bits.OnesCount64(r.NumLeaves) {
+		err = fmt.Errorf("%d roots for %d leaves, expect %d",
+			len(hexRoots), r.NumLeaves, bits.OnesCount64(r.NumLeaves))
+		return
+	}
+	r.Roots = make([]accumulator.Hash, len(hexRoots))
+	for i, hexRoot := range hexRoots {
+		err = readHexHash(hexRoot, &r.Roots[i])
+		if err != nil {
+			return
+		}
+	}
+	var digest accumulator.Hash
+	err = readHexHash(parts[4], &digest)
+	if err != nil {
+		return
+	}
+	if r.Digest() != digest {
+		err = fmt.Errorf("roots for %d digest %x, expect %x",
+			r.Height, digest, r.Digest())
+	}
+	return
+}
+
+// readHexHash reads a 32 byte hash in hex
+func readHexHash(s string, h *accumulator.Hash) error {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return err
+	}
+	if len(b) != 32 {
+		return fmt.Errorf("hash %s is %d bytes, expect 32", s, len(b))
+	}
+	copy(h[:], b)
+	return nil
+}
+
+// RequestRoots asks a server we've done the handshake with for the roots
+// after block height.
+func RequestRoots(con io.ReadWriter, height int32) (Roots, error) {
+	err := WriteMessage(con, MsgGetRoots, TipBytes(height))
+	if err != nil {
+		return Roots{}, err
+	}
+	t, payload, err := ReadMessage(con)
+	if err != nil {
+		return Roots{}, err
+	}
+	switch t {
+	case MsgRoots:
+	case MsgReject:
+		return Roots{}, fmt.Errorf("server rejected roots request: %s",
+			payload)
+	default:
+		return Roots{}, fmt.Errorf("got message type %d, expect roots", t)
+	}
+	r, err := RootsFromBytes(payload)
+	if err != nil {
+		return Roots{}, err
+	}
+	if r.Height != height {
+		return Roots{}, fmt.Errorf("asked for roots at %d, got %d",
+			height, r.Height)
+	}
+	return r, nil
+}
@@ -1,13 +1,9 @@
 package wire
 
 import (
-	"encoding/binary"
 	"fmt"
 	"io"
-	"math"
-	"net"
 	"sync"
-	"time"
 
 	"github.com/btcsuite/btcd/blockchain"
 	"github.com/btcsuite/btcd/chaincfg"
@@ -20,51 +16,8 @@ import (
 	"github.com/mit-dci/utreexo/util"
 )
 
-// UblockNetworkReader gets Ublocks from the remote host and puts em in the
-// channel.  It'll try to fill the channel buffer.
-func UblockNetworkReader(
-	blockChan chan UBlock, remoteServer string,
-	curHeight, lookahead int32) {
-
-	d := net.Dialer{Timeout: 2 * time.Second}
-	con, err := d.Dial("tcp", remoteServer)
-	if err != nil {
-		panic(err)
-	}
-	defer con.Close()
-	defer close(blockChan)
-
-	var ub UBlock
-	// var ublen uint32
-	// request range from curHeight to latest block
-	err = binary.Write(con, binary.BigEndian, curHeight)
-	if err != nil {
-		e := fmt.Errorf("UblockNetworkReader: write error to connection %s %s\n",
-			con.RemoteAddr().String(), err.Error())
-		panic(e)
-	}
-	err = binary.Write(con, binary.BigEndian, int32(math.MaxInt32))
-	if err != nil {
-		e := fmt.Errorf("UblockNetworkReader: write error to connection %s %s\n",
-			con.RemoteAddr().String(), err.Error())
-		panic(e)
-	}
-
-	// TODO goroutines for only the Deserialize part might be nice.
-	// Need to sort the blocks though if you're doing that
-	for ; ; curHeight++ {
-
-		err = ub.Deserialize(con)
-		if err != nil {
-			fmt.Printf("Deserialize error from connection %s %s\n",
-				con.RemoteAddr().String(), err.Error())
-			return
-		}
-		blockChan <- ub
-	}
-}
-
-// BlockToAdds turns all the new utxos in a msgblock into leafTxos
+// BlockToAdds turns all the new utxos in a msgblock into leafTxos, hashed
+// with h.
 // uses remember slice up to number of txos, but doesn't check that it's the
 // right length.  Similar with skiplist, doesn't check it.
 func BlockToAddLeaves(
@@ -72,12 +25,43 @@ func BlockToAddLeaves(
 	remember []bool,
 	skiplist []uint32,
 	height int32,
-	outCount uint32) (leaves []accumulator.Leaf) {
+	outCount uint32,
+	h accumulator.Hasher) (leaves []accumulator.Leaf) {
 
 	// We're overallocating a little bit since all the unspendables
 	// won't be appended. It's ok though for the pre-allocation savings.
 	leaves = make([]accumulator.Leaf, 0, outCount-uint32(len(skiplist)))
 
+	blockToAdds(blk, skiplist, height, func(txonum uint32, l btcacc.LeafData) {
+		uleaf := accumulator.Leaf{Hash: l.LeafHashWith(h)}
+		if uint32(len(remember)) > txonum {
+			uleaf.Remember = remember[txonum]
+		}
+		leaves = append(leaves, uleaf)
+	})
+	return
+}
+
+// BlockToAddLeafData is like BlockToAddLeaves, but gives the LeafData of
+// the new utxos instead of their hashes
+func BlockToAddLeafData(
+	blk *btcutil.Block,
+	skiplist []uint32,
+	height int32,
+	outCount uint32) (lds []btcacc.LeafData) {
+
+	lds = make([]btcacc.LeafData, 0, outCount-uint32(len(skiplist)))
+	blockToAdds(blk, skiplist, height, func(_ uint32, l btcacc.LeafData) {
+		lds = append(lds, l)
+	})
+	return
+}
+
+// blockToAdds calls add for each txo in the block that goes in the
+// accumulator, with its position among all the txos in the block
+func blockToAdds(blk *btcutil.Block, skiplist []uint32, height int32,
+	add func(txonum uint32, l btcacc.LeafData)) {
+
 	var txonum uint32
 	for coinbaseif0, tx := range blk.Transactions() {
 		// cache txid aka txhash
@@ -106,15 +90,10 @@ func BlockToAddLeaves(
 			}
 			l.Amt = out.Value
 			l.PkScript = out.PkScript
-			uleaf := accumulator.Leaf{Hash: l.LeafHash()}
-			if uint32(len(remember)) > txonum {
-				uleaf.Remember = remember[txonum]
-			}
-			leaves = append(leaves, uleaf)
+			add(txonum, l)
 			txonum++
 		}
 	}
-	return
 }
 
 // UBlock is a regular block, with Udata stuck on
@@ -262,6 +241,29 @@ func (ub *UBlock) Deserialize(r io.Reader) (err error) {
 	return
 }
 
+// DeserializeCompact reads a block followed by compact udata
+func (ub *UBlock) DeserializeCompact(r io.Reader) (err error) {
+	var msgBlock wire.MsgBlock
+	err = msgBlock.Deserialize(r)
+	if err != nil {
+		return err
+	}
+
+	ub.Block = btcutil.NewBlock(&msgBlock)
+	err = ub.UtreexoData.DeserializeCompact(r, ub.Block)
+	return
+}
+
+// SerializeCompact writes the block and then the compact udata
+func (ub *UBlock) SerializeCompact(w io.Writer) (err error) {
+	err = ub.Block.MsgBlock().Serialize(w)
+	if err != nil {
+		return
+	}
+	err = ub.UtreexoData.SerializeCompact(w)
+	return
+}
+
 // We don't actually call serialize since from the server side we don't
 // serialize, we just glom stuff together from the disk and send it over.
 func (ub *UBlock) Serialize(w io.Writer) (err error) {